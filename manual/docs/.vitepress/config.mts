@@ -38,7 +38,8 @@ export default defineConfig({
       {
         text: '参考',
         items: [
-          { text: '关于项目', link: '/reference/about-project' }
+          { text: '关于项目', link: '/reference/about-project' },
+          { text: '配置参考', link: '/reference/config' }
         ]
       },
       {
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+)
+
+// registerAdminHandlers 注册 /admin/ 管理接口；是否启用取决于当前配置的 admin_token，热重载后即时生效。
+func registerAdminHandlers() {
+	http.HandleFunc("GET /admin/sessions", withAdminAuth(func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, map[string]any{"sessions": listSessions()})
+	}))
+	http.HandleFunc("POST /admin/sessions/{id}/close", withAdminAuth(func(w http.ResponseWriter, r *http.Request) {
+		sess := lookupSession(r.PathValue("id"))
+		if sess == nil {
+			writeAdminJSON(w, http.StatusNotFound, map[string]string{"error": "session not found"})
+			return
+		}
+		loggerA.Info("管理接口关闭会话", "session", sess.id, "route", sess.route, "remote", r.RemoteAddr)
+		sess.close("closed by admin")
+		writeAdminJSON(w, http.StatusOK, map[string]string{"status": "closed", "id": sess.id})
+	}))
+	http.HandleFunc("POST /admin/sessions/{id}/reconnect", withAdminAuth(func(w http.ResponseWriter, r *http.Request) {
+		sess := lookupSession(r.PathValue("id"))
+		if sess == nil {
+			writeAdminJSON(w, http.StatusNotFound, map[string]string{"error": "session not found"})
+			return
+		}
+		if err := sess.reconnectUpstream(); err != nil {
+			loggerA.Error("管理接口重连协议端失败", "session", sess.id, "route", sess.route, "err", err)
+			writeAdminJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+			return
+		}
+		loggerA.Info("管理接口重连协议端", "session", sess.id, "route", sess.route, "remote", r.RemoteAddr)
+		writeAdminJSON(w, http.StatusOK, sess.info())
+	}))
+}
+
+// withAdminAuth 校验 Authorization: Bearer <admin_token>；未配置 admin_token 时接口表现为不存在。
+func withAdminAuth(h http.HandlerFunc) http.HandlerFunc {
+	return withHTTPLogging(func(w http.ResponseWriter, r *http.Request) {
+		token := currentConfig().AdminToken
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		got := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+token)) != 1 {
+			loggerA.Warn("管理接口未授权访问", "remote", r.RemoteAddr, "path", r.URL.Path)
+			writeAdminJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		h(w, r)
+	})
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditConfig 为消息审计日志配置：将经过代理的每条动作以 JSONL 记录到 file，修改后需重启。
+type AuditConfig struct {
+	// File 审计日志路径，为空时不记录
+	File string `json:"file"`
+	// Actions 只记录这些动作，留空记录全部
+	Actions []string `json:"actions"`
+	// RedactPatterns 额外的脱敏正则，匹配内容替换为 ***
+	RedactPatterns []string `json:"redact_patterns"`
+	// Base64Keep base64 负载保留的前缀字符数，默认 0（只记录长度）
+	Base64Keep int `json:"base64_keep"`
+	// ResultTimeout 等待协议端响应的秒数，超时后以 no_response 记录，默认 30
+	ResultTimeout int `json:"result_timeout"`
+
+	MaxSizeMB      int    `json:"max_size_mb"`
+	RotateInterval string `json:"rotate_interval"`
+	MaxBackups     int    `json:"max_backups"`
+	MaxAgeDays     int    `json:"max_age_days"`
+	Compress       bool   `json:"compress"`
+}
+
+// auditRecord 为审计日志中的一行
+type auditRecord struct {
+	Time    time.Time   `json:"time"`
+	RID     string      `json:"rid,omitempty"`
+	Route   string      `json:"route"`
+	Session string      `json:"session"`
+	SelfID  string      `json:"self_id,omitempty"`
+	Action  string      `json:"action"`
+	GroupID string      `json:"group_id,omitempty"`
+	UserID  string      `json:"user_id,omitempty"`
+	Message string      `json:"message,omitempty"`
+	Echo    interface{} `json:"echo,omitempty"`
+	// Result 为 ok、failed（协议端响应）、sent（无 echo）、rejected（引用了禁止读取的路径）、send_error 或 no_response
+	Result  string `json:"result"`
+	Retcode *int   `json:"retcode,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// defaultRedactPatterns 脱敏 URL 与 CQ 码参数中的令牌
+var defaultRedactPatterns = []string{
+	`(?i)((?:access_token|token|secret|password|key)=)[^&\s,\]"]+`,
+}
+
+type auditSink struct {
+	out        *rotatingFile
+	actions    map[string]bool
+	redact     []*regexp.Regexp
+	base64Keep int
+	timeout    time.Duration
+}
+
+// auditor 为全局审计输出，未启用时为 nil
+var auditor *auditSink
+
+func newAuditSink(ac AuditConfig) (*auditSink, error) {
+	a := &auditSink{base64Keep: ac.Base64Keep, timeout: 30 * time.Second}
+	if ac.ResultTimeout > 0 {
+		a.timeout = time.Duration(ac.ResultTimeout) * time.Second
+	}
+	if len(ac.Actions) > 0 {
+		a.actions = map[string]bool{}
+		for _, act := range ac.Actions {
+			a.actions[strings.TrimSpace(act)] = true
+		}
+	}
+	for _, p := range append(append([]string{}, defaultRedactPatterns...), ac.RedactPatterns...) {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("audit.redact_patterns: %w", err)
+		}
+		a.redact = append(a.redact, re)
+	}
+	if ac.File == "" {
+		return a, nil
+	}
+	maxSize, maxBackups := ac.MaxSizeMB, ac.MaxBackups
+	if maxSize == 0 {
+		maxSize = 100
+	}
+	if maxBackups == 0 {
+		maxBackups = 30
+	}
+	out, err := openRotatingFile(ac.File, logRotateOptions{
+		MaxSizeMB:  maxSize,
+		Interval:   ac.RotateInterval,
+		MaxBackups: maxBackups,
+		MaxAgeDays: ac.MaxAgeDays,
+		Compress:   ac.Compress,
+	})
+	if err != nil {
+		return nil, err
+	}
+	a.out = out
+	return a, nil
+}
+
+func (a *auditSink) write(rec *auditRecord) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	if _, err := a.out.Write(append(b, '\n')); err != nil {
+		loggerA.Error("写入审计日志失败", "err", err)
+	}
+}
+
+// sanitize 截断 base64 负载并按规则脱敏
+func (a *auditSink) sanitize(s string) string {
+	s = shortenBase64(s, a.base64Keep)
+	for _, re := range a.redact {
+		s = re.ReplaceAllStringFunc(s, func(m string) string {
+			if sub := re.FindStringSubmatch(m); len(sub) > 1 && sub[1] != "" {
+				return sub[1] + "***"
+			}
+			return "***"
+		})
+	}
+	return s
+}
+
+// auditPending 为等待协议端响应的审计记录，按 echo 对应
+type auditPending struct {
+	mu      sync.Mutex
+	records map[string]*auditRecord
+}
+
+// auditBegin 在改写后的动作发往协议端之前创建审计记录；带 echo 的动作先登记，
+// 以免响应先于登记到达，等收到响应后再写入。未启用或不需记录时返回 nil。
+func auditBegin(sess *session, rid string, msg []byte) *auditRecord {
+	a := auditor
+	if a == nil {
+		return nil
+	}
+	var cmd oneBotCommand
+	if json.Unmarshal(msg, &cmd) != nil || cmd.Action == "" {
+		return nil
+	}
+	if a.actions != nil && !a.actions[cmd.Action] {
+		return nil
+	}
+	p, _ := cmd.Params.(map[string]interface{})
+	info := sess.info()
+	rec := &auditRecord{
+		Time:    time.Now(),
+		RID:     rid,
+		Route:   info.Route,
+		Session: info.ID,
+		SelfID:  info.SelfID,
+		Action:  cmd.Action,
+		GroupID: idString(p["group_id"]),
+		UserID:  idString(p["user_id"]),
+		Message: a.sanitize(renderAuditMessage(p)),
+		Echo:    cmd.Echo,
+	}
+	a.expire(sess)
+	if cmd.Echo != nil {
+		sess.audit.mu.Lock()
+		if sess.audit.records == nil {
+			sess.audit.records = map[string]*auditRecord{}
+		}
+		sess.audit.records[echoKey(cmd.Echo)] = rec
+		sess.audit.mu.Unlock()
+	}
+	return rec
+}
+
+// auditSent 在发送完成后写入无需等待响应的记录；发送失败时撤销登记并记录错误。
+func auditSent(sess *session, rec *auditRecord, sendErr error) {
+	if rec == nil {
+		return
+	}
+	if sendErr == nil && rec.Echo != nil {
+		return
+	}
+	if rec.Echo != nil {
+		key := echoKey(rec.Echo)
+		sess.audit.mu.Lock()
+		if sess.audit.records[key] != rec {
+			// 响应已经到达并写入
+			sess.audit.mu.Unlock()
+			return
+		}
+		delete(sess.audit.records, key)
+		sess.audit.mu.Unlock()
+	}
+	rec.Result = "sent"
+	if sendErr != nil {
+		rec.Result = "send_error"
+		if errors.Is(sendErr, errPathDenied) {
+			rec.Result = "rejected"
+		}
+		rec.Error = sendErr.Error()
+	}
+	auditor.write(rec)
+}
+
+// auditResponse 用协议端的响应补全对应 echo 的审计记录。
+func auditResponse(sess *session, msg []byte) {
+	if auditor == nil || !strings.Contains(string(msg), `"echo"`) {
+		return
+	}
+	var resp struct {
+		Status  string      `json:"status"`
+		Retcode *int        `json:"retcode"`
+		Echo    interface{} `json:"echo"`
+		Msg     string      `json:"msg"`
+		Wording string      `json:"wording"`
+	}
+	if json.Unmarshal(msg, &resp) != nil || resp.Echo == nil {
+		return
+	}
+	key := echoKey(resp.Echo)
+	sess.audit.mu.Lock()
+	rec := sess.audit.records[key]
+	delete(sess.audit.records, key)
+	sess.audit.mu.Unlock()
+	if rec == nil {
+		return
+	}
+	rec.Retcode = resp.Retcode
+	rec.Result = "ok"
+	if resp.Status == "failed" || (resp.Retcode != nil && *resp.Retcode != 0) {
+		rec.Result = "failed"
+		rec.Error = strings.TrimSpace(resp.Msg + " " + resp.Wording)
+	}
+	auditor.write(rec)
+}
+
+// expire 写出等待响应超时的记录
+func (a *auditSink) expire(sess *session) {
+	cutoff := time.Now().Add(-a.timeout)
+	a.flush(sess, func(rec *auditRecord) bool { return rec.Time.Before(cutoff) })
+}
+
+// auditSessionClosed 在会话结束时写出仍在等待响应的记录
+func auditSessionClosed(sess *session) {
+	if auditor == nil {
+		return
+	}
+	auditor.flush(sess, func(*auditRecord) bool { return true })
+}
+
+func (a *auditSink) flush(sess *session, match func(*auditRecord) bool) {
+	var out []*auditRecord
+	sess.audit.mu.Lock()
+	for k, rec := range sess.audit.records {
+		if match(rec) {
+			out = append(out, rec)
+			delete(sess.audit.records, k)
+		}
+	}
+	sess.audit.mu.Unlock()
+	for _, rec := range out {
+		rec.Result = "no_response"
+		a.write(rec)
+	}
+}
+
+func echoKey(echo interface{}) string {
+	b, _ := json.Marshal(echo)
+	return string(b)
+}
+
+func idString(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case json.Number:
+		return t.String()
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+// renderAuditMessage 将动作参数中的消息渲染为 CQ 码文本，媒体显示为改写后的 URL / 路径。
+func renderAuditMessage(p map[string]interface{}) string {
+	if p == nil {
+		return ""
+	}
+	if m, ok := p["message"]; ok {
+		return renderMessage(m)
+	}
+	if m, ok := p["messages"]; ok {
+		return renderMessage(m)
+	}
+	if f, ok := p["file"].(string); ok && f != "" {
+		if name, _ := p["name"].(string); name != "" {
+			return fmt.Sprintf("[CQ:file,file=%s,name=%s]", f, name)
+		}
+		return fmt.Sprintf("[CQ:file,file=%s]", f)
+	}
+	return ""
+}
+
+func renderMessage(m interface{}) string {
+	switch t := m.(type) {
+	case string:
+		return t
+	case map[string]interface{}:
+		return renderSegment(t)
+	case []interface{}:
+		var sb strings.Builder
+		for _, seg := range t {
+			if s, ok := seg.(map[string]interface{}); ok {
+				if sb.Len() > 0 && s["type"] == "node" {
+					sb.WriteString("\n")
+				}
+				sb.WriteString(renderSegment(s))
+			}
+		}
+		return sb.String()
+	}
+	return ""
+}
+
+func renderSegment(seg map[string]interface{}) string {
+	typ, _ := seg["type"].(string)
+	data, _ := seg["data"].(map[string]interface{})
+	switch typ {
+	case "text":
+		s, _ := data["text"].(string)
+		return s
+	case "node":
+		if c, ok := data["content"]; ok {
+			return renderMessage(c)
+		}
+		return "[CQ:node,id=" + idString(data["id"]) + "]"
+	}
+	var sb strings.Builder
+	sb.WriteString("[CQ:" + typ)
+	for _, k := range []string{"file", "url", "id", "qq", "name"} {
+		if v, ok := data[k]; ok && v != nil && v != "" {
+			sb.WriteString("," + k + "=" + idString(v))
+		}
+	}
+	sb.WriteString("]")
+	return sb.String()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// runAuditCLI 实现 `middleware-a audit`：按群、用户、动作与时间范围查询审计日志（含轮转后的旧文件）。
+func runAuditCLI(args []string) int {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	cfgPath := fs.String("config", "config.json", "config path，用于读取 audit.file")
+	file := fs.String("file", "", "审计日志路径，默认取配置中的 audit.file")
+	group := fs.String("group", "", "群号")
+	user := fs.String("user", "", "QQ 号")
+	action := fs.String("action", "", "动作名")
+	result := fs.String("result", "", "结果：ok、failed、sent、rejected、send_error、no_response")
+	since := fs.String("since", "", "开始时间，如 2024-05-01、\"2024-05-01 12:00\" 或 24h（表示最近 24 小时）")
+	until := fs.String("until", "", "结束时间，格式同 -since")
+	asJSON := fs.Bool("json", false, "按原始 JSONL 输出")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	path := *file
+	if path == "" {
+		var cfg struct {
+			Audit AuditConfig `json:"audit"`
+		}
+		if b, err := os.ReadFile(*cfgPath); err == nil {
+			_ = json.Unmarshal(b, &cfg)
+		}
+		path = cfg.Audit.File
+	}
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "未指定审计日志：使用 -file 或在配置中设置 audit.file")
+		return 2
+	}
+	from, err := parseAuditTime(*since)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "-since:", err)
+		return 2
+	}
+	to, err := parseAuditTime(*until)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "-until:", err)
+		return 2
+	}
+	match := func(rec *auditRecord) bool {
+		return (*group == "" || rec.GroupID == *group) &&
+			(*user == "" || rec.UserID == *user) &&
+			(*action == "" || rec.Action == *action) &&
+			(*result == "" || rec.Result == *result) &&
+			(from.IsZero() || !rec.Time.Before(from)) &&
+			(to.IsZero() || rec.Time.Before(to))
+	}
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for _, f := range auditFiles(path) {
+		if err := scanAuditFile(f, func(line []byte, rec *auditRecord) {
+			if !match(rec) {
+				return
+			}
+			if *asJSON {
+				out.Write(line)
+				out.WriteByte('\n')
+				return
+			}
+			target := "group=" + rec.GroupID
+			if rec.GroupID == "" {
+				target = "user=" + rec.UserID
+			}
+			fmt.Fprintf(out, "%s %s %s %s %s\n", rec.Time.Local().Format("2006-01-02 15:04:05"), rec.Action, target, rec.Result, rec.Message)
+		}); err != nil {
+			fmt.Fprintln(os.Stderr, f+":", err)
+		}
+	}
+	return 0
+}
+
+// parseAuditTime 解析本地时间或相对时长（如 24h 表示当前时间往前 24 小时）
+func parseAuditTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("无法解析时间 %q", s)
+}
+
+// auditFiles 按时间顺序返回轮转后的旧文件与当前文件
+func auditFiles(path string) []string {
+	ext := filepath.Ext(path)
+	prefix := filepath.Base(strings.TrimSuffix(path, ext)) + "-"
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	var backups []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".gz"), ext)
+		if _, err := time.Parse(backupTimeFormat, stamp); err == nil {
+			backups = append(backups, filepath.Join(filepath.Dir(path), name))
+		}
+	}
+	// 时间戳格式按字典序即时间顺序
+	sort.Strings(backups)
+	return append(backups, path)
+}
+
+func scanAuditFile(path string, fn func(line []byte, rec *auditRecord)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	for sc.Scan() {
+		var rec auditRecord
+		if json.Unmarshal(sc.Bytes(), &rec) != nil {
+			continue
+		}
+		fn(sc.Bytes(), &rec)
+	}
+	return sc.Err()
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditSanitize(t *testing.T) {
+	cases := []struct {
+		name     string
+		patterns []string
+		keep     int
+		in       string
+		want     string
+	}{
+		{name: "URL 中的 access_token", in: "[CQ:image,file=http://b/files/1?access_token=abc&x=1]", want: "[CQ:image,file=http://b/files/1?access_token=***&x=1]"},
+		{name: "忽略大小写", in: "http://b/f?Token=abc PASSWORD=p1", want: "http://b/f?Token=*** PASSWORD=***"},
+		{name: "CQ 码参数在逗号处截止", in: "[CQ:x,key=k1,secret=s1]", want: "[CQ:x,key=***,secret=***]"},
+		{name: "无匹配时原样保留", in: "hello tokens", want: "hello tokens"},
+		{name: "自定义规则无捕获组时整段替换", patterns: []string{`\d{11}`}, in: "手机 13800138000", want: "手机 ***"},
+		{name: "自定义规则保留第一个捕获组", patterns: []string{`(身份证:)\d+`}, in: "身份证:110101", want: "身份证:***"},
+		{name: "截断 base64", in: "[CQ:image,file=base64://aGVsbG8gd29ybGQh]", want: "[CQ:image,file=base64://[12 bytes]]"},
+		{name: "base64 保留前缀", keep: 4, in: "base64://aGVsbG8gd29ybGQh", want: "base64://aGVs…[12 bytes]"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := newAuditSink(AuditConfig{RedactPatterns: tc.patterns, Base64Keep: tc.keep})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := a.sanitize(tc.in); got != tc.want {
+				t.Errorf("sanitize = %q，期望 %q", got, tc.want)
+			}
+		})
+	}
+	if _, err := newAuditSink(AuditConfig{RedactPatterns: []string{"("}}); err == nil || !strings.Contains(err.Error(), "audit.redact_patterns") {
+		t.Errorf("无效正则应报错，得到 %v", err)
+	}
+}
+
+// useTestAuditor 启用写入临时文件的审计输出，返回读取已写入记录的函数
+func useTestAuditor(t *testing.T, ac AuditConfig) func() []auditRecord {
+	t.Helper()
+	ac.File = filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := newAuditSink(ac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditor = a
+	t.Cleanup(func() { auditor = nil })
+	return func() []auditRecord {
+		t.Helper()
+		f, err := os.Open(ac.File)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var out []auditRecord
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var rec auditRecord
+			if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+				t.Fatalf("无效的审计记录 %s: %v", sc.Text(), err)
+			}
+			out = append(out, rec)
+		}
+		return out
+	}
+}
+
+func auditAction(echo string) []byte {
+	msg := `{"action":"send_group_msg","params":{"group_id":123,"message":"hi"}`
+	if echo != "" {
+		msg += `,"echo":` + echo
+	}
+	return []byte(msg + "}")
+}
+
+// 带 echo 的动作等协议端响应后按 echo 写入结果，各种发送与响应顺序下每个动作只写一条记录
+func TestAuditEchoMatching(t *testing.T) {
+	retcode := func(n int) *int { return &n }
+	cases := []struct {
+		name    string
+		actions []string
+		run     func(sess *session)
+		want    []auditRecord
+		pending int // 仍在等待响应的记录数
+	}{
+		{
+			name: "响应成功",
+			run: func(sess *session) {
+				auditSent(sess, auditBegin(sess, "r1", auditAction(`"e1"`)), nil)
+				auditResponse(sess, []byte(`{"status":"ok","retcode":0,"data":null,"echo":"e1"}`))
+			},
+			want: []auditRecord{{RID: "r1", Action: "send_group_msg", GroupID: "123", Message: "hi", Echo: "e1", Result: "ok", Retcode: retcode(0)}},
+		},
+		{
+			name: "响应失败时记录 retcode 与错误",
+			run: func(sess *session) {
+				auditSent(sess, auditBegin(sess, "", auditAction(`"e1"`)), nil)
+				auditResponse(sess, []byte(`{"status":"failed","retcode":1200,"msg":"发送失败","wording":"群不存在","echo":"e1"}`))
+			},
+			want: []auditRecord{{Echo: "e1", Result: "failed", Retcode: retcode(1200), Error: "发送失败 群不存在"}},
+		},
+		{
+			name: "数字 echo",
+			run: func(sess *session) {
+				auditSent(sess, auditBegin(sess, "", auditAction(`42`)), nil)
+				auditResponse(sess, []byte(`{"status":"ok","retcode":0,"echo":"42"}`))
+				auditResponse(sess, []byte(`{"status":"ok","retcode":0,"echo":42}`))
+			},
+			want: []auditRecord{{Echo: float64(42), Result: "ok", Retcode: retcode(0)}},
+		},
+		{
+			name: "响应先于发送完成到达",
+			run: func(sess *session) {
+				rec := auditBegin(sess, "", auditAction(`"e1"`))
+				auditResponse(sess, []byte(`{"status":"ok","retcode":0,"echo":"e1"}`))
+				auditSent(sess, rec, nil)
+			},
+			want: []auditRecord{{Echo: "e1", Result: "ok", Retcode: retcode(0)}},
+		},
+		{
+			name: "响应已写入后不再记录发送错误",
+			run: func(sess *session) {
+				rec := auditBegin(sess, "", auditAction(`"e1"`))
+				auditResponse(sess, []byte(`{"status":"ok","retcode":0,"echo":"e1"}`))
+				auditSent(sess, rec, errors.New("broken pipe"))
+			},
+			want: []auditRecord{{Echo: "e1", Result: "ok", Retcode: retcode(0)}},
+		},
+		{
+			name: "不匹配的响应被忽略",
+			run: func(sess *session) {
+				auditSent(sess, auditBegin(sess, "", auditAction(`"e1"`)), nil)
+				auditResponse(sess, []byte(`{"status":"ok","retcode":0,"echo":"other"}`))
+				auditResponse(sess, []byte(`{"post_type":"message","raw_message":"\"echo\""}`))
+			},
+			pending: 1,
+		},
+		{
+			name: "无 echo 时发送后即写入",
+			run: func(sess *session) {
+				auditSent(sess, auditBegin(sess, "", auditAction("")), nil)
+			},
+			want: []auditRecord{{Result: "sent"}},
+		},
+		{
+			name: "发送失败",
+			run: func(sess *session) {
+				rec := auditBegin(sess, "", auditAction(`"e1"`))
+				auditSent(sess, rec, errors.New("broken pipe"))
+				auditResponse(sess, []byte(`{"status":"ok","retcode":0,"echo":"e1"}`))
+			},
+			want: []auditRecord{{Echo: "e1", Result: "send_error", Error: "broken pipe"}},
+		},
+		{
+			name: "引用禁止读取的路径",
+			run: func(sess *session) {
+				auditSent(sess, auditBegin(sess, "", auditAction(`"e1"`)), fmt.Errorf("/etc/passwd: %w", errPathDenied))
+			},
+			want: []auditRecord{{Echo: "e1", Result: "rejected", Error: "/etc/passwd: " + errPathDenied.Error()}},
+		},
+		{
+			name: "会话结束时写出未响应的记录",
+			run: func(sess *session) {
+				auditSent(sess, auditBegin(sess, "", auditAction(`"e1"`)), nil)
+				auditSessionClosed(sess)
+				auditResponse(sess, []byte(`{"status":"ok","retcode":0,"echo":"e1"}`))
+			},
+			want: []auditRecord{{Echo: "e1", Result: "no_response"}},
+		},
+		{
+			name:    "只记录 actions 中的动作",
+			actions: []string{"upload_group_file"},
+			run: func(sess *session) {
+				if rec := auditBegin(sess, "", auditAction(`"e1"`)); rec != nil {
+					t.Errorf("不在 actions 中的动作不应记录: %+v", rec)
+				}
+				auditResponse(sess, []byte(`{"status":"ok","retcode":0,"echo":"e1"}`))
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			records := useTestAuditor(t, AuditConfig{Actions: tc.actions})
+			sess := &session{id: "s1", route: "default"}
+			tc.run(sess)
+			got := records()
+			if len(got) != len(tc.want) {
+				t.Fatalf("写入 %d 条记录，期望 %d: %+v", len(got), len(tc.want), got)
+			}
+			for i, want := range tc.want {
+				rec := got[i]
+				if rec.Session != "s1" || rec.Route != "default" {
+					t.Errorf("会话信息 %q/%q", rec.Session, rec.Route)
+				}
+				if want.Action != "" && (rec.RID != want.RID || rec.Action != want.Action || rec.GroupID != want.GroupID || rec.Message != want.Message) {
+					t.Errorf("记录 %+v，期望 %+v", rec, want)
+				}
+				if fmt.Sprint(rec.Echo) != fmt.Sprint(want.Echo) || rec.Result != want.Result || rec.Error != want.Error {
+					t.Errorf("echo/result/error = %v/%q/%q，期望 %v/%q/%q", rec.Echo, rec.Result, rec.Error, want.Echo, want.Result, want.Error)
+				}
+				if (rec.Retcode == nil) != (want.Retcode == nil) || (rec.Retcode != nil && *rec.Retcode != *want.Retcode) {
+					t.Errorf("retcode = %v，期望 %v", rec.Retcode, want.Retcode)
+				}
+			}
+			if n := len(sess.audit.records); n != tc.pending {
+				t.Errorf("%d 条记录在等待响应，期望 %d", n, tc.pending)
+			}
+		})
+	}
+}
+
+// 未启用审计时各钩子不做任何事
+func TestAuditDisabled(t *testing.T) {
+	sess := &session{id: "s1"}
+	if rec := auditBegin(sess, "", auditAction(`"e1"`)); rec != nil {
+		t.Fatalf("未启用时返回 %+v", rec)
+	}
+	auditSent(sess, nil, nil)
+	auditResponse(sess, []byte(`{"echo":"e1"}`))
+	auditSessionClosed(sess)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServerTokens(t *testing.T) {
+	cfg := &Config{ServerAccessToken: " old ", ServerAccessTokens: []string{"new", "  ", "next"}}
+	if got, want := cfg.serverTokens(), []string{"old", "new", "next"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("serverTokens = %v，期望 %v", got, want)
+	}
+	if got := (&Config{ServerAccessTokens: []string{""}}).serverTokens(); len(got) != 0 {
+		t.Errorf("全部为空时应不鉴权，得到 %v", got)
+	}
+}
+
+func TestRequestToken(t *testing.T) {
+	cases := []struct {
+		name   string
+		header string
+		query  string
+		want   string
+	}{
+		{name: "Bearer", header: "Bearer abc", want: "abc"},
+		{name: "bearer 小写", header: "bearer  abc ", want: "abc"},
+		{name: "Token", header: "Token abc", want: "abc"},
+		{name: "查询参数", query: "access_token=abc", want: "abc"},
+		{name: "头优先于查询参数", header: "Bearer h", query: "access_token=q", want: "h"},
+		{name: "不支持的头不回退到查询参数", header: "Basic abc", query: "access_token=q"},
+		{name: "只有前缀", header: "Bearer "},
+		{name: "都没有"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/ws?"+tc.query, nil)
+			if tc.header != "" {
+				r.Header.Set("Authorization", tc.header)
+			}
+			if got := requestToken(r); got != tc.want {
+				t.Errorf("requestToken = %q，期望 %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTokenMatches(t *testing.T) {
+	tokens := []string{"old", "new"}
+	for got, want := range map[string]bool{"old": true, "new": true, "ol": false, "newer": false, "": false} {
+		if tokenMatches(got, tokens) != want {
+			t.Errorf("tokenMatches(%q) 应为 %v", got, want)
+		}
+	}
+	if tokenMatches("", []string{""}) {
+		t.Error("空 token 不应通过")
+	}
+}
+
+// 配置多个 token 时，经 Authorization 头与 access_token 查询参数携带任一 token 都能通过
+func TestAuthorizeServerTokens(t *testing.T) {
+	cfg := loadTestConfig(t, map[string]any{
+		"upstream_ws_url":      "ws://127.0.0.1:1",
+		"server_access_token":  "old",
+		"server_access_tokens": []string{"new"},
+		"auth_max_failures":    -1,
+	}).routes[0]
+	cases := []struct {
+		name   string
+		header string
+		query  string
+		want   int
+	}{
+		{name: "旧 token 经 Bearer", header: "Bearer old", want: http.StatusOK},
+		{name: "新 token 经 Token", header: "Token new", want: http.StatusOK},
+		{name: "新 token 经查询参数", query: "access_token=new", want: http.StatusOK},
+		{name: "错误 token", header: "Bearer bad", want: http.StatusUnauthorized},
+		{name: "错误的头不回退到查询参数", header: "Basic new", query: "access_token=new", want: http.StatusUnauthorized},
+		{name: "未携带 token", want: http.StatusUnauthorized},
+	}
+	for i, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/ws?"+tc.query, nil)
+			r.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", i+1)
+			if tc.header != "" {
+				r.Header.Set("Authorization", tc.header)
+			}
+			w := httptest.NewRecorder()
+			ok := authorizeServer(w, r, cfg)
+			if ok != (tc.want == http.StatusOK) || (!ok && w.Code != tc.want) {
+				t.Errorf("ok = %v，状态码 %d，期望 %d", ok, w.Code, tc.want)
+			}
+		})
+	}
+	if !authorizeServer(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ws", nil), &Config{}) {
+		t.Error("未配置 token 时应放行")
+	}
+}
+
+func TestAuthGuard(t *testing.T) {
+	const window, ban = time.Minute, 10 * time.Minute
+	base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	type step struct {
+		at   time.Duration
+		op   string // fail / reset / check
+		want bool   // fail 是否开始封禁；check 是否处于封禁中
+	}
+	cases := []struct {
+		name  string
+		max   int
+		steps []step
+	}{
+		{"达到上限后封禁", 3, []step{
+			{0, "fail", false}, {time.Second, "fail", false}, {2 * time.Second, "fail", true},
+			{3 * time.Second, "check", true}, {ban, "check", true},
+		}},
+		{"封禁到期后解除", 2, []step{
+			{0, "fail", false}, {0, "fail", true},
+			{ban - time.Second, "check", true}, {ban, "check", false},
+			// 到期后重新计数
+			{ban, "fail", false}, {ban + time.Second, "fail", true},
+		}},
+		{"窗口过后重新计数", 3, []step{
+			{0, "fail", false}, {time.Second, "fail", false},
+			{window + 2*time.Second, "fail", false}, {window + 3*time.Second, "fail", false},
+			{window + 3*time.Second, "check", false}, {window + 4*time.Second, "fail", true},
+		}},
+		{"成功后清零", 2, []step{
+			{0, "fail", false}, {0, "reset", false}, {time.Second, "fail", false}, {time.Second, "check", false},
+		}},
+		{"上限为负数时只记录不封禁", -1, []step{
+			{0, "fail", false}, {0, "fail", false}, {0, "fail", false}, {0, "check", false},
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			g := &authGuard{clients: map[string]*authState{}}
+			for i, s := range tc.steps {
+				now := base.Add(s.at)
+				var got bool
+				switch s.op {
+				case "fail":
+					got = g.fail("192.0.2.1", tc.max, window, ban, now)
+				case "reset":
+					g.reset("192.0.2.1")
+					continue
+				case "check":
+					got = g.bannedFor("192.0.2.1", now) > 0
+				}
+				if got != s.want {
+					t.Fatalf("第 %d 步 %s@%v = %v，期望 %v", i, s.op, s.at, got, s.want)
+				}
+				if g.bannedFor("192.0.2.2", now) != 0 {
+					t.Fatal("封禁不应影响其他 IP")
+				}
+			}
+		})
+	}
+}
+
+// 同一 IP 连续失败后返回 429 与 Retry-After，封禁期间正确的 token 也被拒绝
+func TestAuthorizeServerBan(t *testing.T) {
+	cfg := loadTestConfig(t, map[string]any{
+		"upstream_ws_url":     "ws://127.0.0.1:1",
+		"server_access_token": "secret",
+		"auth_max_failures":   2,
+		"auth_ban_seconds":    60,
+	}).routes[0]
+	const ip = "198.51.100.7"
+	t.Cleanup(func() { serverAuthGuard.reset(ip) })
+	try := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/ws?access_token="+token, nil)
+		r.RemoteAddr = ip + ":5000"
+		w := httptest.NewRecorder()
+		authorizeServer(w, r, cfg)
+		return w
+	}
+	for i := 0; i < 2; i++ {
+		if w := try("bad"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("第 %d 次失败返回 %d，期望 401", i+1, w.Code)
+		}
+	}
+	w := try("secret")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("封禁期间返回 %d，期望 429", w.Code)
+	}
+	if ra := w.Header().Get("Retry-After"); ra != "60" {
+		t.Errorf("Retry-After = %q，期望 60", ra)
+	}
+	// 模拟封禁到期
+	serverAuthGuard.mu.Lock()
+	serverAuthGuard.clients[ip].bannedUntil = time.Now().Add(-time.Second)
+	serverAuthGuard.mu.Unlock()
+	if w := try("secret"); w.Code != http.StatusOK {
+		t.Fatalf("封禁到期后返回 %d，期望放行", w.Code)
+	}
+	if serverAuthGuard.bannedFor(ip, time.Now()) != 0 || serverAuthGuard.clients[ip] != nil {
+		t.Error("鉴权成功后应清除该 IP 的记录")
+	}
+}
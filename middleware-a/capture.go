@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 流量录制：配置 capture_dir 后，每对连接的双向消息按时间写入一个 JSONL 文件，
+// 供 `middleware-a replay` 离线重放。
+
+const (
+	captureOpen  = "open"  // 首行：路由、会话等元信息
+	captureIn    = "in"    // 海豹 -> a，改写前
+	captureOut   = "out"   // a -> 协议端，改写后
+	captureEvent = "event" // 协议端 -> 海豹
+)
+
+// captureRecord 为录制文件中的一行；ms 为相对连接建立的毫秒数。
+type captureRecord struct {
+	MS     int64  `json:"ms"`
+	Dir    string `json:"dir"`
+	Binary bool   `json:"binary,omitempty"`
+	// Data 为消息原文，二进制消息为 base64
+	Data string `json:"data,omitempty"`
+
+	// 以下仅 open 行
+	Route   string     `json:"route,omitempty"`
+	Session string     `json:"session,omitempty"`
+	SelfID  string     `json:"self_id,omitempty"`
+	Time    *time.Time `json:"time,omitempty"`
+}
+
+// captureFile 为一个会话的录制输出，nil 表示未录制。
+type captureFile struct {
+	mu      sync.Mutex
+	f       *os.File
+	started time.Time
+}
+
+// openCapture 在 dir 下创建 <route>-<时间>-<会话>.jsonl 并写入首行。
+func openCapture(dir string, sess *session) (*captureFile, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%s-%s-%s.jsonl", sess.route, sess.started.Format("20060102T150405"), sess.id)
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	c := &captureFile{f: f, started: sess.started}
+	c.write(&captureRecord{Dir: captureOpen, Route: sess.route, Session: sess.id, SelfID: sess.info().SelfID, Time: &sess.started})
+	return c, nil
+}
+
+func (c *captureFile) record(dir string, mt int, msg []byte) {
+	if c == nil {
+		return
+	}
+	rec := newCaptureRecord(time.Since(c.started).Milliseconds(), dir, mt, msg)
+	c.write(&rec)
+}
+
+func newCaptureRecord(ms int64, dir string, mt int, msg []byte) captureRecord {
+	rec := captureRecord{MS: ms, Dir: dir, Data: string(msg)}
+	if mt == websocket.BinaryMessage {
+		rec.Binary = true
+		rec.Data = base64.StdEncoding.EncodeToString(msg)
+	}
+	return rec
+}
+
+func (c *captureFile) write(rec *captureRecord) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.f.Write(append(b, '\n')); err != nil {
+		loggerA.Error("写入录制文件失败", "err", err, "path", c.f.Name())
+	}
+}
+
+func (c *captureFile) Close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.f.Close()
+}
+
+// message 返回录制消息对应的 WebSocket 消息类型与原始内容
+func (rec *captureRecord) message() (int, []byte, error) {
+	if !rec.Binary {
+		return websocket.TextMessage, []byte(rec.Data), nil
+	}
+	b, err := base64.StdEncoding.DecodeString(rec.Data)
+	return websocket.BinaryMessage, b, err
+}
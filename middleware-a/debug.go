@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// 改写调试：开启 debug_rewrite 后，每条命中改写规则的动作输出改写前后的 JSON，
+// 以及每个媒体的处理结果与跳过原因。
+
+const (
+	skipNotMedia       = "not a media type"
+	skipAlreadyHTTP    = "already http"
+	skipEmptyFile      = "empty file"
+	skipCQFileDisabled = "CQ:file unsupported by upstream"
+	skipUploadFailed   = "upload failed"
+)
+
+// rewriteNote 记录一个消息段 / CQ 码 / 字段的处理结果
+type rewriteNote struct {
+	Target string `json:"target"`
+	Source string `json:"source,omitempty"`
+	Result string `json:"result"`
+	Reason string `json:"reason,omitempty"`
+	To     string `json:"to,omitempty"`
+}
+
+// debugBase64Keep 为调试输出中 base64 负载保留的前缀字符数
+const debugBase64Keep = 16
+
+var base64Payload = regexp.MustCompile(`base64://[A-Za-z0-9+/=_-]+`)
+
+// shortenBase64 将 base64:// 负载替换为前 keep 个字符加原始字节数，避免日志被大段内容淹没。
+func shortenBase64(s string, keep int) string {
+	return base64Payload.ReplaceAllStringFunc(s, func(m string) string {
+		data := strings.TrimPrefix(m, "base64://")
+		prefix := ""
+		if keep > 0 && len(data) > keep {
+			prefix = data[:keep] + "…"
+		}
+		return fmt.Sprintf("base64://%s[%d bytes]", prefix, len(data)*3/4)
+	})
+}
+
+func (job *rewriteJob) noteRewrite(target, src, to string) {
+	if job.debug {
+		job.notes = append(job.notes, rewriteNote{Target: target, Source: shortenBase64(src, debugBase64Keep), Result: "rewritten", To: shortenBase64(to, debugBase64Keep)})
+	}
+}
+
+func (job *rewriteJob) noteSkip(target, src, reason string) {
+	if !job.debug {
+		return
+	}
+	if reason == skipUploadFailed && job.uploadErr != "" {
+		reason += ": " + job.uploadErr
+		job.uploadErr = ""
+	}
+	job.notes = append(job.notes, rewriteNote{Target: target, Source: shortenBase64(src, debugBase64Keep), Result: "skipped", Reason: reason})
+}
+
+// dumpRewrite 输出一次动作改写的前后对比
+func (job *rewriteJob) dumpRewrite(before, after []byte) {
+	loggerA.Info("rewrite debug",
+		"rid", requestIDFrom(job.ctx),
+		"route", job.cfg.routeName,
+		"action", job.action,
+		"changed", string(before) != string(after),
+		"before", shortenBase64(string(before), debugBase64Keep),
+		"after", shortenBase64(string(after), debugBase64Keep),
+		"items", job.notes,
+	)
+}
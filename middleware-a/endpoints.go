@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 多个 b 节点：按 priority 分组，组内按 weight 分配上传；定期健康检查，
+// 不健康或熔断中的节点排在最后，上传失败时依次切换到下一个节点。
+
+// UploadEndpoint 为 upload_endpoints 中的一个 b 节点
+type UploadEndpoint struct {
+	URL string `json:"url"`
+	// Priority 数值小的优先，只有同优先级的节点都不可用时才使用下一优先级
+	Priority int `json:"priority"`
+	// Weight 同优先级内的分配权重，默认 1
+	Weight int `json:"weight"`
+}
+
+const defaultUploadHealthInterval = 10
+
+// uploadEndpoints 返回生效的上传端点：upload_endpoints，未配置时为 upload_endpoint
+func (cfg *Config) uploadEndpoints() []UploadEndpoint {
+	if len(cfg.UploadEndpoints) > 0 {
+		return cfg.UploadEndpoints
+	}
+	if cfg.UploadEndpoint != "" {
+		return []UploadEndpoint{{URL: cfg.UploadEndpoint, Weight: 1}}
+	}
+	return nil
+}
+
+// prepareUploadEndpoints 校验 upload_endpoints 并补全默认权重
+func prepareUploadEndpoints(eps []UploadEndpoint) error {
+	seen := map[string]bool{}
+	for i := range eps {
+		ep := &eps[i]
+		ep.URL = strings.TrimSpace(ep.URL)
+		if !strings.HasPrefix(ep.URL, "http://") && !strings.HasPrefix(ep.URL, "https://") {
+			return fmt.Errorf("upload_endpoints[%d]: 无效的 url %q", i, ep.URL)
+		}
+		if seen[ep.URL] {
+			return fmt.Errorf("upload_endpoints[%d]: url 重复", i)
+		}
+		seen[ep.URL] = true
+		if ep.Weight < 0 {
+			return fmt.Errorf("upload_endpoints[%d]: weight 不能为负数", i)
+		}
+		if ep.Weight == 0 {
+			ep.Weight = 1
+		}
+	}
+	return nil
+}
+
+// endpointHealth 记录健康检查结果；尚未检查的端点视为健康
+var endpointHealth = struct {
+	sync.Mutex
+	down map[string]bool
+}{down: map[string]bool{}}
+
+func endpointHealthy(url string) bool {
+	endpointHealth.Lock()
+	defer endpointHealth.Unlock()
+	return !endpointHealth.down[url]
+}
+
+func setEndpointHealth(url string, err error) {
+	endpointHealth.Lock()
+	was := !endpointHealth.down[url]
+	endpointHealth.down[url] = err != nil
+	endpointHealth.Unlock()
+	switch {
+	case was && err != nil:
+		loggerA.Warn("上传端点健康检查失败", "endpoint", url, "err", err)
+	case !was && err == nil:
+		loggerA.Info("上传端点健康检查恢复", "endpoint", url)
+	}
+	up := 1.0
+	if err != nil {
+		up = 0
+	}
+	metricUploadEndpointUp.WithLabelValues(url).Set(up)
+}
+
+// orderEndpoints 返回本次上传依次尝试的端点：按 priority 从小到大，同优先级内按权重随机排序；
+// 健康检查失败或熔断中的端点排在最后，仅在其余端点都失败时尝试。
+func orderEndpoints(eps []UploadEndpoint, threshold int) []UploadEndpoint {
+	type candidate struct {
+		ep   UploadEndpoint
+		down bool
+		key  float64
+	}
+	cs := make([]candidate, len(eps))
+	now := time.Now()
+	for i, ep := range eps {
+		// 加权随机排序：key = u^(1/w)，按 key 从大到小
+		cs[i] = candidate{
+			ep:   ep,
+			down: !endpointHealthy(ep.URL) || breakerFor(ep.URL).isOpen(threshold, now),
+			key:  math.Pow(rand.Float64(), 1/float64(max(ep.Weight, 1))),
+		}
+	}
+	sort.SliceStable(cs, func(i, j int) bool {
+		a, b := cs[i], cs[j]
+		if a.down != b.down {
+			return !a.down
+		}
+		if a.ep.Priority != b.ep.Priority {
+			return a.ep.Priority < b.ep.Priority
+		}
+		return a.key > b.key
+	})
+	out := make([]UploadEndpoint, len(cs))
+	for i, c := range cs {
+		out[i] = c.ep
+	}
+	return out
+}
+
+// checkUploadURL 只要求 b 有响应；/upload 对 GET 返回 405 视为正常。
+func checkUploadURL(tr http.RoundTripper, url string) error {
+	client := &http.Client{Transport: tr, Timeout: healthCheckTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// uploadTargets 返回各路由使用的上传端点（按 URL 去重）及检查时使用的 transport
+func uploadTargets(cfg *Config) map[string]http.RoundTripper {
+	out := map[string]http.RoundTripper{}
+	for _, rc := range cfg.routes {
+		for _, ep := range rc.uploadEndpoints() {
+			if _, ok := out[ep.URL]; !ok {
+				out[ep.URL] = rc.uploadClient.Transport
+			}
+		}
+	}
+	return out
+}
+
+// checkUploadEndpoints 并发检查各路由的全部上传端点，返回各端点的错误（健康的为 nil）
+func checkUploadEndpoints(cfg *Config) map[string]error {
+	targets := uploadTargets(cfg)
+	res := make(map[string]error, len(targets))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for url, tr := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := checkUploadURL(tr, url)
+			mu.Lock()
+			res[url] = err
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return res
+}
+
+// uploadHealthLoop 按 upload_health_interval 定期检查各路由的上传端点。
+func uploadHealthLoop() {
+	for {
+		cfg := currentConfig()
+		interval := cfg.UploadHealthInterval
+		if interval > 0 {
+			for url, err := range checkUploadEndpoints(cfg) {
+				setEndpointHealth(url, err)
+			}
+		} else {
+			interval = defaultUploadHealthInterval
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
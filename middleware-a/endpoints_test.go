@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPrepareUploadEndpoints(t *testing.T) {
+	cases := []struct {
+		name    string
+		eps     []UploadEndpoint
+		want    []UploadEndpoint
+		wantErr string
+	}{
+		{
+			name: "补全默认权重并去掉空白",
+			eps:  []UploadEndpoint{{URL: " http://b1/upload "}, {URL: "https://b2/upload", Weight: 3, Priority: 1}},
+			want: []UploadEndpoint{{URL: "http://b1/upload", Weight: 1}, {URL: "https://b2/upload", Weight: 3, Priority: 1}},
+		},
+		{name: "无效的 url", eps: []UploadEndpoint{{URL: "b1:8082/upload"}}, wantErr: "upload_endpoints[0]: 无效的 url"},
+		{name: "url 重复", eps: []UploadEndpoint{{URL: "http://b1/upload"}, {URL: "http://b1/upload "}}, wantErr: "upload_endpoints[1]: url 重复"},
+		{name: "权重为负数", eps: []UploadEndpoint{{URL: "http://b1/upload", Weight: -1}}, wantErr: "weight 不能为负数"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := prepareUploadEndpoints(tc.eps)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("err = %v，期望包含 %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range tc.want {
+				if tc.eps[i] != tc.want[i] {
+					t.Errorf("[%d] = %+v，期望 %+v", i, tc.eps[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func endpointURLs(eps []UploadEndpoint) []string {
+	out := make([]string, len(eps))
+	for i, ep := range eps {
+		out[i] = ep.URL
+	}
+	return out
+}
+
+// uniqueEndpoint 返回本测试专用的端点地址，避免与其他测试共用健康状态与熔断器
+func uniqueEndpoint(t *testing.T, name string) string {
+	return fmt.Sprintf("http://%s.%s.test/upload", name, strings.ToLower(strings.ReplaceAll(t.Name(), "/", "-")))
+}
+
+func TestOrderEndpointsPriority(t *testing.T) {
+	p0, p1, p2 := uniqueEndpoint(t, "p0"), uniqueEndpoint(t, "p1"), uniqueEndpoint(t, "p2")
+	eps := []UploadEndpoint{{URL: p2, Priority: 2, Weight: 100}, {URL: p0, Priority: 0, Weight: 1}, {URL: p1, Priority: 1, Weight: 1}}
+	for i := 0; i < 50; i++ {
+		got := endpointURLs(orderEndpoints(eps, 5))
+		if strings.Join(got, " ") != strings.Join([]string{p0, p1, p2}, " ") {
+			t.Fatalf("顺序 %v 未按 priority 排列", got)
+		}
+	}
+}
+
+// 同优先级内第一个尝试的端点按权重分配
+func TestOrderEndpointsWeighted(t *testing.T) {
+	heavy, light := uniqueEndpoint(t, "heavy"), uniqueEndpoint(t, "light")
+	eps := []UploadEndpoint{{URL: light, Weight: 1}, {URL: heavy, Weight: 3}}
+	const n = 4000
+	first := 0
+	for i := 0; i < n; i++ {
+		got := orderEndpoints(eps, 5)
+		if len(got) != 2 {
+			t.Fatalf("返回 %d 个端点", len(got))
+		}
+		if got[0].URL == heavy {
+			first++
+		}
+	}
+	if ratio := float64(first) / n; ratio < 0.70 || ratio > 0.80 {
+		t.Errorf("权重 3:1 时首选比例为 %.3f，期望约 0.75", ratio)
+	}
+}
+
+// 健康检查失败或熔断中的端点排在最后，即使优先级更高
+func TestOrderEndpointsDown(t *testing.T) {
+	unhealthy, open, ok := uniqueEndpoint(t, "unhealthy"), uniqueEndpoint(t, "open"), uniqueEndpoint(t, "ok")
+	eps := []UploadEndpoint{{URL: unhealthy, Weight: 1}, {URL: open, Weight: 1}, {URL: ok, Priority: 9, Weight: 1}}
+	setEndpointHealth(unhealthy, errors.New("down"))
+	t.Cleanup(func() { setEndpointHealth(unhealthy, nil) })
+	for i := 0; i < 2; i++ {
+		breakerFor(open).failure(2, time.Minute, time.Now())
+	}
+	t.Cleanup(breakerFor(open).success)
+
+	got := endpointURLs(orderEndpoints(eps, 2))
+	if got[0] != ok {
+		t.Fatalf("顺序 %v：可用端点应排在最前", got)
+	}
+	// 熔断阈值为 0 时不参考熔断器
+	if got := endpointURLs(orderEndpoints(eps, 0)); got[2] != unhealthy {
+		t.Fatalf("顺序 %v：不熔断时只有健康检查失败的端点排在最后", got)
+	}
+	setEndpointHealth(unhealthy, nil)
+	if !endpointHealthy(unhealthy) {
+		t.Fatal("健康检查恢复后应视为健康")
+	}
+}
+
+// fakeB 模拟 b：按 status 响应，成功时返回 <b>/files/1
+func fakeB(t *testing.T, status int, hits *atomic.Int32) *httptest.Server {
+	t.Helper()
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(status)
+			return
+		}
+		hits.Add(1)
+		if status != http.StatusOK {
+			http.Error(w, "fail", status)
+			return
+		}
+		fmt.Fprintf(w, `{"url":"http://%s/files/1"}`, r.Host)
+	}))
+	t.Cleanup(b.Close)
+	return b
+}
+
+// 端点暂时不可用时切换到下一个；b 拒绝文件时不切换
+func TestUploadFailover(t *testing.T) {
+	refused := httptest.NewServer(http.NotFoundHandler())
+	refused.Close()
+	cases := []struct {
+		name      string
+		first     int // 0 表示拒绝连接
+		wantFirst int32
+		wantNext  int32
+		rewritten bool
+	}{
+		{name: "503 后切换", first: http.StatusServiceUnavailable, wantFirst: 1, wantNext: 1, rewritten: true},
+		{name: "429 后切换", first: http.StatusTooManyRequests, wantFirst: 1, wantNext: 1, rewritten: true},
+		{name: "拒绝连接后切换", first: 0, wantNext: 1, rewritten: true},
+		{name: "b 拒绝文件时不切换", first: http.StatusUnsupportedMediaType, wantFirst: 1, wantNext: 0},
+		{name: "首选端点成功", first: http.StatusOK, wantFirst: 1, wantNext: 0, rewritten: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var firstHits, nextHits atomic.Int32
+			firstURL := refused.URL
+			if tc.first != 0 {
+				firstURL = fakeB(t, tc.first, &firstHits).URL
+			}
+			next := fakeB(t, http.StatusOK, &nextHits)
+			cfg := loadTestConfig(t, map[string]any{
+				"upstream_ws_url": "ws://127.0.0.1:1",
+				"upload_endpoints": []map[string]any{
+					{"url": firstURL + "/upload", "priority": 0},
+					{"url": next.URL + "/upload", "priority": 1},
+				},
+				"upload_max_retries":      -1,
+				"upload_breaker_failures": -1,
+			})
+			msg := `{"action":"set_group_portrait","params":{"group_id":1,"file":"base64://aGk="}}`
+			out, err := rewriteIfUpload(context.Background(), []byte(msg), cfg.routes[0], nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if firstHits.Load() != tc.wantFirst || nextHits.Load() != tc.wantNext {
+				t.Errorf("首选端点 %d 次、下一个 %d 次，期望 %d / %d", firstHits.Load(), nextHits.Load(), tc.wantFirst, tc.wantNext)
+			}
+			if got := strings.Contains(string(out), "/files/1"); got != tc.rewritten {
+				t.Errorf("改写结果 %s", out)
+			}
+		})
+	}
+}
+
+// checkUploadEndpoints 检查各路由用到的全部端点：有响应且非 5xx 为健康，结果写入 setEndpointHealth 后影响排序
+func TestCheckUploadEndpoints(t *testing.T) {
+	var hits atomic.Int32
+	healthy := fakeB(t, http.StatusMethodNotAllowed, &hits)
+	broken := fakeB(t, http.StatusBadGateway, &hits)
+	refused := httptest.NewServer(http.NotFoundHandler())
+	refused.Close()
+	cfg := loadTestConfig(t, map[string]any{
+		"upstream_ws_url": "ws://127.0.0.1:1",
+		"upload_endpoint": healthy.URL + "/upload",
+		"routes": []map[string]any{
+			{"name": "r1", "listen_ws_path": "/a"},
+			{"name": "r2", "listen_ws_path": "/b", "upload_endpoints": []map[string]any{
+				{"url": broken.URL + "/upload"}, {"url": refused.URL + "/upload"}, {"url": healthy.URL + "/upload"},
+			}},
+		},
+	})
+	res := checkUploadEndpoints(cfg)
+	if len(res) != 3 {
+		t.Fatalf("检查了 %d 个端点，期望按 URL 去重后 3 个: %v", len(res), res)
+	}
+	for url, wantOK := range map[string]bool{healthy.URL + "/upload": true, broken.URL + "/upload": false, refused.URL + "/upload": false} {
+		if (res[url] == nil) != wantOK {
+			t.Errorf("%s: err = %v", url, res[url])
+		}
+	}
+	for url, err := range res {
+		setEndpointHealth(url, err)
+		t.Cleanup(func() { setEndpointHealth(url, nil) })
+	}
+	got := orderEndpoints(cfg.routes[1].uploadEndpoints(), 0)
+	if got[0].URL != healthy.URL+"/upload" {
+		t.Errorf("顺序 %v：健康的端点应排在最前", endpointURLs(got))
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// healthCheckTimeout 为单项就绪检查的超时时间
+const healthCheckTimeout = 5 * time.Second
+
+type checkResult struct {
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+func writeHealth(w http.ResponseWriter, rep healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if rep.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(rep)
+}
+
+// handleHealthz 仅表示进程存活。
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, healthReport{Status: "ok"})
+}
+
+// handleReadyz 并发检查各路由的上游是否可连接、各上传端点是否有响应。
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	checks := map[string]func() error{}
+	for _, rc := range cfg.routes {
+		rc := rc
+		checks["upstream:"+rc.routeName] = func() error { return checkUpstream(rc) }
+	}
+	for url, tr := range uploadTargets(cfg) {
+		checks["upload_endpoint:"+url] = func() error { return checkUploadURL(tr, url) }
+	}
+	writeHealth(w, runChecks(checks))
+}
+
+func runChecks(checks map[string]func() error) healthReport {
+	rep := healthReport{Status: "ok", Checks: map[string]checkResult{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, fn := range checks {
+		wg.Add(1)
+		go func(name string, fn func() error) {
+			defer wg.Done()
+			start := time.Now()
+			err := fn()
+			res := checkResult{OK: err == nil, Duration: time.Since(start).String()}
+			if err != nil {
+				res.Error = err.Error()
+			}
+			mu.Lock()
+			rep.Checks[name] = res
+			if err != nil {
+				rep.Status = "fail"
+			}
+			mu.Unlock()
+		}(name, fn)
+	}
+	wg.Wait()
+	return rep
+}
+
+func checkUpstream(rc *Config) error {
+	conn, _, err := dialUpstream(rc.upstreamDialer(healthCheckTimeout), rc)
+	if err != nil {
+		return err
+	}
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), timeNowPlus())
+	return conn.Close()
+}
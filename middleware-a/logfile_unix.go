@@ -0,0 +1,17 @@
+// 共享文件：与其他模块中的同名文件保持一致，以 middleware-a 中的为准。
+// 修改后运行 scripts/shared-files.sh sync 同步，CI 中由 scripts/shared-files.sh check 检查。
+
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func notifyLogReopen(c chan<- os.Signal) bool {
+	signal.Notify(c, syscall.SIGUSR1)
+	return true
+}
@@ -0,0 +1,11 @@
+// 共享文件：与其他模块中的同名文件保持一致，以 middleware-a 中的为准。
+// 修改后运行 scripts/shared-files.sh sync 同步，CI 中由 scripts/shared-files.sh check 检查。
+
+//go:build windows
+
+package main
+
+import "os"
+
+// Windows 没有 SIGUSR1，依赖内置轮转。
+func notifyLogReopen(c chan<- os.Signal) bool { return false }
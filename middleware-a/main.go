@@ -1,25 +1,38 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log/slog"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"runtime"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Config struct {
@@ -34,6 +47,96 @@ type Config struct {
 	LogFile               string `json:"log_file"`
 	LogFormat             string `json:"log_format"`
 	LogConsole            bool   `json:"log_console"`
+	// 日志轮转：单文件上限（MB，默认 100，负数不限）、按时间轮转（hourly/daily/weekly）、
+	// 保留的旧文件数（默认 7，负数不限）与天数（0 不限），以及是否 gzip 压缩旧文件
+	LogMaxSizeMB      int    `json:"log_max_size_mb"`
+	LogRotateInterval string `json:"log_rotate_interval"`
+	LogMaxBackups     int    `json:"log_max_backups"`
+	LogMaxAgeDays     int    `json:"log_max_age_days"`
+	LogCompress       bool   `json:"log_compress"`
+	// ConfigReloadInterval 配置文件变更检查间隔（秒），默认 5，负数表示仅响应 SIGHUP
+	ConfigReloadInterval int `json:"config_reload_interval"`
+	// RewriteRules 追加或覆盖内置的动作改写规则
+	RewriteRules []RewriteRule `json:"rewrite_rules"`
+	// MediaSegmentTypes 需要改写的消息段 / CQ 码类型，留空使用 defaultMediaSegmentTypes
+	MediaSegmentTypes []string `json:"media_segment_types"`
+	// CompatProfile 上游实现：generic、go-cqhttp、napcat、llonebot、lagrange、shamrock
+	CompatProfile string          `json:"compat_profile"`
+	Compat        *CompatOverride `json:"compat"`
+	// Routes 多账号路由，为空时使用顶层的监听路径与上游
+	Routes []Route `json:"routes"`
+	// AdminToken 管理接口 /admin/ 的 Bearer token，为空时不启用管理接口
+	AdminToken string `json:"admin_token"`
+	// ServerAccessTokens 除 server_access_token 外额外接受的 token，便于轮换
+	ServerAccessTokens []string `json:"server_access_tokens"`
+	// 海豹侧鉴权失败限制：同一 IP 在 auth_failure_window 秒内失败 auth_max_failures 次（默认 5，负数不限）后
+	// 封禁 auth_ban_seconds 秒（默认 600）
+	AuthMaxFailures   int `json:"auth_max_failures"`
+	AuthFailureWindow int `json:"auth_failure_window"`
+	AuthBanSeconds    int `json:"auth_ban_seconds"`
+	// AllowedOrigins 允许的浏览器来源（如 https://panel.example.com，"*" 为任意）；为空时只接受同源，
+	// 未携带 Origin 的客户端不受限制
+	AllowedOrigins []string `json:"allowed_origins"`
+	// MaxWSPairs 全部路由同时存在的连接对上限，0 为不限制
+	MaxWSPairs int `json:"max_ws_pairs"`
+	// 海豹连接的单条消息上限（MB）：普通消息默认 4，含 base64:// 的消息默认 64；负数不限
+	WSReadLimitMB      int `json:"ws_read_limit_mb"`
+	WSMediaReadLimitMB int `json:"ws_media_read_limit_mb"`
+	// WSUpstreamReadLimitMB 协议端连接的单条消息上限（MB），默认 256，负数不限
+	WSUpstreamReadLimitMB int `json:"ws_upstream_read_limit_mb"`
+	// 两端连接的 ping 间隔与空闲超时（秒），默认 30 与 90，负数不启用
+	WSPingInterval int `json:"ws_ping_interval"`
+	WSIdleTimeout  int `json:"ws_idle_timeout"`
+	// TLS 监听端口的 TLS 配置，修改后需重启；证书文件变更自动重新加载
+	TLS ServerTLSConfig `json:"tls"`
+	// UpstreamTLS 连接 wss:// 协议端时的 CA 与客户端证书
+	UpstreamTLS ClientTLSConfig `json:"upstream_tls"`
+	// UploadTLS 连接 https:// 的 b 时的 CA 与客户端证书（双向 TLS）
+	UploadTLS ClientTLSConfig `json:"upload_tls"`
+	// UploadEndpoints 多个 b 节点，按优先级与权重分配上传并在失败时切换；配置后忽略 upload_endpoint
+	UploadEndpoints []UploadEndpoint `json:"upload_endpoints"`
+	// UploadHealthInterval 上传端点的健康检查间隔（秒），默认 10，负数不检查
+	UploadHealthInterval int `json:"upload_health_interval"`
+	// UploadToken 上传到 b 时携带的 Bearer token（对应 b 的 upload_tokens），路由可单独配置
+	UploadToken string `json:"upload_token"`
+	// 上传到 b 的连接超时与单次请求总超时（秒），默认 5 与 60
+	UploadConnectTimeout int `json:"upload_connect_timeout"`
+	UploadTimeout        int `json:"upload_timeout"`
+	// UploadMessageTimeout 一条动作中全部上传（含重试）的总时长（秒），默认 120，负数不限
+	UploadMessageTimeout int `json:"upload_message_timeout"`
+	// b 暂时不可用（连接失败、502/503/504、429）时最多重试 upload_max_retries 次（默认 2，负数不重试）；
+	// 单次所需等待超过 upload_retry_max_wait 秒（默认 10）时不再重试
+	UploadMaxRetries   int `json:"upload_max_retries"`
+	UploadRetryMaxWait int `json:"upload_retry_max_wait"`
+	// 连续失败 upload_breaker_failures 次（默认 5，负数不熔断）后 upload_breaker_cooldown 秒（默认 30）内不再请求 b
+	UploadBreakerFailures int `json:"upload_breaker_failures"`
+	UploadBreakerCooldown int `json:"upload_breaker_cooldown"`
+	// UploadFallback b 不可用时的处理：passthrough（默认，保持原样）或 base64（以 base64:// 内联发送）
+	UploadFallback string `json:"upload_fallback"`
+	// Tracing OpenTelemetry 链路追踪，修改后需重启
+	Tracing TracingConfig `json:"tracing"`
+	// AllowedFileRoots 允许读取的本地目录（如海豹的 data/、backups/），消息中引用其他路径的动作会被拒绝；
+	// 为空时不限制
+	AllowedFileRoots []string `json:"allowed_file_roots"`
+	// DebugRewrite 输出每条动作改写前后的 JSON 及各媒体的处理结果，支持热重载
+	DebugRewrite bool `json:"debug_rewrite"`
+	// CaptureDir 录制双向 WS 流量的目录，为空时不录制；对之后建立的连接生效
+	CaptureDir string `json:"capture_dir"`
+	// Audit 消息审计日志，修改后需重启
+	Audit AuditConfig `json:"audit"`
+
+	ruleTable  map[string][]RewriteRule
+	mediaTypes map[string]bool
+	profile    CompatProfile
+	sandbox    *fileSandbox
+	routes     []*Config
+	routeName  string
+	routeKey   string // 热重载时对应新旧路由，见 liveRoute
+	selfID     string
+
+	// upstreamTLS / uploadClient 由 upstream_tls / upload_tls 生成，uploadClient 由各路由共用
+	upstreamTLS  *tls.Config
+	uploadClient *http.Client
 }
 
 var (
@@ -48,8 +151,8 @@ func initLoggerADefault() {
 	slog.SetDefault(loggerA)
 }
 
-func initLoggerAFromConfig(cfg *Config) {
-	switch strings.ToLower(strings.TrimSpace(cfg.LogLevel)) {
+func setLogLevelA(level string) {
+	switch strings.ToLower(strings.TrimSpace(level)) {
 	case "debug":
 		levelVarA.Set(slog.LevelDebug)
 	case "warn":
@@ -59,6 +162,20 @@ func initLoggerAFromConfig(cfg *Config) {
 	default:
 		levelVarA.Set(slog.LevelInfo)
 	}
+}
+
+func (cfg *Config) logRotateOptions() logRotateOptions {
+	return logRotateOptions{
+		MaxSizeMB:  cfg.LogMaxSizeMB,
+		Interval:   cfg.LogRotateInterval,
+		MaxBackups: cfg.LogMaxBackups,
+		MaxAgeDays: cfg.LogMaxAgeDays,
+		Compress:   cfg.LogCompress,
+	}
+}
+
+func initLoggerAFromConfig(cfg *Config) {
+	setLogLevelA(cfg.LogLevel)
 	out := []io.Writer{}
 	if cfg.LogConsole {
 		out = append(out, os.Stdout)
@@ -69,9 +186,12 @@ func initLoggerAFromConfig(cfg *Config) {
 		lf = filepath.Join("logs", "middleware-a.log")
 	}
 	if lf != "" {
-		_ = os.MkdirAll(filepath.Dir(lf), 0o755)
-		if f, err := os.OpenFile(lf, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644); err == nil {
-			out = append(out, f)
+		rf, err := openRotatingFile(lf, cfg.logRotateOptions())
+		if err != nil {
+			loggerA.Error("打开日志文件失败", "err", err, "path", lf)
+		} else {
+			out = append(out, rf)
+			go watchLogReopen(rf)
 		}
 	}
 	var w io.Writer = os.Stdout
@@ -104,13 +224,29 @@ func (w *statusRecorder) Write(b []byte) (int, error) {
 	return n, err
 }
 
+// Hijack 供 WebSocket 升级使用
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("hijack not supported")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return hj.Hijack()
+}
+
 func withHTTPLogging(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		rid := fmt.Sprintf("%x", time.Now().UnixNano())
+		rid := r.Header.Get(requestIDHeader)
+		if !validRequestID(rid) {
+			rid = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, rid)
 		rw := &statusRecorder{ResponseWriter: w}
 		loggerA.Info("http start", "rid", rid, "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
-		h(rw, r)
+		h(rw, r.WithContext(withRequestID(r.Context(), rid)))
 		dur := time.Since(start)
 		loggerA.Info("http end", "rid", rid, "status", rw.status, "bytes", rw.bytes, "duration", dur)
 	}
@@ -122,36 +258,24 @@ type oneBotCommand struct {
 	Echo   interface{} `json:"echo"`
 }
 
-type uploadPrivateFileParams struct {
-	UserID int64  `json:"user_id"`
-	File   string `json:"file"`
-	Name   string `json:"name"`
-}
-
-type uploadGroupFileParams struct {
-	GroupID int64  `json:"group_id"`
-	File    string `json:"file"`
-	Name    string `json:"name"`
-}
-
-type sendPrivateMsgParams struct {
-	UserID  int64  `json:"user_id"`
-	Message string `json:"message"`
-}
-
-type sendGroupMsgParams struct {
-	GroupID int64  `json:"group_id"`
-	Message string `json:"message"`
-}
-
-func rewriteCQMediaInText(s string, cfg *Config) string {
-	re := regexp.MustCompile(`\[CQ:(image|record|video)([^\]]*)]`)
+func rewriteCQMediaInText(s string, job *rewriteJob) string {
+	re := regexp.MustCompile(`\[CQ:([A-Za-z_]+)([^\]]*)]`)
 	return re.ReplaceAllStringFunc(s, func(seg string) string {
 		m := re.FindStringSubmatch(seg)
 		if len(m) < 3 {
 			return seg
 		}
 		kind := m[1]
+		target := "CQ:" + kind
+		if !job.cfg.isMediaSegment(kind) {
+			job.noteSkip(target, "", skipNotMedia)
+			return seg
+		}
+		if kind == "file" && !job.cfg.profile.CQFileSupported {
+			loggerA.Warn("上游不支持 CQ:file，保持原样", "profile", job.cfg.CompatProfile)
+			job.noteSkip(target, "", skipCQFileDisabled)
+			return seg
+		}
 		argsStr := m[2]
 		args := map[string]string{}
 		for _, kv := range strings.Split(strings.TrimLeft(argsStr, ","), ",") {
@@ -165,20 +289,26 @@ func rewriteCQMediaInText(s string, cfg *Config) string {
 		}
 		if u, ok := args["url"]; ok {
 			if strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") {
+				job.noteSkip(target, u, skipAlreadyHTTP)
 				return seg
 			}
 		}
 		file := args["file"]
 		if file == "" {
+			job.noteSkip(target, file, skipEmptyFile)
 			return seg
 		}
 		if strings.HasPrefix(file, "http://") || strings.HasPrefix(file, "https://") {
+			job.noteSkip(target, file, skipAlreadyHTTP)
 			return seg
 		}
-		up, name := uploadViaB(file, args["name"], cfg)
+		up, name := uploadViaB(file, args["name"], job)
 		if up.URL == "" {
+			job.noteSkip(target, file, skipUploadFailed)
 			return seg
 		}
+		job.countRewrite(kind)
+		job.noteRewrite(target, file, up.URL)
 		args["file"] = escapeCommaMaybe(up.URL)
 		if name != "" {
 			args["name"] = name
@@ -213,7 +343,7 @@ func rewriteCQMediaInText(s string, cfg *Config) string {
 	})
 }
 
-func rewritePictureTagInText(s string, cfg *Config) string {
+func rewritePictureTagInText(s string, job *rewriteJob) string {
 	re := regexp.MustCompile(`\[图:([^\]]+)]`)
 	return re.ReplaceAllStringFunc(s, func(seg string) string {
 		m := re.FindStringSubmatch(seg)
@@ -221,10 +351,13 @@ func rewritePictureTagInText(s string, cfg *Config) string {
 			return seg
 		}
 		src := strings.TrimSpace(m[1])
-		up, _ := uploadViaB(src, "", cfg)
+		up, _ := uploadViaB(src, "", job)
 		if up.URL == "" {
+			job.noteSkip("[图:]", src, skipUploadFailed)
 			return seg
 		}
+		job.countRewrite("image")
+		job.noteRewrite("[图:]", src, up.URL)
 		return "[CQ:image,file=" + escapeCommaMaybe(up.URL) + "]"
 	})
 }
@@ -232,7 +365,8 @@ func rewritePictureTagInText(s string, cfg *Config) string {
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  64 * 1024,
 	WriteBufferSize: 64 * 1024,
-	CheckOrigin:     func(r *http.Request) bool { return true },
+	// 来源在 serveWS 中按 allowed_origins 校验
+	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
 func loadConfig(path string) (*Config, error) {
@@ -264,10 +398,103 @@ func loadConfig(path string) (*Config, error) {
 	if !cfg.LogConsole {
 		cfg.LogConsole = true
 	}
+	if cfg.LogMaxSizeMB == 0 {
+		cfg.LogMaxSizeMB = 100
+	}
+	if cfg.LogMaxBackups == 0 {
+		cfg.LogMaxBackups = 7
+	}
+	if _, err := parseRotateInterval(cfg.LogRotateInterval); err != nil {
+		return nil, err
+	}
+	// 仅校验审计配置，审计日志在启动时打开
+	if _, err := newAuditSink(AuditConfig{RedactPatterns: cfg.Audit.RedactPatterns}); err != nil {
+		return nil, err
+	}
+	if _, err := parseRotateInterval(cfg.Audit.RotateInterval); err != nil {
+		return nil, fmt.Errorf("audit: %w", err)
+	}
+	if cfg.AuthMaxFailures == 0 {
+		cfg.AuthMaxFailures = 5
+	}
+	if cfg.AuthFailureWindow <= 0 {
+		cfg.AuthFailureWindow = 60
+	}
+	if cfg.AuthBanSeconds <= 0 {
+		cfg.AuthBanSeconds = 600
+	}
+	if cfg.ConfigReloadInterval == 0 {
+		cfg.ConfigReloadInterval = 5
+	}
+	if cfg.WSReadLimitMB == 0 {
+		cfg.WSReadLimitMB = defaultWSReadLimitMB
+	}
+	if cfg.WSMediaReadLimitMB == 0 {
+		cfg.WSMediaReadLimitMB = defaultWSMediaReadLimitMB
+	}
+	if cfg.WSUpstreamReadLimitMB == 0 {
+		cfg.WSUpstreamReadLimitMB = defaultWSUpstreamReadLimitMB
+	}
+	if cfg.WSPingInterval == 0 {
+		cfg.WSPingInterval = defaultWSPingInterval
+	}
+	if cfg.WSIdleTimeout == 0 {
+		cfg.WSIdleTimeout = defaultWSIdleTimeout
+	}
+	if cfg.UploadMaxRetries == 0 {
+		cfg.UploadMaxRetries = defaultUploadMaxRetries
+	}
+	if cfg.UploadRetryMaxWait <= 0 {
+		cfg.UploadRetryMaxWait = defaultUploadRetryMaxWait
+	}
+	if cfg.UploadConnectTimeout <= 0 {
+		cfg.UploadConnectTimeout = defaultUploadConnectTimeout
+	}
+	if cfg.UploadTimeout <= 0 {
+		cfg.UploadTimeout = defaultUploadTimeout
+	}
+	if cfg.UploadMessageTimeout == 0 {
+		cfg.UploadMessageTimeout = defaultUploadMessageTimeout
+	}
+	if cfg.UploadBreakerFailures == 0 {
+		cfg.UploadBreakerFailures = defaultUploadBreakerFailures
+	}
+	if cfg.UploadBreakerCooldown <= 0 {
+		cfg.UploadBreakerCooldown = defaultUploadBreakerCooldown
+	}
+	if err := prepareUploadEndpoints(cfg.UploadEndpoints); err != nil {
+		return nil, err
+	}
+	if cfg.UploadHealthInterval == 0 {
+		cfg.UploadHealthInterval = defaultUploadHealthInterval
+	}
+	switch cfg.UploadFallback {
+	case "":
+		cfg.UploadFallback = uploadFallbackPassthrough
+	case uploadFallbackPassthrough, uploadFallbackBase64:
+	default:
+		return nil, fmt.Errorf("upload_fallback 只能为 %s 或 %s", uploadFallbackPassthrough, uploadFallbackBase64)
+	}
+	if cfg.WSPingInterval > 0 && cfg.WSIdleTimeout > 0 && cfg.WSIdleTimeout <= cfg.WSPingInterval {
+		return nil, fmt.Errorf("ws_idle_timeout (%d) 需大于 ws_ping_interval (%d)", cfg.WSIdleTimeout, cfg.WSPingInterval)
+	}
+	routes, err := buildRoutes(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	cfg.routes = routes
 	return &cfg, nil
 }
 
 func main() {
+	// middleware-a audit ...：查询审计日志
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(runAuditCLI(os.Args[2:]))
+	}
+	// middleware-a replay ...：离线重放录制的流量
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplayCLI(os.Args[2:]))
+	}
 	var cfgPath string
 	flag.StringVar(&cfgPath, "config", "config.json", "config path")
 	flag.Parse()
@@ -279,388 +506,295 @@ func main() {
 		os.Exit(1)
 	}
 	initLoggerAFromConfig(cfg)
-
-	http.HandleFunc(cfg.ListenWSPath, withHTTPLogging(func(w http.ResponseWriter, r *http.Request) {
-		// 鉴权对接协议端的 access_token
-		if cfg.ServerAccessToken != "" {
-			auth := r.Header.Get("Authorization")
-			expected := "Bearer " + cfg.ServerAccessToken
-			if auth != expected {
-				w.WriteHeader(http.StatusUnauthorized)
-				_, _ = w.Write([]byte("unauthorized"))
-				loggerA.Warn("未授权访问", "remote", r.RemoteAddr, "path", r.URL.Path)
-				return
-			}
-		}
-		// 对接到海豹的 Onebot v11 正向 WS 连接
-		clientConn, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			loggerA.Error("WebSocket 升级失败", "err", err, "remote", r.RemoteAddr)
-			return
-		}
-
-		// 连接 Onebot V11 协议实现端
-		header := http.Header{}
-		if cfg.UpstreamAccessToken != "" && !cfg.UpstreamUseQueryToken {
-			header.Set("Authorization", "Bearer "+cfg.UpstreamAccessToken)
-		}
-		upstreamURL := cfg.UpstreamWSURL
-		if cfg.UpstreamAccessToken != "" && cfg.UpstreamUseQueryToken {
-			if u, e := url.Parse(upstreamURL); e == nil {
-				q := u.Query()
-				q.Set("access_token", cfg.UpstreamAccessToken)
-				u.RawQuery = q.Encode()
-				upstreamURL = u.String()
-			}
-		}
-		upstreamConn, _, err := websocket.DefaultDialer.Dial(upstreamURL, header)
-		if err != nil {
-			loggerA.Error("连接协议端失败", "err", err, "url", upstreamURL)
-			_ = clientConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "upstream dial error"), timeNowPlus())
-			clientConn.Close()
-			return
+	if cfg.Audit.File != "" {
+		if auditor, err = newAuditSink(cfg.Audit); err != nil {
+			loggerA.Error("打开审计日志失败", "err", err)
+			os.Exit(1)
 		}
+		loggerA.Info("消息审计已启用", "file", cfg.Audit.File)
+	}
+	currentCfg.Store(cfg)
+	go watchConfig(cfgPath, cfg.ConfigReloadInterval)
+	go uploadHealthLoop()
 
-		var wg sync.WaitGroup
-		wg.Add(2)
-
+	shutdown, err := initTracing(cfg.Tracing)
+	if err != nil {
+		loggerA.Error("初始化链路追踪失败", "err", err)
+		os.Exit(1)
+	}
+	if cfg.Tracing.Endpoint != "" {
+		loggerA.Info("链路追踪已启用", "endpoint", cfg.Tracing.Endpoint)
+		// 退出前刷新尚未导出的 span
 		go func() {
-			defer wg.Done()
-			defer func() {
-				if rec := recover(); rec != nil {
-					loggerA.Error("发生异常 (客户端到上游)", "err", rec)
-				}
-			}()
-			for {
-				mt, msg, err := clientConn.ReadMessage()
-				if err != nil {
-					loggerA.Error("读取海豹消息失败", "err", err)
-					_ = upstreamConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), timeNowPlus())
-					return
-				}
-				if mt == websocket.TextMessage {
-					rewritten := rewriteIfUpload(cmdBytes(msg), cfg)
-					msg = rewritten
-				}
-				if err := upstreamConn.WriteMessage(mt, msg); err != nil {
-					loggerA.Error("写入协议端消息失败", "err", err)
-					return
-				}
-			}
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+			<-sig
+			shutdownTracing(shutdown)
+			os.Exit(0)
 		}()
+	}
 
-		go func() {
-			defer wg.Done()
-			defer func() {
-				if rec := recover(); rec != nil {
-					loggerA.Error("发生异常 (上游到客户端)", "err", rec)
-				}
-			}()
-			for {
-				mt, msg, err := upstreamConn.ReadMessage()
-				if err != nil {
-					loggerA.Error("读取协议端消息失败", "err", err)
-					_ = clientConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), timeNowPlus())
-					return
-				}
-				if err := clientConn.WriteMessage(mt, msg); err != nil {
-					loggerA.Error("写入海豹消息失败", "err", err)
-					return
-				}
-			}
-		}()
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
+	registerAdminHandlers()
 
-		wg.Wait()
-		loggerA.Info("ws closed", "remote", r.RemoteAddr, "upstream", upstreamURL)
-		clientConn.Close()
-		upstreamConn.Close()
+	// 按监听路径与 X-Self-ID 分发到各路由
+	http.HandleFunc("/", withHTTPLogging(func(w http.ResponseWriter, r *http.Request) {
+		rc := matchRoute(currentConfig().routes, r)
+		if rc == nil {
+			http.NotFound(w, r)
+			return
+		}
+		serveWS(w, r, rc)
 	}))
 
-	loggerA.Info("服务启动", "http", cfg.ListenHTTP, "ws_path", cfg.ListenWSPath, "upstream", cfg.UpstreamWSURL)
-	if err := http.ListenAndServe(cfg.ListenHTTP, nil); err != nil {
+	if len(cfg.AllowedFileRoots) == 0 {
+		loggerA.Warn("未配置 allowed_file_roots，消息中引用的任意本地文件都会被读取并上传")
+	}
+	for _, rc := range cfg.routes {
+		loggerA.Info("路由", "route", rc.routeName, "ws_path", rc.ListenWSPath, "self_id", rc.selfID, "upstream", rc.UpstreamWSURL)
+	}
+	tlsCfg, err := cfg.TLS.build()
+	if err != nil {
+		loggerA.Error("加载 TLS 证书失败", "err", err)
+		os.Exit(1)
+	}
+	loggerA.Info("服务启动", "http", cfg.ListenHTTP, "tls", tlsCfg != nil, "routes", len(cfg.routes))
+	if err := listenAndServe(cfg.ListenHTTP, nil, tlsCfg); err != nil {
 		loggerA.Error("HTTP 服务启动失败", "err", err)
 		os.Exit(1)
 	}
 }
 
-func timeNowPlus() (deadline time.Time) { // minimal helper to satisfy control writes
-	return time.Now().Add(1 * time.Second)
-}
+// serveWS 处理一条海豹连接：鉴权、升级并与该路由的上游建立双向转发。
+func serveWS(w http.ResponseWriter, r *http.Request, cfg *Config) {
+	// 鉴权海豹携带的 access_token
+	if !authorizeServer(w, r, cfg) {
+		return
+	}
+	live := liveRoute(cfg)
+	if !originAllowed(r, live.AllowedOrigins) {
+		metricWSRejected.WithLabelValues(cfg.routeName, "origin").Inc()
+		loggerA.Warn("拒绝来源不在 allowed_origins 中的连接", "route", cfg.routeName, "origin", r.Header.Get("Origin"), "remote", r.RemoteAddr)
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	if !acquirePair(live.MaxWSPairs) {
+		metricWSRejected.WithLabelValues(cfg.routeName, "max_pairs").Inc()
+		loggerA.Warn("连接对数量已达上限", "route", cfg.routeName, "max_ws_pairs", live.MaxWSPairs, "remote", r.RemoteAddr)
+		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+		return
+	}
+	defer releasePair()
+	limits := live.wsLimits()
+	// 对接到海豹的 Onebot v11 正向 WS 连接
+	clientConn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		loggerA.Error("WebSocket 升级失败", "err", err, "remote", r.RemoteAddr)
+		return
+	}
+	limits.setup(clientConn)
 
-func cmdBytes(b []byte) []byte { return b }
+	// 连接 Onebot V11 协议实现端
+	upstreamConn, upstreamURL, err := dialUpstream(cfg.upstreamDialer(upstreamHandshakeTimeout), cfg)
+	if err != nil {
+		loggerA.Error("连接协议端失败", "route", cfg.routeName, "err", err, "url", upstreamURL)
+		_ = clientConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "upstream dial error"), timeNowPlus())
+		clientConn.Close()
+		return
+	}
+	upLimits := limits.upstream()
+	upLimits.setup(upstreamConn)
 
-func rewriteIfUpload(msg []byte, cfg *Config) []byte {
-	var cmd oneBotCommand
-	if err := json.Unmarshal(msg, &cmd); err != nil {
-		return msg
-	}
-	switch cmd.Action {
-	case "send_msg":
-		raw, _ := json.Marshal(cmd.Params)
-		var p map[string]interface{}
-		if json.Unmarshal(raw, &p) == nil {
-			if v, ok := p["message"].(string); ok {
-				nv := rewriteCQMediaInText(v, cfg)
-				nv = rewritePictureTagInText(nv, cfg)
-				if nv != v {
-					p["message"] = nv
-					newCmd := oneBotCommand{Action: "send_msg", Params: p, Echo: cmd.Echo}
-					b, _ := json.Marshal(newCmd)
-					return b
-				}
-			} else if arr, ok := p["message"].([]interface{}); ok {
-				changed := false
-				for i := range arr {
-					el, ok := arr[i].(map[string]interface{})
-					if !ok {
-						continue
-					}
-					t, _ := el["type"].(string)
-					data, _ := el["data"].(map[string]interface{})
-					if t == "image" || t == "record" || t == "video" {
-						if u, _ := data["url"].(string); strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") {
-							continue
-						}
-						src := ""
-						if f, _ := data["file"].(string); f != "" {
-							src = f
-						}
-						if src == "" {
-							if pth, _ := data["path"].(string); pth != "" {
-								src = pth
-							}
-						}
-						if src == "" {
-							continue
-						}
-						up, _ := uploadViaB(src, "", cfg)
-						if up.URL != "" {
-							data["url"] = up.URL
-							data["file"] = up.URL
-							delete(data, "path")
-							changed = true
-						}
-					} else if t == "text" {
-						if txt, _ := data["text"].(string); txt != "" {
-							nv := rewritePictureTagInText(txt, cfg)
-							if nv != txt {
-								data["text"] = nv
-								changed = true
-							}
-						}
-					}
+	sessCtx, cancelSess := context.WithCancel(context.Background())
+	defer cancelSess()
+	sess := &session{
+		ctx:         sessCtx,
+		cancel:      cancelSess,
+		id:          newSessionID(),
+		route:       cfg.routeName,
+		remote:      r.RemoteAddr,
+		started:     time.Now(),
+		cfg:         cfg,
+		client:      clientConn,
+		upstream:    upstreamConn,
+		upstreamURL: cfg.UpstreamWSURL,
+		selfID:      strings.TrimSpace(r.Header.Get("X-Self-ID")),
+	}
+	registerSession(sess)
+	defer unregisterSession(sess)
+	loggerA.Info("ws opened", "session", sess.id, "route", cfg.routeName, "remote", r.RemoteAddr, "upstream", upstreamURL)
+	var capture *captureFile
+	if dir := liveRoute(cfg).CaptureDir; dir != "" {
+		if capture, err = openCapture(dir, sess); err != nil {
+			loggerA.Error("创建录制文件失败", "err", err, "dir", dir)
+		} else {
+			defer capture.Close()
+		}
+	}
+
+	pairs := metricWSPairs.WithLabelValues(cfg.routeName)
+	pairs.Inc()
+	defer pairs.Dec()
+	toUpstream := metricMessages.WithLabelValues(cfg.routeName, dirToUpstream)
+	toClient := metricMessages.WithLabelValues(cfg.routeName, dirToClient)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		defer sess.cancel()
+		defer func() {
+			if rec := recover(); rec != nil {
+				loggerA.Error("发生异常 (客户端到上游)", "err", rec)
+			}
+		}()
+		for {
+			mt, msg, err := limits.readMessage(clientConn)
+			if err != nil {
+				if errors.Is(err, errMessageTooLarge) {
+					metricWSRejected.WithLabelValues(cfg.routeName, "too_large").Inc()
 				}
-				if changed {
-					p["message"] = arr
-					newCmd := oneBotCommand{Action: "send_msg", Params: p, Echo: cmd.Echo}
-					b, _ := json.Marshal(newCmd)
-					return b
+				if !sess.closed.Load() {
+					loggerA.Error("读取海豹消息失败", "err", err)
 				}
+				_ = sess.upstreamConn().WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), timeNowPlus())
+				return
 			}
-		}
-		return msg
-	case "send_private_msg":
-		raw, _ := json.Marshal(cmd.Params)
-		var p map[string]interface{}
-		if json.Unmarshal(raw, &p) == nil {
-			if v, ok := p["message"].(string); ok {
-				nv := rewriteCQMediaInText(v, cfg)
-				nv = rewritePictureTagInText(nv, cfg)
-				if nv != v {
-					p["message"] = nv
-					newCmd := oneBotCommand{Action: "send_private_msg", Params: p, Echo: cmd.Echo}
-					b, _ := json.Marshal(newCmd)
-					return b
-				}
-			} else if arr, ok := p["message"].([]interface{}); ok {
-				changed := false
-				for i := range arr {
-					el, ok := arr[i].(map[string]interface{})
-					if !ok {
-						continue
-					}
-					t, _ := el["type"].(string)
-					data, _ := el["data"].(map[string]interface{})
-					if t == "image" || t == "record" || t == "video" {
-						// prefer existing http(s) url
-						if u, _ := data["url"].(string); strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") {
-							continue
-						}
-						// candidate source
-						src := ""
-						if f, _ := data["file"].(string); f != "" {
-							src = f
-						}
-						if src == "" {
-							if pth, _ := data["path"].(string); pth != "" {
-								src = pth
-							}
-						}
-						if src == "" {
-							continue
-						}
-						up, _ := uploadViaB(src, "", cfg)
-						if up.URL != "" {
-							// set both url and file to remote URL to support impls that prefer 'file'
-							data["url"] = up.URL
-							data["file"] = up.URL
-							// drop local-only path if present
-							delete(data, "path")
-							changed = true
-						}
-					} else if t == "text" {
-						if txt, _ := data["text"].(string); txt != "" {
-							nv := rewritePictureTagInText(txt, cfg)
-							if nv != txt {
-								data["text"] = nv
-								changed = true
-							}
-						}
+			capture.record(captureIn, mt, msg)
+			ctx := sess.ctx
+			var span trace.Span
+			if mt == websocket.TextMessage {
+				ctx, span = startActionSpan(sess.ctx, msg, cfg.routeName, sess)
+				// 每条消息使用最新配置，热重载后无需重连
+				live := liveRoute(cfg)
+				uctx, cancel := live.uploadContext(ctx)
+				rewritten, rerr := rewriteIfUpload(uctx, cmdBytes(msg), live, sess)
+				cancel()
+				if rerr != nil {
+					// 引用了禁止读取的路径：不转发，直接回复失败
+					rec := auditBegin(sess, requestIDFrom(ctx), msg)
+					endSpan(span, rerr)
+					auditSent(sess, rec, rerr)
+					if err := rejectAction(sess, msg, rerr.Error()); err != nil {
+						loggerA.Error("写入海豹消息失败", "err", err)
+						return
 					}
+					continue
 				}
-				if changed {
-					p["message"] = arr
-					newCmd := oneBotCommand{Action: "send_private_msg", Params: p, Echo: cmd.Echo}
-					b, _ := json.Marshal(newCmd)
-					return b
-				}
+				msg = rewritten
+			}
+			var rec *auditRecord
+			if mt == websocket.TextMessage {
+				rec = auditBegin(sess, requestIDFrom(ctx), msg)
+			}
+			up := sess.upstreamConn()
+			err = up.WriteMessage(mt, msg)
+			if err != nil && sess.upstreamConn() != up {
+				// 写入期间上游被重连，改写到新连接
+				err = sess.upstreamConn().WriteMessage(mt, msg)
 			}
+			endSpan(span, err)
+			auditSent(sess, rec, err)
+			if err != nil {
+				loggerA.Error("写入协议端消息失败", "err", err)
+				return
+			}
+			capture.record(captureOut, mt, msg)
+			toUpstream.Inc()
+			sess.toUpstream.Add(1)
 		}
-		return msg
-	case "send_group_msg":
-		raw, _ := json.Marshal(cmd.Params)
-		var p map[string]interface{}
-		if json.Unmarshal(raw, &p) == nil {
-			if v, ok := p["message"].(string); ok {
-				nv := rewriteCQMediaInText(v, cfg)
-				nv = rewritePictureTagInText(nv, cfg)
-				if nv != v {
-					p["message"] = nv
-					newCmd := oneBotCommand{Action: "send_group_msg", Params: p, Echo: cmd.Echo}
-					b, _ := json.Marshal(newCmd)
-					return b
+	}()
+
+	go func() {
+		defer wg.Done()
+		// 任一方向的转发结束即取消该会话进行中的上传
+		defer sess.cancel()
+		defer func() {
+			if rec := recover(); rec != nil {
+				loggerA.Error("发生异常 (上游到客户端)", "err", rec)
+			}
+		}()
+		for {
+			up := sess.upstreamConn()
+			mt, msg, err := upLimits.readMessage(up)
+			if err != nil {
+				if !sess.closed.Load() && sess.upstreamConn() != up {
+					// 管理接口触发了重连，继续读取新连接
+					continue
 				}
-			} else if arr, ok := p["message"].([]interface{}); ok {
-				changed := false
-				for i := range arr {
-					el, ok := arr[i].(map[string]interface{})
-					if !ok {
-						continue
-					}
-					t, _ := el["type"].(string)
-					data, _ := el["data"].(map[string]interface{})
-					if t == "image" || t == "record" || t == "video" {
-						if u, _ := data["url"].(string); strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") {
-							continue
-						}
-						src := ""
-						if f, _ := data["file"].(string); f != "" {
-							src = f
-						}
-						if src == "" {
-							if pth, _ := data["path"].(string); pth != "" {
-								src = pth
-							}
-						}
-						if src == "" {
-							continue
-						}
-						up, _ := uploadViaB(src, "", cfg)
-						if up.URL != "" {
-							data["url"] = up.URL
-							data["file"] = up.URL
-							delete(data, "path")
-							changed = true
-						}
-					} else if t == "text" {
-						if txt, _ := data["text"].(string); txt != "" {
-							nv := rewritePictureTagInText(txt, cfg)
-							if nv != txt {
-								data["text"] = nv
-								changed = true
-							}
-						}
-					}
+				if errors.Is(err, errMessageTooLarge) {
+					metricWSRejected.WithLabelValues(cfg.routeName, "too_large").Inc()
 				}
-				if changed {
-					p["message"] = arr
-					newCmd := oneBotCommand{Action: "send_group_msg", Params: p, Echo: cmd.Echo}
-					b, _ := json.Marshal(newCmd)
-					return b
+				if !sess.closed.Load() {
+					loggerA.Error("读取协议端消息失败", "err", err)
 				}
+				_ = clientConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), timeNowPlus())
+				return
 			}
-		}
-		return msg
-	case "upload_private_file":
-		raw, _ := json.Marshal(cmd.Params)
-		var p uploadPrivateFileParams
-		if err := json.Unmarshal(raw, &p); err != nil {
-			return msg
-		}
-		up, name := uploadViaB(p.File, p.Name, cfg)
-		if up.LocalPath != "" {
-			newCmd := oneBotCommand{
-				Action: "upload_private_file",
-				Params: uploadPrivateFileParams{UserID: p.UserID, File: up.LocalPath, Name: name},
-				Echo:   cmd.Echo,
-			}
-			b, _ := json.Marshal(newCmd)
-			return b
-		}
-		if up.URL != "" {
-			// 用 cqcode 发送
-			cq := fmt.Sprintf("[CQ:file,file=%s,name=%s]", escapeCommaMaybe(up.URL), name)
-			newCmd := oneBotCommand{
-				Action: "send_private_msg",
-				Params: sendPrivateMsgParams{UserID: p.UserID, Message: cq},
-				Echo:   cmd.Echo,
-			}
-			b, _ := json.Marshal(newCmd)
-			return b
-		}
-		return msg
-	case "upload_group_file":
-		raw, _ := json.Marshal(cmd.Params)
-		var p uploadGroupFileParams
-		if err := json.Unmarshal(raw, &p); err != nil {
-			return msg
-		}
-		up, name := uploadViaB(p.File, p.Name, cfg)
-		if up.LocalPath != "" {
-			newCmd := oneBotCommand{
-				Action: "upload_group_file",
-				Params: uploadGroupFileParams{GroupID: p.GroupID, File: up.LocalPath, Name: name},
-				Echo:   cmd.Echo,
+			capture.record(captureEvent, mt, msg)
+			if mt == websocket.TextMessage {
+				sess.observeEvent(msg)
+				auditResponse(sess, msg)
 			}
-			b, _ := json.Marshal(newCmd)
-			return b
-		}
-		if up.URL != "" {
-			cq := fmt.Sprintf("[CQ:file,file=%s,name=%s]", escapeCommaMaybe(up.URL), name)
-			newCmd := oneBotCommand{
-				Action: "send_group_msg",
-				Params: sendGroupMsgParams{GroupID: p.GroupID, Message: cq},
-				Echo:   cmd.Echo,
+			if err := sess.writeClient(mt, msg); err != nil {
+				loggerA.Error("写入海豹消息失败", "err", err)
+				return
 			}
-			b, _ := json.Marshal(newCmd)
-			return b
+			toClient.Inc()
+			sess.toClient.Add(1)
+		}
+	}()
+
+	wg.Wait()
+	auditSessionClosed(sess)
+	loggerA.Info("ws closed", "session", sess.id, "route", cfg.routeName, "remote", r.RemoteAddr, "upstream", upstreamURL)
+	clientConn.Close()
+	sess.upstreamConn().Close()
+}
+
+// dialUpstream 按路由配置携带 access_token 连接协议端，返回连接与实际拨号的 URL。
+func dialUpstream(d *websocket.Dialer, cfg *Config) (*websocket.Conn, string, error) {
+	header := http.Header{}
+	if cfg.UpstreamAccessToken != "" && !cfg.UpstreamUseQueryToken {
+		header.Set("Authorization", "Bearer "+cfg.UpstreamAccessToken)
+	}
+	upstreamURL := cfg.UpstreamWSURL
+	if cfg.UpstreamAccessToken != "" && cfg.UpstreamUseQueryToken {
+		if u, e := url.Parse(upstreamURL); e == nil {
+			q := u.Query()
+			q.Set("access_token", cfg.UpstreamAccessToken)
+			u.RawQuery = q.Encode()
+			upstreamURL = u.String()
 		}
-		return msg
-	default:
-		return msg
 	}
+	conn, _, err := d.Dial(upstreamURL, header)
+	return conn, upstreamURL, err
 }
 
+// upstreamHandshakeTimeout 与 websocket.DefaultDialer 一致
+const upstreamHandshakeTimeout = 45 * time.Second
+
+func timeNowPlus() (deadline time.Time) { // minimal helper to satisfy control writes
+	return time.Now().Add(1 * time.Second)
+}
+
+func cmdBytes(b []byte) []byte { return b }
+
 func escapeCommaMaybe(text string) string { return strings.ReplaceAll(text, ",", "%2C") }
 
+// uploadResult 为上传结果；Inline 表示 b 不可用时按 upload_fallback 回退，URL 为文件内容的 base64://
 type uploadResult struct {
 	URL       string
 	LocalPath string
+	Inline    bool
 }
 
-func uploadViaB(fileField string, name string, cfg *Config) (uploadResult, string) {
+func uploadViaB(fileField string, name string, job *rewriteJob) (uploadResult, string) {
 	path := fileField
-	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+	if isRemoteURL(path) {
 		if name == "" {
 			if u, err := url.Parse(path); err == nil {
 				base := filepath.Base(u.Path)
@@ -671,6 +805,46 @@ func uploadViaB(fileField string, name string, cfg *Config) (uploadResult, strin
 		}
 		return uploadResult{URL: path}, name
 	}
+	if job.sess != nil {
+		job.sess.pendingUploads.Add(1)
+		defer job.sess.pendingUploads.Add(-1)
+	}
+	ctx, span := tracer.Start(job.ctx, "upload_via_b", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("onebot.action", job.action)))
+	defer span.End()
+	data, name, err := loadSource(path, name, job.cfg.sandbox)
+	if errors.Is(err, errPathDenied) {
+		loggerA.Warn("拒绝读取允许目录之外的文件", "rid", requestIDFrom(job.ctx), "action", job.action, "route", job.cfg.routeName, "src", path, "err", err)
+		job.denied = append(job.denied, path)
+		failUpload(job, span, "denied", err)
+		return uploadResult{}, ""
+	}
+	if err != nil {
+		failUpload(job, span, "source", err)
+		return uploadResult{}, ""
+	}
+	span.SetAttributes(attribute.String("upload.name", name), attribute.Int("upload.bytes", len(data)))
+	up, upName, unavailable := postToB(ctx, data, name, job)
+	if up.URL == "" && unavailable && job.cfg.UploadFallback == uploadFallbackBase64 && !strings.HasPrefix(path, "base64://") {
+		metricUploadFallbacks.Inc()
+		loggerA.Warn("b 不可用，文件改为 base64 内联", "rid", requestIDFrom(job.ctx), "name", name, "bytes", len(data))
+		return uploadResult{URL: base64URI(data), Inline: true}, name
+	}
+	return up, upName
+}
+
+// failUpload 记录上传失败的指标，并将 span 标记为失败。
+func failUpload(job *rewriteJob, span trace.Span, reason string, err error) {
+	job.uploadErr = fmt.Sprintf("%s: %v", reason, err)
+	metricUploadFailures.WithLabelValues(reason).Inc()
+	span.SetAttributes(attribute.String("upload.failure", reason))
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// loadSource 读取 base64:// / file:// / 本地路径指向的文件内容，并在 name 为空时推断文件名。
+// 本地路径须通过 sb 的检查。
+func loadSource(path string, name string, sb *fileSandbox) ([]byte, string, error) {
 	// Handle base64:// content
 	if strings.HasPrefix(path, "base64://") {
 		enc := strings.TrimPrefix(path, "base64://")
@@ -681,55 +855,12 @@ func uploadViaB(fileField string, name string, cfg *Config) (uploadResult, strin
 		data, err := base64.StdEncoding.DecodeString(enc)
 		if err != nil {
 			loggerA.Error("Base64 解码失败", "err", err)
-			return uploadResult{}, ""
+			return nil, "", err
 		}
 		if name == "" {
 			name = "file.bin"
 		}
-		var body bytes.Buffer
-		writer := multipart.NewWriter(&body)
-		part, err := writer.CreateFormFile("file", name)
-		if err != nil {
-			loggerA.Error("创建表单文件失败", "err", err)
-			return uploadResult{}, ""
-		}
-		if _, e := part.Write(data); e != nil {
-			loggerA.Error("写入 Base64 数据失败", "err", e)
-			return uploadResult{}, ""
-		}
-		_ = writer.WriteField("name", name)
-		writer.Close()
-
-		req, err := http.NewRequest("POST", cfg.UploadEndpoint, &body)
-		if err != nil {
-			loggerA.Error("创建 HTTP 请求失败", "err", err)
-			return uploadResult{}, ""
-		}
-		req.Header.Set("Content-Type", writer.FormDataContentType())
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			loggerA.Error("上传 HTTP 请求失败", "err", err)
-			return uploadResult{}, ""
-		}
-		defer resp.Body.Close()
-		b, _ := io.ReadAll(resp.Body)
-		if resp.StatusCode/100 != 2 {
-			loggerA.Error("上传失败", "status", resp.StatusCode, "body", string(b))
-			return uploadResult{}, ""
-		}
-		var ret struct {
-			URL       string `json:"url"`
-			Name      string `json:"name"`
-			LocalPath string `json:"local_path"`
-		}
-		if err := json.Unmarshal(b, &ret); err != nil {
-			loggerA.Error("解析上传响应失败", "err", err)
-			return uploadResult{}, ""
-		}
-		if ret.Name != "" {
-			name = ret.Name
-		}
-		return uploadResult{URL: ret.URL, LocalPath: ret.LocalPath}, name
+		return data, name, nil
 	}
 	if strings.HasPrefix(path, "file://") {
 		u, err := url.Parse(path)
@@ -750,47 +881,137 @@ func uploadViaB(fileField string, name string, cfg *Config) (uploadResult, strin
 			path = abs
 		}
 	}
-	f, err := os.Open(path)
+	if name == "" {
+		name = filepath.Base(path)
+	}
+	path, err := sb.resolve(path)
+	if errors.Is(err, errPathDenied) {
+		return nil, "", err
+	}
+	var data []byte
+	if err == nil {
+		data, err = os.ReadFile(path)
+	}
 	if err != nil {
 		loggerA.Error("打开上传文件失败", "err", err)
-		return uploadResult{}, ""
+		return nil, "", err
 	}
-	defer f.Close()
-	if name == "" {
-		name = filepath.Base(path)
+	return data, name, nil
+}
+
+// uploader 标识上传来源，供 B 的文件管理页展示：路由名，已知机器人账号时附加账号。
+func (job *rewriteJob) uploader() string {
+	who := "middleware-a/" + job.cfg.routeName
+	if job.sess != nil {
+		if id := job.sess.info().SelfID; id != "" {
+			who += "/" + id
+		}
 	}
+	return who
+}
 
+// postToB 以 multipart 表单将文件上传到 b，返回 b 给出的 URL / 本地路径；
+// 失败时 unavailable 表示 b 暂时不可用（而不是拒绝了该文件），可按 upload_fallback 回退。
+func postToB(ctx context.Context, data []byte, name string, job *rewriteJob) (uploadResult, string, bool) {
+	span := trace.SpanFromContext(ctx)
+	rid := requestIDFrom(ctx)
 	// 多平台构建
 	var body bytes.Buffer
 	writer := multipart.NewWriter(&body)
 	part, err := writer.CreateFormFile("file", name)
 	if err != nil {
-		loggerA.Error("创建表单文件失败", "err", err)
-		return uploadResult{}, ""
+		loggerA.Error("创建表单文件失败", "rid", rid, "err", err)
+		return uploadResult{}, "", false
 	}
-	if _, err := io.Copy(part, f); err != nil {
-		loggerA.Error("拷贝文件失败", "err", err)
-		return uploadResult{}, ""
+	if _, err := part.Write(data); err != nil {
+		loggerA.Error("写入文件数据失败", "rid", rid, "err", err)
+		return uploadResult{}, "", false
 	}
 	_ = writer.WriteField("name", name)
+	_ = writer.WriteField("uploader", job.uploader())
 	writer.Close()
 
-	req, err := http.NewRequest("POST", cfg.UploadEndpoint, &body)
-	if err != nil {
-		loggerA.Error("创建 HTTP 请求失败", "err", err)
-		return uploadResult{}, ""
+	eps := orderEndpoints(job.cfg.uploadEndpoints(), job.cfg.UploadBreakerFailures)
+	if len(eps) == 0 {
+		failUpload(job, span, "request", errNoUploadEndpoint)
+		return uploadResult{}, "", false
 	}
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		loggerA.Error("上传 HTTP 请求失败", "err", err)
-		return uploadResult{}, ""
+	payload, contentType := body.Bytes(), writer.FormDataContentType()
+	maxWait := time.Duration(job.cfg.UploadRetryMaxWait) * time.Second
+	var resp uploadAttempt
+	// timedOut 为达到总超时的端点：可能仍在处理，之后的轮次不再请求
+	timedOut := map[string]bool{}
+	for round := 0; ; round++ {
+		// 依次尝试各端点，全部暂时不可用时按本轮要求的最短 Retry-After 与指数退避重试；
+		// 只有上传被取消时立即放弃，b 拒绝文件（429 以外的 4xx）时由 postOnce 直接返回响应
+		var (
+			last    uploadAttempt
+			minWait = time.Duration(-1)
+			fatal   bool
+		)
+		for i, ep := range eps {
+			if timedOut[ep.URL] {
+				continue
+			}
+			a := job.postOnce(ctx, ep.URL, payload, contentType)
+			if a.reason == "" {
+				resp = a
+				break
+			}
+			if a.reason == "circuit_open" {
+				if last.reason == "" {
+					last = a
+				}
+				continue
+			}
+			last = a
+			if a.reason == "request" && ctx.Err() != nil {
+				fatal = true
+				break
+			}
+			if a.reason == "request" && !retryableUploadError(ctx, a.err) {
+				timedOut[ep.URL] = true
+			}
+			if minWait < 0 || a.retryAfter < minWait {
+				minWait = a.retryAfter
+			}
+			if i < len(eps)-1 {
+				metricUploadFailovers.Inc()
+				loggerA.Warn("上传端点暂时不可用，切换到下一个", "rid", rid, "endpoint", ep.URL, "reason", a.reason, "err", a.err)
+			}
+		}
+		if resp.endpoint != "" {
+			break
+		}
+		if last.reason == "circuit_open" && minWait < 0 {
+			failUpload(job, span, "circuit_open", errUploadCircuitOpen)
+			loggerA.Warn("上传端点熔断中，跳过上传", "rid", rid, "endpoints", len(eps))
+			return uploadResult{}, "", true
+		}
+		wait := uploadRetryDelay(round, max(minWait, 0))
+		if len(timedOut) == len(eps) {
+			fatal = true
+		}
+		if fatal || round >= job.cfg.UploadMaxRetries || wait > maxWait {
+			failUpload(job, span, last.reason, last.err)
+			loggerA.Error("上传到 b 失败", "rid", rid, "reason", last.reason, "endpoint", last.endpoint, "attempts", round+1, "err", last.err, "retry_after", last.retryAfter.String(), "body", strings.TrimSpace(string(last.body)))
+			return uploadResult{}, "", true
+		}
+		metricUploadRetries.WithLabelValues(last.reason).Inc()
+		loggerA.Warn("b 暂时不可用，稍后重试", "rid", rid, "reason", last.reason, "err", last.err, "attempt", round+1, "wait", wait.Round(time.Millisecond).String())
+		if !sleepCtx(ctx, wait) {
+			failUpload(job, span, "request", ctx.Err())
+			return uploadResult{}, "", true
+		}
 	}
-	defer resp.Body.Close()
-	b, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode/100 != 2 {
-		loggerA.Error("上传失败", "status", resp.StatusCode, "body", string(b))
-		return uploadResult{}, ""
+	b := resp.body
+	span.SetAttributes(attribute.String("upload.endpoint", resp.endpoint))
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.status))
+	if resp.status/100 != 2 {
+		// b 拒绝了该文件（类型、大小、鉴权等），不回退
+		failUpload(job, span, "status", fmt.Errorf("status %d", resp.status))
+		loggerA.Error("上传失败", "rid", rid, "endpoint", resp.endpoint, "status", resp.status, "body", string(b))
+		return uploadResult{}, "", false
 	}
 	var ret struct {
 		URL       string `json:"url"`
@@ -798,11 +1019,75 @@ func uploadViaB(fileField string, name string, cfg *Config) (uploadResult, strin
 		LocalPath string `json:"local_path"`
 	}
 	if err := json.Unmarshal(b, &ret); err != nil {
-		loggerA.Error("解析上传响应失败", "err", err)
-		return uploadResult{}, ""
+		failUpload(job, span, "decode", err)
+		loggerA.Error("解析上传响应失败", "rid", rid, "err", err)
+		return uploadResult{}, "", true
 	}
+	metricUploadBytes.Add(float64(len(data)))
 	if ret.Name != "" {
 		name = ret.Name
 	}
-	return uploadResult{URL: ret.URL, LocalPath: ret.LocalPath}, name
+	loggerA.Info("upload success", "rid", rid, "name", name, "bytes", len(data), "url", ret.URL, "endpoint", resp.endpoint)
+	return uploadResult{URL: ret.URL, LocalPath: ret.LocalPath}, name, false
+}
+
+// uploadAttempt 为向一个端点发出的一次上传请求的结果；reason 非空表示该端点暂时不可用
+// （request、status、rate_limited 或 circuit_open）。
+type uploadAttempt struct {
+	endpoint   string
+	status     int
+	body       []byte
+	reason     string
+	err        error
+	retryAfter time.Duration
+}
+
+// postOnce 向 endpoint 发出一次上传请求，并按结果更新该端点的熔断器
+func (job *rewriteJob) postOnce(ctx context.Context, endpoint string, payload []byte, contentType string) uploadAttempt {
+	threshold := job.cfg.UploadBreakerFailures
+	cooldown := time.Duration(job.cfg.UploadBreakerCooldown) * time.Second
+	breaker := breakerFor(endpoint)
+	if !breaker.allow(threshold, cooldown, time.Now()) {
+		return uploadAttempt{endpoint: endpoint, reason: "circuit_open", err: errUploadCircuitOpen}
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return uploadAttempt{endpoint: endpoint, reason: "request", err: err}
+	}
+	req.Header.Set("Content-Type", contentType)
+	if job.cfg.UploadToken != "" {
+		req.Header.Set("Authorization", "Bearer "+job.cfg.UploadToken)
+	}
+	// 传递 trace context，B 的 span 挂在本次上传之下
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	if rid := requestIDFrom(ctx); rid != "" {
+		req.Header.Set(requestIDHeader, rid)
+	}
+	start := time.Now()
+	resp, err := job.cfg.uploadClient.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			breaker.failure(threshold, cooldown, time.Now())
+		}
+		return uploadAttempt{endpoint: endpoint, reason: "request", err: err}
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	metricUploadDuration.Observe(time.Since(start).Seconds())
+	a := uploadAttempt{endpoint: endpoint, status: resp.StatusCode, body: b}
+	switch {
+	case !retryableUploadStatus(resp.StatusCode):
+		breaker.success()
+		return a
+	case resp.StatusCode == http.StatusTooManyRequests:
+		// 限流说明 b 仍在正常工作，不计入熔断
+		breaker.success()
+		a.reason = "rate_limited"
+	default:
+		breaker.failure(threshold, cooldown, time.Now())
+		a.reason = "status"
+	}
+	a.err = fmt.Errorf("status %d", resp.StatusCode)
+	a.retryAfter, _ = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	return a
 }
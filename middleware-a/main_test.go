@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// spanRecorder 在进程内收集全部测试的 span；tracer 只会委托给第一次设置的全局 TracerProvider
+var spanRecorder = tracetest.NewSpanRecorder()
+
+func TestMain(m *testing.M) {
+	loggerA = slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: levelVarA}))
+	otel.SetTracerProvider(newTracerProvider(TracingConfig{}, sdktrace.WithSpanProcessor(spanRecorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	os.Exit(m.Run())
+}
+
+// loadTestConfig 将 cfg 写入临时文件后按正常流程加载，使默认值与校验和运行时一致
+func loadTestConfig(t *testing.T, cfg map[string]any) *Config {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "config.json")
+	writeTestConfig(t, p, cfg)
+	c, err := loadConfig(p)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	currentCfg.Store(c)
+	return c
+}
+
+func writeTestConfig(t *testing.T, p string, cfg map[string]any) {
+	t.Helper()
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testUpstream 模拟协议端，收集 a 转发来的动作
+type testUpstream struct {
+	*httptest.Server
+	msgs chan []byte
+}
+
+func newTestUpstream(t *testing.T) *testUpstream {
+	t.Helper()
+	up := &testUpstream{msgs: make(chan []byte, 16)}
+	up.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			up.msgs <- msg
+		}
+	}))
+	t.Cleanup(up.Close)
+	return up
+}
+
+func (up *testUpstream) wsURL() string { return "ws" + strings.TrimPrefix(up.URL, "http") }
+
+// next 返回协议端收到的下一条 action 动作
+func (up *testUpstream) next(t *testing.T, action string) []byte {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-up.msgs:
+			var cmd oneBotCommand
+			if json.Unmarshal(msg, &cmd) == nil && cmd.Action == action {
+				return msg
+			}
+		case <-deadline:
+			t.Fatalf("协议端未收到 %s", action)
+		}
+	}
+}
+
+// dialTestA 为 rc 启动 a 并以海豹的身份连接
+func dialTestA(t *testing.T, rc *Config) *websocket.Conn {
+	t.Helper()
+	a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { serveWS(w, r, rc) }))
+	t.Cleanup(a.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(a.URL, "http")+rc.ListenWSPath, nil)
+	if err != nil {
+		t.Fatalf("连接 a 失败: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
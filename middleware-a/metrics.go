@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus 指标，经 /metrics 暴露。
+var (
+	metricWSPairs = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "middleware_a_ws_pairs_active",
+		Help: "当前活跃的海豹-协议端 WebSocket 连接对数量",
+	}, []string{"route"})
+	metricMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "middleware_a_messages_forwarded_total",
+		Help: "转发的 WebSocket 消息数，direction 为 to_upstream 或 to_client",
+	}, []string{"route", "direction"})
+	metricRewrites = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "middleware_a_rewrites_total",
+		Help: "成功改写的媒体数，按动作与媒体类型区分",
+	}, []string{"action", "media"})
+	metricUploadDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "middleware_a_upload_duration_seconds",
+		Help:    "uploadViaB 向 B 上传文件的耗时",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	})
+	metricUploadBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "middleware_a_upload_bytes_total",
+		Help: "成功上传到 B 的字节数",
+	})
+	metricUploadFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "middleware_a_upload_failures_total",
+		Help: "uploadViaB 失败次数，reason 为 source、denied、request、status、rate_limited（b 返回 429 且重试后仍失败）、" +
+			"circuit_open（熔断中未请求）或 decode",
+	}, []string{"reason"})
+	metricUploadRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "middleware_a_upload_retries_total",
+		Help: "b 暂时不可用时重试上传的次数，reason 为 request、status（502/503/504）或 rate_limited（429）",
+	}, []string{"reason"})
+	metricUploadBreakerOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "middleware_a_upload_breaker_open",
+		Help: "上传端点是否处于熔断状态（1 为熔断）",
+	}, []string{"endpoint"})
+	metricUploadFailovers = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "middleware_a_upload_failovers_total",
+		Help: "上传端点暂时不可用而切换到下一个端点的次数",
+	})
+	metricUploadEndpointUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "middleware_a_upload_endpoint_up",
+		Help: "多个上传端点时各端点的健康检查结果（1 为健康）",
+	}, []string{"endpoint"})
+	metricUploadFallbacks = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "middleware_a_upload_fallbacks_total",
+		Help: "b 不可用时按 upload_fallback=base64 改为内联发送的文件数",
+	})
+	metricAuthFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "middleware_a_auth_failures_total",
+		Help: "海豹连接鉴权失败次数，reason 为 invalid（token 错误）或 banned（来源 IP 被临时封禁）",
+	}, []string{"route", "reason"})
+	metricWSRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "middleware_a_ws_rejected_total",
+		Help: "被拒绝的连接或消息数，reason 为 origin、max_pairs 或 too_large（消息超过大小上限，连接随之关闭）",
+	}, []string{"route", "reason"})
+)
+
+const (
+	dirToUpstream = "to_upstream"
+	dirToClient   = "to_client"
+)
+
+// countRewrite 记录一次成功的媒体改写。
+func (job *rewriteJob) countRewrite(media string) {
+	metricRewrites.WithLabelValues(job.action, media).Inc()
+}
+
+// countAuthFailure 记录一次海豹连接的鉴权失败，按路由区分。
+func (cfg *Config) countAuthFailure(reason string) {
+	metricAuthFailures.WithLabelValues(cfg.routeName, reason).Inc()
+}
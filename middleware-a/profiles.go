@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// CompatProfile 描述上游 OneBot 实现对媒体字段与文件上传的支持情况，决定改写结果的形态。
+type CompatProfile struct {
+	// SegmentFields 媒体消息段中写入远程地址的字段
+	SegmentFields []string
+	// UploadFileAcceptsURL upload_*_file 的 file 可直接使用 http(s) URL
+	UploadFileAcceptsURL bool
+	// UploadFileAcceptsBase64 upload_*_file 的 file 可直接使用 base64://
+	UploadFileAcceptsBase64 bool
+	// CQFileSupported 支持通过 [CQ:file] 消息发送文件
+	CQFileSupported bool
+}
+
+// CompatOverride 为配置中的 compat 字段，仅覆盖显式给出的项。
+type CompatOverride struct {
+	SegmentFields           []string `json:"segment_fields"`
+	UploadFileAcceptsURL    *bool    `json:"upload_file_accepts_url"`
+	UploadFileAcceptsBase64 *bool    `json:"upload_file_accepts_base64"`
+	CQFileSupported         *bool    `json:"cq_file_supported"`
+}
+
+// compatProfiles 为内置的上游实现配置，generic 保持早期版本的行为。
+var compatProfiles = map[string]CompatProfile{
+	"generic": {
+		SegmentFields:   []string{"file", "url"},
+		CQFileSupported: true,
+	},
+	"go-cqhttp": {
+		SegmentFields: []string{"file"},
+	},
+	"napcat": {
+		SegmentFields:           []string{"file"},
+		UploadFileAcceptsURL:    true,
+		UploadFileAcceptsBase64: true,
+		CQFileSupported:         true,
+	},
+	"llonebot": {
+		SegmentFields:           []string{"file"},
+		UploadFileAcceptsURL:    true,
+		UploadFileAcceptsBase64: true,
+		CQFileSupported:         true,
+	},
+	"lagrange": {
+		SegmentFields: []string{"file"},
+	},
+	"shamrock": {
+		SegmentFields:        []string{"file", "url"},
+		UploadFileAcceptsURL: true,
+	},
+}
+
+// resolveProfile 按名称取内置配置，并用 override 中给出的项覆盖。
+func resolveProfile(name string, override *CompatOverride) (CompatProfile, error) {
+	key := strings.ToLower(strings.TrimSpace(name))
+	if key == "" {
+		key = "generic"
+	}
+	p, ok := compatProfiles[key]
+	if !ok {
+		return CompatProfile{}, fmt.Errorf("未知的 compat_profile %q", name)
+	}
+	if override != nil {
+		if len(override.SegmentFields) > 0 {
+			p.SegmentFields = override.SegmentFields
+		}
+		if override.UploadFileAcceptsURL != nil {
+			p.UploadFileAcceptsURL = *override.UploadFileAcceptsURL
+		}
+		if override.UploadFileAcceptsBase64 != nil {
+			p.UploadFileAcceptsBase64 = *override.UploadFileAcceptsBase64
+		}
+		if override.CQFileSupported != nil {
+			p.CQFileSupported = *override.CQFileSupported
+		}
+	}
+	return p, nil
+}
+
+// applySegmentURL 按配置写入媒体消息段的远程地址，并去掉仅本地可用的 path。
+func (p CompatProfile) applySegmentURL(data map[string]interface{}, remote string) {
+	for _, f := range p.SegmentFields {
+		data[f] = remote
+	}
+	delete(data, "path")
+}
+
+func base64URI(data []byte) string {
+	return "base64://" + base64.StdEncoding.EncodeToString(data)
+}
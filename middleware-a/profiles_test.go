@@ -0,0 +1,183 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveProfile(t *testing.T) {
+	yes, no := true, false
+	cases := []struct {
+		name     string
+		profile  string
+		override *CompatOverride
+		want     CompatProfile
+		wantErr  bool
+	}{
+		{name: "空名称为 generic", want: compatProfiles["generic"]},
+		{name: "名称忽略大小写与空白", profile: " NapCat ", want: compatProfiles["napcat"]},
+		{name: "未知名称", profile: "mirai", wantErr: true},
+		{
+			name:     "仅覆盖显式给出的项",
+			profile:  "go-cqhttp",
+			override: &CompatOverride{UploadFileAcceptsBase64: &yes, CQFileSupported: &yes},
+			want:     CompatProfile{SegmentFields: []string{"file"}, UploadFileAcceptsBase64: true, CQFileSupported: true},
+		},
+		{
+			name:     "覆盖为 false 与 segment_fields",
+			profile:  "napcat",
+			override: &CompatOverride{SegmentFields: []string{"url"}, UploadFileAcceptsURL: &no},
+			want:     CompatProfile{SegmentFields: []string{"url"}, UploadFileAcceptsBase64: true, CQFileSupported: true},
+		},
+		{
+			name:     "空 segment_fields 不覆盖",
+			profile:  "shamrock",
+			override: &CompatOverride{SegmentFields: []string{}},
+			want:     compatProfiles["shamrock"],
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := resolveProfile(tc.profile, tc.override)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("期望报错，得到 %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("得到 %+v，期望 %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestApplySegmentURL(t *testing.T) {
+	cases := []struct {
+		profile string
+		want    map[string]interface{}
+	}{
+		{"generic", map[string]interface{}{"file": "http://b/1", "url": "http://b/1", "name": "a.png"}},
+		{"go-cqhttp", map[string]interface{}{"file": "http://b/1", "name": "a.png"}},
+		{"shamrock", map[string]interface{}{"file": "http://b/1", "url": "http://b/1", "name": "a.png"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.profile, func(t *testing.T) {
+			data := map[string]interface{}{"file": "/tmp/a.png", "path": "/tmp/a.png", "name": "a.png"}
+			compatProfiles[tc.profile].applySegmentURL(data, "http://b/1")
+			if !reflect.DeepEqual(data, tc.want) {
+				t.Errorf("得到 %v，期望 %v", data, tc.want)
+			}
+		})
+	}
+}
+
+// 各上游配置下 upload_*_file 的改写结果：本地路径、URL、base64:// 与 [CQ:file] 依次降级。
+func TestRewriteUploadFile(t *testing.T) {
+	content := []byte("%PDF-1.4 test")
+	doc := filepath.Join(t.TempDir(), "报告.pdf")
+	if err := os.WriteFile(doc, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	plain, local := newTestB(t, ""), newTestB(t, "/data/files/1.pdf")
+	group := `{"action":"upload_group_file","params":{"group_id":1,"file":` + mustJSON(doc) + `},"echo":"e1"}`
+	private := `{"action":"upload_private_file","params":{"user_id":2,"file":` + mustJSON(doc) + `},"echo":"e2"}`
+	cases := []struct {
+		name    string
+		profile string
+		compat  map[string]any
+		local   bool
+		msg     string
+		want    map[string]any
+	}{
+		{
+			name:    "b 返回本地路径时直接使用",
+			profile: "go-cqhttp",
+			local:   true,
+			msg:     group,
+			want:    map[string]any{"action": "upload_group_file", "params.file": "/data/files/1.pdf", "params.name": "报告.pdf"},
+		},
+		{
+			name:    "napcat 接受 URL",
+			profile: "napcat",
+			msg:     group,
+			want:    map[string]any{"action": "upload_group_file", "params.file": "{b}/files/1", "params.name": "报告.pdf", "echo": "e1"},
+		},
+		{
+			name:    "shamrock 接受 URL",
+			profile: "shamrock",
+			msg:     private,
+			want:    map[string]any{"action": "upload_private_file", "params.file": "{b}/files/1"},
+		},
+		{
+			name:    "不接受 URL 时改用 base64",
+			profile: "napcat",
+			compat:  map[string]any{"upload_file_accepts_url": false},
+			msg:     group,
+			want:    map[string]any{"action": "upload_group_file", "params.file": base64URI(content), "params.name": "报告.pdf"},
+		},
+		{
+			name:    "generic 群文件改为 CQ:file",
+			profile: "generic",
+			msg:     group,
+			want: map[string]any{
+				"action":          "send_group_msg",
+				"params.group_id": float64(1),
+				"params.message":  "[CQ:file,file={b}/files/1,name=报告.pdf]",
+				"params.file":     nil,
+				"echo":            "e1",
+			},
+		},
+		{
+			name:    "generic 私聊文件改为 CQ:file",
+			profile: "generic",
+			msg:     private,
+			want: map[string]any{
+				"action":         "send_private_msg",
+				"params.user_id": float64(2),
+				"params.message": "[CQ:file,file={b}/files/1,name=报告.pdf]",
+				"echo":           "e2",
+			},
+		},
+		{
+			name:    "开启 cq_file_supported 的 lagrange",
+			profile: "lagrange",
+			compat:  map[string]any{"cq_file_supported": true},
+			msg:     group,
+			want:    map[string]any{"action": "send_group_msg", "params.message": "[CQ:file,file={b}/files/1,name=报告.pdf]"},
+		},
+		{
+			name:    "go-cqhttp 无可用方式时保持原样",
+			profile: "go-cqhttp",
+			msg:     group,
+			want:    map[string]any{"action": "upload_group_file", "params.file": doc, "params.name": nil},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := plain
+			if tc.local {
+				b = local
+			}
+			extra := map[string]any{"compat_profile": tc.profile}
+			if tc.compat != nil {
+				extra["compat"] = tc.compat
+			}
+			got := rewriteWith(t, b, extra, tc.msg)
+			for path, want := range tc.want {
+				if s, ok := want.(string); ok {
+					want = strings.ReplaceAll(s, "{b}", b.URL)
+				}
+				if v := fieldAt(got, path); !reflect.DeepEqual(v, want) {
+					t.Errorf("%s = %#v，期望 %#v", path, v, want)
+				}
+			}
+		})
+	}
+}
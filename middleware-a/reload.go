@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// currentCfg 保存当前生效的配置，热重载时整体替换；已建立的 WS 连接不受影响。
+var currentCfg atomic.Pointer[Config]
+
+func currentConfig() *Config { return currentCfg.Load() }
+
+// liveRoute 返回 rc 对应路由的最新配置：有 name 的路由按 name 对应，其余按 listen_ws_path 与 self_id；
+// 路由已被移除时沿用 rc。
+func liveRoute(rc *Config) *Config {
+	cur := currentConfig()
+	if cur == nil {
+		return rc
+	}
+	for _, r := range cur.routes {
+		if r.routeKey == rc.routeKey {
+			return r
+		}
+	}
+	return rc
+}
+
+// reloadConfig 重新加载配置；校验失败时保留旧配置并返回错误。
+func reloadConfig(path string) error {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	old := currentConfig()
+	if cfg.ListenHTTP != old.ListenHTTP {
+		loggerA.Warn("listen_http 变更需重启后生效", "old", old.ListenHTTP, "new", cfg.ListenHTTP)
+	}
+	if cfg.TLS != old.TLS {
+		loggerA.Warn("tls 变更需重启后生效（证书文件内容变更会自动加载）")
+	}
+	if !reflect.DeepEqual(cfg.Tracing, old.Tracing) {
+		loggerA.Warn("tracing 变更需重启后生效")
+	}
+	if !reflect.DeepEqual(cfg.Audit, old.Audit) {
+		loggerA.Warn("audit 变更需重启后生效")
+	}
+	if cfg.LogFile != old.LogFile || cfg.LogFormat != old.LogFormat || cfg.LogConsole != old.LogConsole || cfg.logRotateOptions() != old.logRotateOptions() {
+		loggerA.Warn("log_file / log_format / log_console 及日志轮转配置变更需重启后生效")
+	}
+	setLogLevelA(cfg.LogLevel)
+	currentCfg.Store(cfg)
+	closeUploadClients(old)
+	loggerA.Info("配置已重新加载", "path", path, "routes", len(cfg.routes), "upload_endpoints", len(uploadTargets(cfg)), "log_level", cfg.LogLevel)
+	return nil
+}
+
+// closeUploadClients 关闭旧配置中上传客户端的空闲连接（各路由共用同一客户端）；
+// 进行中的上传不受影响，完成后其连接在空闲超时后关闭。
+func closeUploadClients(old *Config) {
+	old.uploadClient.CloseIdleConnections()
+}
+
+// watchConfig 在收到 SIGHUP 或配置文件修改时间 / 大小变化时重新加载配置。
+func watchConfig(path string, intervalSec int) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if intervalSec > 0 {
+		t := time.NewTicker(time.Duration(intervalSec) * time.Second)
+		defer t.Stop()
+		tick = t.C
+	}
+	var lastMod time.Time
+	var lastSize int64
+	if st, err := os.Stat(path); err == nil {
+		lastMod, lastSize = st.ModTime(), st.Size()
+	}
+	for {
+		select {
+		case <-hup:
+			loggerA.Info("收到 SIGHUP，重新加载配置")
+			if st, err := os.Stat(path); err == nil {
+				lastMod, lastSize = st.ModTime(), st.Size()
+			}
+		case <-tick:
+			st, err := os.Stat(path)
+			if err != nil || (st.ModTime().Equal(lastMod) && st.Size() == lastSize) {
+				continue
+			}
+			lastMod, lastSize = st.ModTime(), st.Size()
+			loggerA.Info("检测到配置文件变更", "path", path)
+		}
+		if err := reloadConfig(path); err != nil {
+			loggerA.Error("重新加载配置失败，继续使用旧配置", "err", err)
+		}
+	}
+}
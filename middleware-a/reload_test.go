@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func routeByPath(t *testing.T, cfg *Config, path string) *Config {
+	t.Helper()
+	for _, rc := range cfg.routes {
+		if rc.ListenWSPath == path {
+			return rc
+		}
+	}
+	t.Fatalf("没有 listen_ws_path 为 %s 的路由", path)
+	return nil
+}
+
+// 热重载后按 name 或 listen_ws_path/self_id 找到对应的新路由，与路由在列表中的位置无关
+func TestLiveRoute(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "config.json")
+	writeTestConfig(t, p, map[string]any{
+		"upload_endpoint": "http://127.0.0.1:1/upload",
+		"routes": []map[string]any{
+			{"listen_ws_path": "/ws/1", "upstream_ws_url": "ws://10.0.0.1:6700"},
+			{"listen_ws_path": "/ws/1", "self_id": "10001", "upstream_ws_url": "ws://10.0.0.2:6700"},
+			{"name": "bot", "listen_ws_path": "/ws/2", "upstream_ws_url": "ws://10.0.0.3:6700"},
+			{"listen_ws_path": "/ws/gone", "upstream_ws_url": "ws://10.0.0.4:6700"},
+		},
+	})
+	old, err := loadConfig(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentCfg.Store(old)
+
+	// 在最前面插入新路由，bot 改用新的路径，/ws/gone 被移除
+	writeTestConfig(t, p, map[string]any{
+		"upload_endpoint": "http://127.0.0.1:1/upload",
+		"routes": []map[string]any{
+			{"listen_ws_path": "/ws/0", "upstream_ws_url": "ws://10.0.1.0:6700"},
+			{"name": "bot", "listen_ws_path": "/ws/3", "upstream_ws_url": "ws://10.0.1.3:6700"},
+			{"listen_ws_path": "/ws/1", "self_id": "10001", "upstream_ws_url": "ws://10.0.1.2:6700"},
+			{"listen_ws_path": "/ws/1", "upstream_ws_url": "ws://10.0.1.1:6700"},
+		},
+	})
+	if err := reloadConfig(p); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		rc       *Config
+		upstream string
+	}{
+		{"未命名的路由按路径", old.routes[0], "ws://10.0.1.1:6700"},
+		{"未命名的路由按路径与 self_id", old.routes[1], "ws://10.0.1.2:6700"},
+		{"命名的路由按 name", old.routes[2], "ws://10.0.1.3:6700"},
+		{"已移除的路由沿用旧配置", old.routes[3], "ws://10.0.0.4:6700"},
+	}
+	for _, tt := range tests {
+		if got := liveRoute(tt.rc).UpstreamWSURL; got != tt.upstream {
+			t.Errorf("%s: upstream_ws_url = %s，期望 %s", tt.name, got, tt.upstream)
+		}
+	}
+	if rc := routeByPath(t, currentConfig(), "/ws/0"); rc.routeName != "route-0" || liveRoute(old.routes[0]) == rc {
+		t.Errorf("新插入的路由 route-0 被当作旧的 route-0")
+	}
+
+	// 未配置 routes 的顶层路由与之后同路径、未命名的路由相对应
+	writeTestConfig(t, p, map[string]any{
+		"listen_ws_path":  "/ws/1",
+		"upstream_ws_url": "ws://10.0.2.1:6700",
+		"upload_endpoint": "http://127.0.0.1:1/upload",
+	})
+	if err := reloadConfig(p); err != nil {
+		t.Fatal(err)
+	}
+	if got := liveRoute(old.routes[0]).UpstreamWSURL; got != "ws://10.0.2.1:6700" {
+		t.Errorf("顶层路由: upstream_ws_url = %s", got)
+	}
+}
+
+func TestRouteNameDuplicate(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "config.json")
+	writeTestConfig(t, p, map[string]any{
+		"upload_endpoint": "http://127.0.0.1:1/upload",
+		"routes": []map[string]any{
+			{"name": "bot", "listen_ws_path": "/ws/1", "upstream_ws_url": "ws://10.0.0.1:6700"},
+			{"name": " bot ", "listen_ws_path": "/ws/2", "upstream_ws_url": "ws://10.0.0.2:6700"},
+		},
+	})
+	if _, err := loadConfig(p); err == nil || !strings.Contains(err.Error(), "重复") {
+		t.Fatalf("重复的 name: err = %v", err)
+	}
+}
+
+// 热重载后旧配置的上传客户端不再保留空闲连接
+func TestReloadClosesIdleUploadConns(t *testing.T) {
+	var closed atomic.Int32
+	b := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	b.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+		if s == http.StateClosed {
+			closed.Add(1)
+		}
+	}
+	b.Start()
+	defer b.Close()
+
+	p := filepath.Join(t.TempDir(), "config.json")
+	cfg := map[string]any{
+		"listen_ws_path":  "/ws",
+		"upstream_ws_url": "ws://127.0.0.1:1",
+		"upload_endpoint": b.URL + "/upload",
+	}
+	writeTestConfig(t, p, cfg)
+	old, err := loadConfig(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentCfg.Store(old)
+	resp, err := old.routes[0].uploadClient.Get(b.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if err := reloadConfig(p); err != nil {
+		t.Fatal(err)
+	}
+	if currentConfig().routes[0].uploadClient == old.routes[0].uploadClient {
+		t.Fatal("热重载后仍为旧的上传客户端")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for closed.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("旧上传客户端的空闲连接未关闭")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 各路由共用按顶层配置创建的上传客户端，包括覆盖了上传端点的路由
+func TestRoutesShareUploadClient(t *testing.T) {
+	cfg := loadTestConfig(t, map[string]any{
+		"upstream_ws_url": "ws://127.0.0.1:1",
+		"upload_endpoint": "http://b1:8082/upload",
+		"routes": []map[string]any{
+			{"name": "r1", "listen_ws_path": "/a"},
+			{"name": "r2", "listen_ws_path": "/b", "upload_endpoint": "http://b2:8082/upload"},
+			{"name": "r3", "listen_ws_path": "/c", "upload_endpoints": []map[string]any{{"url": "http://b3:8082/upload"}}},
+		},
+	})
+	if cfg.uploadClient == nil {
+		t.Fatal("顶层未创建上传客户端")
+	}
+	for _, rc := range cfg.routes {
+		if rc.uploadClient != cfg.uploadClient {
+			t.Errorf("路由 %s 使用了单独的上传客户端", rc.routeName)
+		}
+	}
+	targets := uploadTargets(cfg)
+	if len(targets) != 3 {
+		t.Fatalf("上传端点 %v，期望 3 个", targets)
+	}
+	for url, tr := range targets {
+		if tr != cfg.uploadClient.Transport {
+			t.Errorf("%s 的健康检查未使用共用的 transport", url)
+		}
+	}
+}
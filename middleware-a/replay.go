@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// runReplayCLI 实现 `middleware-a replay`：在本地启动模拟协议端、模拟 b 与模拟海豹，
+// 按录制时序重放海豹发出的消息，并将 a 改写后发往协议端的内容与录制中的 out 逐条比较。
+// 有差异时返回 1，可直接作为回归检查。
+func runReplayCLI(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	cfgPath := fs.String("config", "config.json", "config path，使用其中的改写规则与兼容配置；文件不存在时使用默认值")
+	routeName := fs.String("route", "", "使用的路由，默认取录制文件中的路由")
+	speed := fs.Float64("speed", 1, "重放速度倍率，0 表示不等待录制中的间隔")
+	wait := fs.Duration("wait", 3*time.Second, "发送完毕后等待协议端收齐消息的最长时间")
+	update := fs.Bool("update", false, "用本次重放结果覆盖录制文件中的 out 记录，作为之后比较的期望")
+	debug := fs.Bool("debug", false, "输出改写调试日志（debug_rewrite）")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "用法: middleware-a replay [flags] capture.jsonl")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	path := fs.Arg(0)
+
+	levelVarA.Set(slog.LevelWarn)
+	if *debug {
+		levelVarA.Set(slog.LevelInfo)
+	}
+	loggerA = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: levelVarA})).With("component", "middleware-a")
+
+	recs, err := readCapture(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, path+":", err)
+		return 2
+	}
+	var open captureRecord
+	if len(recs) > 0 && recs[0].Dir == captureOpen {
+		open = recs[0]
+	}
+	rc, err := replayRoute(*cfgPath, *routeName, open.Route)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	rc.DebugRewrite = rc.DebugRewrite || *debug
+
+	sent, expected, got, err := replayCapture(rc, recs, *speed, *wait)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("路由 %s：重放 %d 条消息，协议端收到 %d 条，录制中为 %d 条\n", rc.routeName, sent, len(got), len(expected))
+
+	if *update {
+		if err := updateCapture(path, recs, got); err != nil {
+			fmt.Fprintln(os.Stderr, "更新录制文件失败:", err)
+			return 1
+		}
+		fmt.Println("已用本次结果更新", path)
+		return 0
+	}
+	diffs := 0
+	for i := 0; i < len(expected) || i < len(got); i++ {
+		var want, have string
+		if i < len(expected) {
+			want = normalizeReplay(expected[i])
+		}
+		if i < len(got) {
+			have = normalizeReplay(got[i])
+		}
+		if want == have {
+			continue
+		}
+		diffs++
+		fmt.Printf("#%d 不一致\n  期望: %s\n  实际: %s\n", i+1, shortenBase64(want, debugBase64Keep), shortenBase64(have, debugBase64Keep))
+	}
+	if diffs > 0 {
+		fmt.Printf("%d 条不一致\n", diffs)
+		return 1
+	}
+	fmt.Println("全部一致")
+	return 0
+}
+
+// replayCapture 在本地启动模拟协议端、模拟 b 与使用路由 rc 的 a，以模拟海豹重放 recs；
+// 返回发出的消息数、录制中的 out 记录，以及协议端实际收到的消息。
+func replayCapture(rc *Config, recs []captureRecord, speed float64, wait time.Duration) (int, []captureRecord, []captureRecord, error) {
+	var open captureRecord
+	if len(recs) > 0 && recs[0].Dir == captureOpen {
+		open = recs[0]
+	}
+	up := newReplayUpstream(recs, speed)
+	upURL, stopUp, err := serveLocal(up)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("启动模拟协议端失败: %w", err)
+	}
+	defer stopUp()
+	bURL, stopB, err := serveLocal(&replayB{})
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("启动模拟 b 失败: %w", err)
+	}
+	defer stopB()
+	rc.UpstreamWSURL = "ws" + strings.TrimPrefix(upURL, "http") + "/"
+	rc.UpstreamAccessToken = ""
+	rc.ServerAccessToken = ""
+	rc.ServerAccessTokens = nil
+	rc.UploadEndpoint = bURL + "/upload"
+	rc.UploadEndpoints = nil
+	rc.CaptureDir = ""
+	currentCfg.Store(&Config{routes: []*Config{rc}})
+	aURL, stopA, err := serveLocal(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { serveWS(w, r, rc) }))
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("启动 middleware-a 失败: %w", err)
+	}
+	defer stopA()
+
+	var expected []captureRecord
+	for _, rec := range recs {
+		if rec.Dir == captureOut {
+			expected = append(expected, rec)
+		}
+	}
+	sent, err := replaySealdice("ws"+strings.TrimPrefix(aURL, "http")+rc.ListenWSPath, open.SelfID, recs, up, len(expected), speed, wait)
+	if err != nil {
+		return sent, expected, nil, fmt.Errorf("模拟海豹连接失败: %w", err)
+	}
+	return sent, expected, up.received(), nil
+}
+
+func readCapture(path string) ([]captureRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var recs []captureRecord
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), 64<<20)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var rec captureRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("第 %d 行: %w", line, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, sc.Err()
+}
+
+// replayRoute 从配置中取出要重放的路由；配置文件不存在时使用默认配置。
+func replayRoute(cfgPath, name, recorded string) (*Config, error) {
+	cfg, err := loadConfig(cfgPath)
+	if os.IsNotExist(err) {
+		cfg = &Config{ListenWSPath: "/ws"}
+		cfg.routes, err = buildRoutes(cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("加载配置失败: %w", err)
+	}
+	if name == "" {
+		name = recorded
+	}
+	for _, r := range cfg.routes {
+		if r.routeName == name {
+			rc := *r
+			return &rc, nil
+		}
+	}
+	if name != "" && len(cfg.routes) > 1 {
+		return nil, fmt.Errorf("配置中没有路由 %q，请用 -route 指定", name)
+	}
+	rc := *cfg.routes[0]
+	return &rc, nil
+}
+
+// serveLocal 在 127.0.0.1 的随机端口上提供 h，返回其 http:// 地址与关闭函数。
+func serveLocal(h http.Handler) (string, func(), error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	srv := &http.Server{Handler: h}
+	go srv.Serve(ln)
+	return "http://" + ln.Addr().String(), func() { _ = srv.Close() }, nil
+}
+
+// replayDelay 等待到录制中第 ms 毫秒对应的重放时刻
+func replayDelay(start time.Time, ms int64, speed float64) {
+	if speed <= 0 {
+		return
+	}
+	at := start.Add(time.Duration(float64(ms) / speed * float64(time.Millisecond)))
+	time.Sleep(time.Until(at))
+}
+
+// replaySealdice 模拟海豹：连接 a，按时序发送录制中的 in 消息，随后等待协议端收到 want 条或超时。
+func replaySealdice(wsURL, selfID string, recs []captureRecord, up *replayUpstream, want int, speed float64, wait time.Duration) (int, error) {
+	header := http.Header{}
+	if selfID != "" {
+		header.Set("X-Self-ID", selfID)
+	}
+	start := time.Now()
+	up.start(start)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	sent := 0
+	for _, rec := range recs {
+		if rec.Dir != captureIn {
+			continue
+		}
+		mt, msg, err := rec.message()
+		if err != nil {
+			return sent, err
+		}
+		replayDelay(start, rec.MS, speed)
+		if err := conn.WriteMessage(mt, msg); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	deadline := time.Now().Add(wait)
+	for len(up.received()) < want && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), timeNowPlus())
+	return sent, nil
+}
+
+// replayUpstream 模拟协议端：按时序推送录制中的事件，收到带 echo 的动作时回放录制中对应的响应。
+type replayUpstream struct {
+	events    []captureRecord
+	responses map[string][]captureRecord
+	speed     float64
+	startAt   atomic.Pointer[time.Time]
+	once      sync.Once
+
+	mu  sync.Mutex
+	got []captureRecord
+}
+
+func newReplayUpstream(recs []captureRecord, speed float64) *replayUpstream {
+	up := &replayUpstream{responses: map[string][]captureRecord{}, speed: speed}
+	for _, rec := range recs {
+		if rec.Dir != captureEvent {
+			continue
+		}
+		if key, ok := responseEcho(rec); ok {
+			up.responses[key] = append(up.responses[key], rec)
+			continue
+		}
+		up.events = append(up.events, rec)
+	}
+	return up
+}
+
+// responseEcho 判断录制的协议端消息是否为动作响应，是则返回其 echo
+func responseEcho(rec captureRecord) (string, bool) {
+	if rec.Binary {
+		return "", false
+	}
+	var m struct {
+		Echo     interface{} `json:"echo"`
+		PostType string      `json:"post_type"`
+	}
+	if json.Unmarshal([]byte(rec.Data), &m) != nil || m.Echo == nil || m.PostType != "" {
+		return "", false
+	}
+	return echoKey(m.Echo), true
+}
+
+func (up *replayUpstream) start(t time.Time) { up.startAt.Store(&t) }
+
+func (up *replayUpstream) received() []captureRecord {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return append([]captureRecord(nil), up.got...)
+}
+
+func (up *replayUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	start := time.Now()
+	if t := up.startAt.Load(); t != nil {
+		start = *t
+	}
+	var wmu sync.Mutex
+	send := func(rec captureRecord) {
+		mt, msg, err := rec.message()
+		if err != nil {
+			return
+		}
+		wmu.Lock()
+		defer wmu.Unlock()
+		_ = conn.WriteMessage(mt, msg)
+	}
+	// 事件只向第一条连接推送
+	up.once.Do(func() {
+		go func() {
+			for _, ev := range up.events {
+				replayDelay(start, ev.MS, up.speed)
+				send(ev)
+			}
+		}()
+	})
+	for {
+		mt, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		rec := newCaptureRecord(time.Since(start).Milliseconds(), captureOut, mt, msg)
+		up.mu.Lock()
+		up.got = append(up.got, rec)
+		var resp *captureRecord
+		if mt == websocket.TextMessage {
+			var cmd oneBotCommand
+			if json.Unmarshal(msg, &cmd) == nil && cmd.Echo != nil {
+				key := echoKey(cmd.Echo)
+				if q := up.responses[key]; len(q) > 0 {
+					resp, up.responses[key] = &q[0], q[1:]
+				}
+			}
+		}
+		up.mu.Unlock()
+		if resp != nil {
+			send(*resp)
+		}
+	}
+}
+
+// replayB 模拟 b：接受上传并返回固定格式的文件地址，不落盘。
+type replayB struct{ n atomic.Int64 }
+
+func (b *replayB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f, hdr, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	size, _ := io.Copy(io.Discard, f)
+	f.Close()
+	name := r.FormValue("name")
+	if name == "" {
+		name = hdr.Filename
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+		"url":  fmt.Sprintf("http://%s/files/replay/%d_%s", r.Host, b.n.Add(1), name),
+		"name": name,
+		"size": size,
+	})
+}
+
+// uploadedURL 匹配 b 返回的文件地址；录制与重放中的地址必然不同，比较前统一替换
+var uploadedURL = regexp.MustCompile(`https?://[^\s"'\[\]<>,]+/files/[^\s"'\[\]<>,]+`)
+
+// normalizeReplay 统一 JSON 键顺序并替换上传得到的文件地址，便于逐条比较。
+func normalizeReplay(rec captureRecord) string {
+	s := rec.Data
+	if !rec.Binary {
+		dec := json.NewDecoder(strings.NewReader(s))
+		dec.UseNumber()
+		var v interface{}
+		if dec.Decode(&v) == nil {
+			var buf bytes.Buffer
+			enc := json.NewEncoder(&buf)
+			enc.SetEscapeHTML(false)
+			if enc.Encode(v) == nil {
+				s = strings.TrimSpace(buf.String())
+			}
+		}
+	}
+	return uploadedURL.ReplaceAllString(s, "<uploaded>")
+}
+
+// updateCapture 以本次重放中协议端收到的消息替换录制文件中的 out 记录
+func updateCapture(path string, recs []captureRecord, got []captureRecord) error {
+	out := make([]captureRecord, 0, len(recs)+len(got))
+	for _, rec := range recs {
+		if rec.Dir != captureOut {
+			out = append(out, rec)
+		}
+	}
+	out = append(out, got...)
+	// open 行保持在最前
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Dir == captureOpen || out[j].Dir == captureOpen {
+			return out[i].Dir == captureOpen && out[j].Dir != captureOpen
+		}
+		return out[i].MS < out[j].MS
+	})
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for i := range out {
+		b, err := json.Marshal(&out[i])
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+		w.Write(b)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 重放 testdata 中的录制（媒体均为 base64://，不依赖本地文件），a 的输出经归一化后须与录制一致。
+func TestReplayCapture(t *testing.T) {
+	recs, err := readCapture("testdata/replay-base64.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := replayRoute(filepath.Join(t.TempDir(), "config.json"), "", recs[0].Route)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent, expected, got, err := replayCapture(rc, recs, 0, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 4 || len(expected) != 4 {
+		t.Fatalf("录制中应有 4 条 in 与 4 条 out，实际 %d / %d", sent, len(expected))
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("协议端收到 %d 条，期望 %d 条", len(got), len(expected))
+	}
+	for i := range expected {
+		want, have := normalizeReplay(expected[i]), normalizeReplay(got[i])
+		if want != have {
+			t.Errorf("#%d 不一致\n  期望: %s\n  实际: %s", i+1, want, have)
+		}
+		if strings.Contains(have, "base64://") {
+			t.Errorf("#%d 仍含 base64:// 负载: %s", i+1, shortenBase64(have, debugBase64Keep))
+		}
+	}
+	// 媒体改写为 b 的地址，纯文本原样转发
+	for i, n := range []int{2, 1, 1, 0} {
+		if c := strings.Count(normalizeReplay(got[i]), "<uploaded>"); c != n {
+			t.Errorf("#%d 含 %d 个上传地址，期望 %d", i+1, c, n)
+		}
+	}
+}
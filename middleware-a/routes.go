@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Route 为多账号路由中的一项：按监听路径（及可选的 X-Self-ID）匹配海豹连接，
+// 并使用各自的上游与改写策略。未填写的字段沿用顶层配置。
+type Route struct {
+	Name                  string           `json:"name"`
+	ListenWSPath          string           `json:"listen_ws_path"`
+	SelfID                string           `json:"self_id"`
+	UpstreamWSURL         string           `json:"upstream_ws_url"`
+	UpstreamAccessToken   string           `json:"upstream_access_token"`
+	UpstreamUseQueryToken *bool            `json:"upstream_use_query_token"`
+	UpstreamTLS           *ClientTLSConfig `json:"upstream_tls"`
+	ServerAccessToken     string           `json:"server_access_token"`
+	ServerAccessTokens    []string         `json:"server_access_tokens"`
+	UploadToken           string           `json:"upload_token"`
+	UploadEndpoint        string           `json:"upload_endpoint"`
+	UploadEndpoints       []UploadEndpoint `json:"upload_endpoints"`
+	CompatProfile         string           `json:"compat_profile"`
+	Compat                *CompatOverride  `json:"compat"`
+	RewriteRules          []RewriteRule    `json:"rewrite_rules"`
+	MediaSegmentTypes     []string         `json:"media_segment_types"`
+}
+
+// prepare 根据配置生成改写所需的规则表、媒体类型与兼容配置。
+func (cfg *Config) prepare() error {
+	table, err := buildRuleTable(cfg.RewriteRules)
+	if err != nil {
+		return err
+	}
+	cfg.ruleTable = table
+	cfg.mediaTypes = buildMediaTypes(cfg.MediaSegmentTypes)
+	if cfg.profile, err = resolveProfile(cfg.CompatProfile, cfg.Compat); err != nil {
+		return err
+	}
+	if cfg.sandbox, err = newFileSandbox(cfg.AllowedFileRoots); err != nil {
+		return err
+	}
+	if cfg.upstreamTLS, err = cfg.UpstreamTLS.build(); err != nil {
+		return fmt.Errorf("upstream_tls: %w", err)
+	}
+	return nil
+}
+
+// buildRoutes 展开 routes 为各自独立的 *Config；未配置 routes 时顶层配置即唯一路由。
+// 路由不能覆盖 upload_tls 与上传超时，上传客户端只按顶层配置创建一次，各路由共用其连接池。
+func buildRoutes(cfg *Config) ([]*Config, error) {
+	if err := cfg.prepare(); err != nil {
+		return nil, err
+	}
+	uploadTLS, err := cfg.UploadTLS.build()
+	if err != nil {
+		return nil, fmt.Errorf("upload_tls: %w", err)
+	}
+	cfg.uploadClient = newUploadClient(uploadTLS,
+		time.Duration(cfg.UploadConnectTimeout)*time.Second, time.Duration(cfg.UploadTimeout)*time.Second)
+	if len(cfg.Routes) == 0 {
+		cfg.routeName = "default"
+		cfg.routeKey = "path:" + cfg.ListenWSPath + "\x00"
+		return []*Config{cfg}, nil
+	}
+	seen := map[string]string{}
+	names := map[string]int{}
+	out := make([]*Config, 0, len(cfg.Routes))
+	for i, rt := range cfg.Routes {
+		rc := *cfg
+		rc.Routes = nil
+		rc.routes = nil
+		name := strings.TrimSpace(rt.Name)
+		if name != "" {
+			if prev, ok := names[name]; ok {
+				return nil, fmt.Errorf("routes[%d]: name %q 与 routes[%d] 重复", i, name, prev)
+			}
+			names[name] = i
+		}
+		if rt.ListenWSPath != "" {
+			rc.ListenWSPath = rt.ListenWSPath
+		}
+		rc.selfID = strings.TrimSpace(rt.SelfID)
+		if rt.UpstreamWSURL != "" {
+			rc.UpstreamWSURL = rt.UpstreamWSURL
+		}
+		if rt.UpstreamAccessToken != "" {
+			rc.UpstreamAccessToken = rt.UpstreamAccessToken
+		}
+		if rt.UpstreamTLS != nil {
+			rc.UpstreamTLS = *rt.UpstreamTLS
+		}
+		if rt.UpstreamUseQueryToken != nil {
+			rc.UpstreamUseQueryToken = *rt.UpstreamUseQueryToken
+		}
+		if rt.ServerAccessToken != "" || rt.ServerAccessTokens != nil {
+			rc.ServerAccessToken = rt.ServerAccessToken
+			rc.ServerAccessTokens = rt.ServerAccessTokens
+		}
+		if rt.UploadToken != "" {
+			rc.UploadToken = rt.UploadToken
+		}
+		switch {
+		case rt.UploadEndpoints != nil:
+			if err := prepareUploadEndpoints(rt.UploadEndpoints); err != nil {
+				return nil, fmt.Errorf("routes[%d]: %w", i, err)
+			}
+			rc.UploadEndpoints = rt.UploadEndpoints
+		case rt.UploadEndpoint != "":
+			rc.UploadEndpoint, rc.UploadEndpoints = rt.UploadEndpoint, nil
+		}
+		if rt.CompatProfile != "" {
+			rc.CompatProfile = rt.CompatProfile
+		}
+		if rt.Compat != nil {
+			rc.Compat = rt.Compat
+		}
+		if rt.RewriteRules != nil {
+			rc.RewriteRules = rt.RewriteRules
+		}
+		if rt.MediaSegmentTypes != nil {
+			rc.MediaSegmentTypes = rt.MediaSegmentTypes
+		}
+		if rc.UpstreamWSURL == "" {
+			return nil, fmt.Errorf("routes[%d]: upstream_ws_url 不能为空", i)
+		}
+		key := rc.ListenWSPath + "\x00" + rc.selfID
+		if prev, ok := seen[key]; ok {
+			return nil, fmt.Errorf("routes[%d]: 与 %s 的 listen_ws_path/self_id 重复", i, prev)
+		}
+		// 有 name 时按 name 对应，否则按 listen_ws_path 与 self_id，不依赖路由的顺序
+		rc.routeName, rc.routeKey = name, "name:"+name
+		if name == "" {
+			rc.routeName, rc.routeKey = fmt.Sprintf("route-%d", i), "path:"+key
+		}
+		seen[key] = rc.routeName
+		if err := rc.prepare(); err != nil {
+			return nil, fmt.Errorf("routes[%d]: %w", i, err)
+		}
+		out = append(out, &rc)
+	}
+	return out, nil
+}
+
+// logAttrs 在 args 前加上路由名，用于路由相关的日志。
+func (cfg *Config) logAttrs(args ...any) []any {
+	return append([]any{"route", cfg.routeName}, args...)
+}
+
+// matchRoute 按请求路径选出路由；同一路径有多条时优先匹配 X-Self-ID，其次为未指定 self_id 的路由。
+func matchRoute(routes []*Config, r *http.Request) *Config {
+	selfID := strings.TrimSpace(r.Header.Get("X-Self-ID"))
+	var fallback *Config
+	for _, rc := range routes {
+		if rc.ListenWSPath != r.URL.Path {
+			continue
+		}
+		if rc.selfID == "" {
+			if fallback == nil {
+				fallback = rc
+			}
+			continue
+		}
+		if rc.selfID == selfID {
+			return rc
+		}
+	}
+	return fallback
+}
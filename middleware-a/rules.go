@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// RewriteRule 描述一条动作改写规则：对 action 的 params 中 field 指向的字段按 strategy 处理。
+// field 为以 "." 分隔的 JSON 路径，"*" 表示遍历数组的每个元素，例如 "messages.*.data.content"。
+type RewriteRule struct {
+	Action   string `json:"action"`
+	Field    string `json:"field"`
+	Strategy string `json:"strategy"`
+}
+
+const (
+	// strategyMessage 字段为消息：CQ 码字符串或消息段数组
+	strategyMessage = "message"
+	// strategyURL 上传到 B 后替换为 B 返回的 URL
+	strategyURL = "url"
+	// strategyLocalPath 上传到 B 后替换为 B 所在机器的本地路径，无本地路径时退回 URL
+	strategyLocalPath = "local_path"
+	// strategyUploadFile upload_*_file 语义：优先本地路径，否则改为发送 [CQ:file]
+	strategyUploadFile = "upload_file"
+)
+
+var knownStrategies = map[string]bool{
+	strategyMessage:    true,
+	strategyURL:        true,
+	strategyLocalPath:  true,
+	strategyUploadFile: true,
+}
+
+// defaultRewriteRules 为内置规则；配置中出现同名 action 的规则时，该 action 的内置规则整体被替换。
+var defaultRewriteRules = []RewriteRule{
+	{Action: "send_msg", Field: "message", Strategy: strategyMessage},
+	{Action: "send_private_msg", Field: "message", Strategy: strategyMessage},
+	{Action: "send_group_msg", Field: "message", Strategy: strategyMessage},
+	{Action: "send_private_forward_msg", Field: "messages", Strategy: strategyMessage},
+	{Action: "send_group_forward_msg", Field: "messages", Strategy: strategyMessage},
+	{Action: "upload_private_file", Field: "file", Strategy: strategyUploadFile},
+	{Action: "upload_group_file", Field: "file", Strategy: strategyUploadFile},
+	{Action: "set_group_portrait", Field: "file", Strategy: strategyURL},
+	{Action: "set_qq_avatar", Field: "file", Strategy: strategyURL},
+	{Action: "send_group_notice", Field: "image", Strategy: strategyURL},
+}
+
+// defaultMediaSegmentTypes 为默认改写的媒体类消息段，含 NapCat / LLOneBot 扩展的 file、mface。
+var defaultMediaSegmentTypes = []string{"image", "record", "video", "file", "mface"}
+
+func buildMediaTypes(types []string) map[string]bool {
+	if len(types) == 0 {
+		types = defaultMediaSegmentTypes
+	}
+	m := map[string]bool{}
+	for _, t := range types {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			m[t] = true
+		}
+	}
+	return m
+}
+
+func (cfg *Config) isMediaSegment(t string) bool {
+	return cfg.mediaTypes[strings.ToLower(t)]
+}
+
+// buildRuleTable 合并内置规则与配置规则，并校验配置规则的合法性。
+func buildRuleTable(custom []RewriteRule) (map[string][]RewriteRule, error) {
+	table := map[string][]RewriteRule{}
+	overridden := map[string]bool{}
+	for i, r := range custom {
+		r.Action = strings.TrimSpace(r.Action)
+		r.Field = strings.TrimSpace(r.Field)
+		r.Strategy = strings.ToLower(strings.TrimSpace(r.Strategy))
+		if r.Action == "" || r.Field == "" {
+			return nil, fmt.Errorf("rewrite_rules[%d]: action 与 field 不能为空", i)
+		}
+		if !knownStrategies[r.Strategy] {
+			return nil, fmt.Errorf("rewrite_rules[%d]: 未知的 strategy %q", i, r.Strategy)
+		}
+		overridden[r.Action] = true
+		table[r.Action] = append(table[r.Action], r)
+	}
+	for _, r := range defaultRewriteRules {
+		if overridden[r.Action] {
+			continue
+		}
+		table[r.Action] = append(table[r.Action], r)
+	}
+	return table, nil
+}
+
+func (cfg *Config) rulesFor(action string) []RewriteRule {
+	return cfg.ruleTable[action]
+}
+
+// rewriteJob 为一次动作改写的上下文，贯穿消息段改写与上传。
+type rewriteJob struct {
+	ctx    context.Context // 携带动作 span，上传时据此创建子 span
+	cfg    *Config
+	action string
+	sess   *session // 所属会话，用于统计进行中的上传，可为 nil
+
+	debug     bool          // debug_rewrite 开启时收集 notes 并输出前后对比
+	notes     []rewriteNote // 各媒体的处理结果
+	uploadErr string        // 最近一次上传失败的原因
+	denied    []string      // 不在 allowed_file_roots 内而被拒绝的来源
+}
+
+func rewriteIfUpload(ctx context.Context, msg []byte, cfg *Config, sess *session) ([]byte, error) {
+	var cmd oneBotCommand
+	if err := json.Unmarshal(msg, &cmd); err != nil {
+		return msg, nil
+	}
+	rules := cfg.rulesFor(cmd.Action)
+	if len(rules) == 0 {
+		return msg, nil
+	}
+	p, ok := cmd.Params.(map[string]interface{})
+	if !ok {
+		return msg, nil
+	}
+	job := &rewriteJob{ctx: ctx, cfg: cfg, action: cmd.Action, sess: sess, debug: cfg.DebugRewrite}
+	out := applyRules(cmd, p, rules, job, msg)
+	if job.debug {
+		job.dumpRewrite(msg, out)
+	}
+	if len(job.denied) > 0 {
+		return msg, fmt.Errorf("%w: %s", errPathDenied, strings.Join(job.denied, ", "))
+	}
+	return out, nil
+}
+
+// applyRules 依次应用动作的改写规则，未发生变化时原样返回 msg。
+func applyRules(cmd oneBotCommand, p map[string]interface{}, rules []RewriteRule, job *rewriteJob, msg []byte) []byte {
+	changed := false
+	for _, rule := range rules {
+		if rule.Strategy == strategyUploadFile {
+			if b := rewriteUploadFile(cmd, p, rule, job); b != nil {
+				return b
+			}
+			continue
+		}
+		if _, ch := applyRule(p, strings.Split(rule.Field, "."), rule.Strategy, job); ch {
+			changed = true
+		}
+	}
+	if !changed {
+		return msg
+	}
+	b, _ := json.Marshal(oneBotCommand{Action: cmd.Action, Params: p, Echo: cmd.Echo})
+	return b
+}
+
+// applyRule 沿 path 定位字段并按 strategy 改写，返回新值与是否发生变化。
+func applyRule(v interface{}, path []string, strategy string, job *rewriteJob) (interface{}, bool) {
+	if len(path) == 0 {
+		switch strategy {
+		case strategyMessage:
+			return rewriteMessageValue(v, job)
+		case strategyURL, strategyLocalPath:
+			return rewriteFileValue(v, strategy, job)
+		}
+		return v, false
+	}
+	key := path[0]
+	switch node := v.(type) {
+	case map[string]interface{}:
+		child, ok := node[key]
+		if !ok {
+			return v, false
+		}
+		nv, ch := applyRule(child, path[1:], strategy, job)
+		if ch {
+			node[key] = nv
+		}
+		return node, ch
+	case []interface{}:
+		if key != "*" {
+			return v, false
+		}
+		changed := false
+		for i := range node {
+			nv, ch := applyRule(node[i], path[1:], strategy, job)
+			if ch {
+				node[i] = nv
+				changed = true
+			}
+		}
+		return node, changed
+	}
+	return v, false
+}
+
+func rewriteFileValue(v interface{}, strategy string, job *rewriteJob) (interface{}, bool) {
+	src, _ := v.(string)
+	if src == "" {
+		job.noteSkip("field", src, skipEmptyFile)
+		return v, false
+	}
+	if isRemoteURL(src) {
+		job.noteSkip("field", src, skipAlreadyHTTP)
+		return v, false
+	}
+	up, _ := uploadViaB(src, "", job)
+	if strategy == strategyLocalPath && up.LocalPath != "" {
+		job.countRewrite("file")
+		job.noteRewrite("field", src, up.LocalPath)
+		return up.LocalPath, true
+	}
+	if up.URL == "" {
+		job.noteSkip("field", src, skipUploadFailed)
+		return v, false
+	}
+	job.countRewrite("file")
+	job.noteRewrite("field", src, up.URL)
+	return up.URL, true
+}
+
+// rewriteUploadFile 处理 upload_*_file 类动作：B 返回本地路径时原动作改用该路径；
+// 否则按上游配置依次尝试 URL、base64:// 与 [CQ:file]。返回 nil 表示未改写。
+func rewriteUploadFile(cmd oneBotCommand, p map[string]interface{}, rule RewriteRule, job *rewriteJob) []byte {
+	path := strings.Split(rule.Field, ".")
+	file, _ := lookupField(p, path).(string)
+	if file == "" {
+		job.noteSkip(rule.Field, file, skipEmptyFile)
+		return nil
+	}
+	name, _ := p["name"].(string)
+	up, upName := uploadViaB(file, name, job)
+	replace := func(v string, n string) []byte {
+		job.countRewrite("file")
+		job.noteRewrite(rule.Field, file, v)
+		setField(p, path, v)
+		if n != "" {
+			p["name"] = n
+		}
+		b, _ := json.Marshal(oneBotCommand{Action: cmd.Action, Params: p, Echo: cmd.Echo})
+		return b
+	}
+	prof := job.cfg.profile
+	if up.Inline {
+		// b 不可用，由下方按上游是否接受 base64:// 处理
+		up.URL = ""
+	}
+	if up.LocalPath != "" {
+		return replace(up.LocalPath, upName)
+	}
+	if up.URL != "" && prof.UploadFileAcceptsURL {
+		return replace(up.URL, upName)
+	}
+	if prof.UploadFileAcceptsBase64 && !isRemoteURL(file) {
+		if data, n, err := loadSource(file, name, job.cfg.sandbox); err == nil {
+			return replace(base64URI(data), n)
+		}
+	}
+	if up.URL == "" {
+		job.noteSkip(rule.Field, file, skipUploadFailed)
+		return nil
+	}
+	if !prof.CQFileSupported {
+		loggerA.Warn("上游不支持以 URL 上传文件，保持原样", "action", cmd.Action, "profile", job.cfg.CompatProfile)
+		job.noteSkip(rule.Field, file, skipCQFileDisabled)
+		return nil
+	}
+	job.countRewrite("file")
+	job.noteRewrite(rule.Field, file, "[CQ:file] "+up.URL)
+	// 用 cqcode 发送
+	cq := fmt.Sprintf("[CQ:file,file=%s,name=%s]", escapeCommaMaybe(up.URL), upName)
+	var newCmd oneBotCommand
+	if gid, ok := p["group_id"]; ok {
+		newCmd = oneBotCommand{Action: "send_group_msg", Params: map[string]interface{}{"group_id": gid, "message": cq}, Echo: cmd.Echo}
+	} else if uid, ok := p["user_id"]; ok {
+		newCmd = oneBotCommand{Action: "send_private_msg", Params: map[string]interface{}{"user_id": uid, "message": cq}, Echo: cmd.Echo}
+	} else {
+		return nil
+	}
+	b, _ := json.Marshal(newCmd)
+	return b
+}
+
+func lookupField(v interface{}, path []string) interface{} {
+	for _, key := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+func setField(m map[string]interface{}, path []string, val interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := m[key].(map[string]interface{})
+		if !ok {
+			return
+		}
+		m = next
+	}
+	m[path[len(path)-1]] = val
+}
+
+// rewriteMessageValue 改写消息字段，支持 CQ 码字符串与消息段数组两种形式。
+func rewriteMessageValue(v interface{}, job *rewriteJob) (interface{}, bool) {
+	switch m := v.(type) {
+	case string:
+		nv := rewriteCQMediaInText(m, job)
+		nv = rewritePictureTagInText(nv, job)
+		return nv, nv != m
+	case []interface{}:
+		return m, rewriteMessageSegments(m, job)
+	case map[string]interface{}:
+		// 单个消息段
+		arr := []interface{}{m}
+		return m, rewriteMessageSegments(arr, job)
+	}
+	return v, false
+}
+
+func rewriteMessageSegments(arr []interface{}, job *rewriteJob) bool {
+	changed := false
+	for i := range arr {
+		el, ok := arr[i].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		t, _ := el["type"].(string)
+		data, _ := el["data"].(map[string]interface{})
+		if data == nil {
+			continue
+		}
+		target := "segment " + t
+		if job.cfg.isMediaSegment(t) {
+			// prefer existing http(s) url
+			if u, _ := data["url"].(string); isRemoteURL(u) {
+				job.noteSkip(target, u, skipAlreadyHTTP)
+				continue
+			}
+			// candidate source
+			src := ""
+			for _, k := range []string{"file", "path", "url"} {
+				if v, _ := data[k].(string); v != "" {
+					src = v
+					break
+				}
+			}
+			if src == "" {
+				job.noteSkip(target, src, skipEmptyFile)
+				continue
+			}
+			if isRemoteURL(src) {
+				job.noteSkip(target, src, skipAlreadyHTTP)
+				continue
+			}
+			name, _ := data["name"].(string)
+			up, name := uploadViaB(src, name, job)
+			if up.URL == "" {
+				job.noteSkip(target, src, skipUploadFailed)
+			} else {
+				if up.Inline {
+					// base64:// 只写入 file，不作为 url
+					data["file"] = up.URL
+					delete(data, "path")
+					delete(data, "url")
+				} else {
+					job.cfg.profile.applySegmentURL(data, up.URL)
+				}
+				job.countRewrite(t)
+				job.noteRewrite(target, src, up.URL)
+				// 文件类消息段保留原始文件名，避免以 URL 末段命名
+				if t == "file" && name != "" {
+					data["name"] = name
+				}
+				changed = true
+			}
+		} else if t != "text" && t != "node" {
+			job.noteSkip(target, "", skipNotMedia)
+		} else if t == "text" {
+			if txt, _ := data["text"].(string); txt != "" {
+				nv := rewritePictureTagInText(txt, job)
+				if nv != txt {
+					data["text"] = nv
+					changed = true
+				}
+			}
+		} else if t == "node" {
+			// 合并转发中的自定义节点
+			if nv, ch := rewriteMessageValue(data["content"], job); ch {
+				data["content"] = nv
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+func isRemoteURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newTestB 模拟 b 的 /upload：一律返回 <b>/files/1 并回显文件名，localPath 非空时同时返回本地路径
+func newTestB(t *testing.T, localPath string) *httptest.Server {
+	t.Helper()
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, err := r.FormFile("file"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"url":        "http://" + r.Host + "/files/1",
+			"name":       r.FormValue("name"),
+			"local_path": localPath,
+		})
+	}))
+	t.Cleanup(b.Close)
+	return b
+}
+
+// rewriteWith 以 b 为上传端点、extra 为附加配置加载 a，改写 msg 并返回解析后的动作
+func rewriteWith(t *testing.T, b *httptest.Server, extra map[string]any, msg string) map[string]any {
+	t.Helper()
+	cfg := map[string]any{
+		"listen_ws_path":  "/ws",
+		"upstream_ws_url": "ws://127.0.0.1:1/",
+		"upload_endpoint": b.URL + "/upload",
+	}
+	for k, v := range extra {
+		cfg[k] = v
+	}
+	rc := loadTestConfig(t, cfg).routes[0]
+	out, err := rewriteIfUpload(context.Background(), []byte(msg), rc, nil)
+	if err != nil {
+		t.Fatalf("rewriteIfUpload: %v", err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("改写结果不是合法 JSON: %v\n%s", err, out)
+	}
+	return got
+}
+
+// fieldAt 按以 "." 分隔的路径取值，数组下标写作数字
+func fieldAt(v any, path string) any {
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]any:
+			v = node[key]
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i >= len(node) {
+				return nil
+			}
+			v = node[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+func TestBuildRuleTable(t *testing.T) {
+	defaults := func(action string) []RewriteRule {
+		var rs []RewriteRule
+		for _, r := range defaultRewriteRules {
+			if r.Action == action {
+				rs = append(rs, r)
+			}
+		}
+		return rs
+	}
+	cases := []struct {
+		name    string
+		custom  []RewriteRule
+		want    map[string][]RewriteRule
+		wantErr string
+	}{
+		{
+			name: "未配置时使用内置规则",
+			want: map[string][]RewriteRule{
+				"send_group_msg":     defaults("send_group_msg"),
+				"upload_group_file":  defaults("upload_group_file"),
+				"set_group_portrait": defaults("set_group_portrait"),
+				"set_qq_avatar":      defaults("set_qq_avatar"),
+				"send_group_notice":  defaults("send_group_notice"),
+			},
+		},
+		{
+			name: "同名 action 整体替换内置规则，其余保留",
+			custom: []RewriteRule{
+				{Action: "send_group_msg", Field: "extra", Strategy: "url"},
+				{Action: "send_group_msg", Field: "message", Strategy: "message"},
+			},
+			want: map[string][]RewriteRule{
+				"send_group_msg": {
+					{Action: "send_group_msg", Field: "extra", Strategy: strategyURL},
+					{Action: "send_group_msg", Field: "message", Strategy: strategyMessage},
+				},
+				"send_private_msg": defaults("send_private_msg"),
+			},
+		},
+		{
+			name:   "新增 action 并规范化空白与大小写",
+			custom: []RewriteRule{{Action: " x_batch ", Field: " items.*.pic ", Strategy: " Local_Path "}},
+			want: map[string][]RewriteRule{
+				"x_batch":        {{Action: "x_batch", Field: "items.*.pic", Strategy: strategyLocalPath}},
+				"send_group_msg": defaults("send_group_msg"),
+			},
+		},
+		{
+			name:    "action 为空",
+			custom:  []RewriteRule{{Field: "file", Strategy: "url"}},
+			wantErr: "rewrite_rules[0]",
+		},
+		{
+			name:    "field 为空",
+			custom:  []RewriteRule{{Action: "a", Strategy: "url"}, {Action: "b", Strategy: "url"}},
+			wantErr: "rewrite_rules[0]",
+		},
+		{
+			name:    "未知 strategy",
+			custom:  []RewriteRule{{Action: "a", Field: "file", Strategy: "url"}, {Action: "b", Field: "file", Strategy: "base64"}},
+			wantErr: `rewrite_rules[1]: 未知的 strategy "base64"`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			table, err := buildRuleTable(tc.custom)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("err = %v，期望包含 %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for action, want := range tc.want {
+				if got := table[action]; !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: %+v，期望 %+v", action, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRewriteRules(t *testing.T) {
+	img := "base64://" + base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\n-test-image"))
+	plain, local := newTestB(t, ""), newTestB(t, "/data/files/1.png")
+	doc := filepath.Join(t.TempDir(), "报告.pdf")
+	if err := os.WriteFile(doc, []byte("%PDF-1.4"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	overrideMsg := map[string]any{"rewrite_rules": []map[string]any{
+		{"action": "send_group_msg", "field": "extra", "strategy": "url"},
+	}}
+	batch := map[string]any{"rewrite_rules": []map[string]any{
+		{"action": "x_batch", "field": "items.*.pic", "strategy": "url"},
+	}}
+	forward := map[string]any{"rewrite_rules": []map[string]any{
+		{"action": "send_group_forward_msg", "field": "messages.*.data.content", "strategy": "message"},
+	}}
+	portraitLocal := map[string]any{"rewrite_rules": []map[string]any{
+		{"action": "set_group_portrait", "field": "file", "strategy": "local_path"},
+	}}
+	cases := []struct {
+		name  string
+		local bool
+		extra map[string]any
+		msg   string
+		// want 中的 {b} 替换为 b 的地址
+		want map[string]any
+	}{
+		{
+			name: "image 消息段",
+			msg:  `{"action":"send_group_msg","params":{"group_id":1,"message":[{"type":"image","data":{"file":"` + img + `","path":"/tmp/a.png"}}]}}`,
+			want: map[string]any{
+				"params.message.0.data.file": "{b}/files/1",
+				"params.message.0.data.url":  "{b}/files/1",
+				"params.message.0.data.path": nil,
+			},
+		},
+		{
+			name: "CQ 码字符串",
+			msg:  `{"action":"send_private_msg","params":{"user_id":1,"message":"看[CQ:image,file=` + img + `,name=a.png]"}}`,
+			want: map[string]any{"params.message": "看[CQ:image,file={b}/files/1,name=a.png]"},
+		},
+		{
+			name: "mface 扩展消息段",
+			msg:  `{"action":"send_group_msg","params":{"group_id":1,"message":[{"type":"mface","data":{"file":"` + img + `","summary":"[表情]"}}]}}`,
+			want: map[string]any{
+				"params.message.0.data.file":    "{b}/files/1",
+				"params.message.0.data.summary": "[表情]",
+			},
+		},
+		{
+			name: "file 消息段保留 name",
+			msg:  `{"action":"send_group_msg","params":{"group_id":1,"message":[{"type":"file","data":{"file":"` + img + `","name":"报告.pdf"}}]}}`,
+			want: map[string]any{
+				"params.message.0.data.file": "{b}/files/1",
+				"params.message.0.data.name": "报告.pdf",
+			},
+		},
+		{
+			name: "file 消息段缺 name 时取本地文件名",
+			msg:  `{"action":"send_group_msg","params":{"group_id":1,"message":[{"type":"file","data":{"file":` + mustJSON(doc) + `}}]}}`,
+			want: map[string]any{
+				"params.message.0.data.file": "{b}/files/1",
+				"params.message.0.data.name": "报告.pdf",
+			},
+		},
+		{
+			name: "已有 http url 不改写",
+			msg:  `{"action":"send_group_msg","params":{"group_id":1,"message":[{"type":"image","data":{"file":"` + img + `","url":"http://x/a.png"}}]}}`,
+			want: map[string]any{"params.message.0.data.file": img},
+		},
+		{
+			name: "非媒体消息段不改写",
+			msg:  `{"action":"send_group_msg","params":{"group_id":1,"message":[{"type":"json","data":{"file":"` + img + `"}}]}}`,
+			want: map[string]any{"params.message.0.data.file": img},
+		},
+		{
+			name:  "media_segment_types 替换默认类型",
+			extra: map[string]any{"media_segment_types": []string{"sticker"}},
+			msg:   `{"action":"send_group_msg","params":{"group_id":1,"message":[{"type":"sticker","data":{"file":"` + img + `"}},{"type":"image","data":{"file":"` + img + `"}}]}}`,
+			want: map[string]any{
+				"params.message.0.data.file": "{b}/files/1",
+				"params.message.1.data.file": img,
+			},
+		},
+		{
+			name: "合并转发的 node 内容",
+			msg:  `{"action":"send_group_forward_msg","params":{"group_id":1,"messages":[{"type":"node","data":{"content":[{"type":"image","data":{"file":"` + img + `"}}]}}]}}`,
+			want: map[string]any{"params.messages.0.data.content.0.data.file": "{b}/files/1"},
+		},
+		{
+			name:  "通配路径遍历消息数组",
+			extra: forward,
+			msg:   `{"action":"send_group_forward_msg","params":{"group_id":1,"messages":[{"type":"node","data":{"content":"[CQ:image,file=` + img + `,name=a.png]"}},{"type":"node","data":{"content":"纯文本"}}]}}`,
+			want: map[string]any{
+				"params.messages.0.data.content": "[CQ:image,file={b}/files/1,name=a.png]",
+				"params.messages.1.data.content": "纯文本",
+			},
+		},
+		{
+			name:  "通配路径按 url 策略改写每个元素",
+			extra: batch,
+			msg:   `{"action":"x_batch","params":{"items":[{"pic":"` + img + `"},{"pic":"http://x/1.png"},{"other":1}]}}`,
+			want: map[string]any{
+				"params.items.0.pic": "{b}/files/1",
+				"params.items.1.pic": "http://x/1.png",
+				"params.items.2.pic": nil,
+			},
+		},
+		{
+			name:  "通配符只匹配数组",
+			extra: batch,
+			msg:   `{"action":"x_batch","params":{"items":{"pic":"` + img + `"}}}`,
+			want:  map[string]any{"params.items.pic": img},
+		},
+		{
+			name:  "覆盖内置规则后原字段不再改写",
+			extra: overrideMsg,
+			msg:   `{"action":"send_group_msg","params":{"group_id":1,"extra":"` + img + `","message":[{"type":"image","data":{"file":"` + img + `"}}]}}`,
+			want: map[string]any{
+				"params.extra":               "{b}/files/1",
+				"params.message.0.data.file": img,
+			},
+		},
+		{
+			name:  "覆盖不影响其他 action 的内置规则",
+			extra: overrideMsg,
+			msg:   `{"action":"send_private_msg","params":{"user_id":1,"message":[{"type":"image","data":{"file":"` + img + `"}}]}}`,
+			want:  map[string]any{"params.message.0.data.file": "{b}/files/1"},
+		},
+		{
+			name: "set_group_portrait",
+			msg:  `{"action":"set_group_portrait","params":{"group_id":1,"file":"` + img + `"}}`,
+			want: map[string]any{"params.file": "{b}/files/1", "params.group_id": float64(1)},
+		},
+		{
+			name:  "set_qq_avatar 优先返回 URL",
+			local: true,
+			msg:   `{"action":"set_qq_avatar","params":{"file":"` + img + `"}}`,
+			want:  map[string]any{"params.file": "{b}/files/1"},
+		},
+		{
+			name: "send_group_notice 的 image",
+			msg:  `{"action":"send_group_notice","params":{"group_id":1,"content":"公告","image":"` + img + `"}}`,
+			want: map[string]any{"params.image": "{b}/files/1", "params.content": "公告"},
+		},
+		{
+			name: "send_group_notice 无 image",
+			msg:  `{"action":"send_group_notice","params":{"group_id":1,"content":"公告"}}`,
+			want: map[string]any{"params.image": nil, "params.content": "公告"},
+		},
+		{
+			name:  "local_path 策略使用 b 的本地路径",
+			local: true,
+			extra: portraitLocal,
+			msg:   `{"action":"set_group_portrait","params":{"group_id":1,"file":"` + img + `"}}`,
+			want:  map[string]any{"params.file": "/data/files/1.png"},
+		},
+		{
+			name:  "local_path 策略无本地路径时退回 URL",
+			extra: portraitLocal,
+			msg:   `{"action":"set_group_portrait","params":{"group_id":1,"file":"` + img + `"}}`,
+			want:  map[string]any{"params.file": "{b}/files/1"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := plain
+			if tc.local {
+				b = local
+			}
+			got := rewriteWith(t, b, tc.extra, tc.msg)
+			for path, want := range tc.want {
+				if s, ok := want.(string); ok {
+					want = strings.ReplaceAll(s, "{b}", b.URL)
+				}
+				if v := fieldAt(got, path); !reflect.DeepEqual(v, want) {
+					t.Errorf("%s = %#v，期望 %#v", path, v, want)
+				}
+			}
+		})
+	}
+}
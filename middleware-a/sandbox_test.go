@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sandboxFixture 创建以下结构，返回临时目录：
+//
+//	root/sub/a.txt
+//	root/link.txt -> outside/secret.txt
+//	root/dirlink  -> outside
+//	rootx/b.txt           与 root 前缀相同的兄弟目录
+//	outside/secret.txt
+func sandboxFixture(t *testing.T) string {
+	t.Helper()
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"root/sub/a.txt", "rootx/b.txt", "outside/secret.txt"} {
+		p = filepath.Join(dir, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(p), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(dir, "outside", "secret.txt"), filepath.Join(dir, "root", "link.txt")); err != nil {
+		t.Skip("不支持符号链接:", err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "outside"), filepath.Join(dir, "root", "dirlink")); err != nil {
+		t.Skip("不支持符号链接:", err)
+	}
+	return dir
+}
+
+func TestFileSandboxResolve(t *testing.T) {
+	dir := sandboxFixture(t)
+	sb, err := newFileSandbox([]string{filepath.Join(dir, "root"), " "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := func(rel string) string { return filepath.Join(dir, filepath.FromSlash(rel)) }
+	tests := []struct {
+		name   string
+		path   string
+		want   string // 允许时的真实路径
+		denied bool
+	}{
+		{"目录内的文件", p("root/sub/a.txt"), p("root/sub/a.txt"), false},
+		{"允许目录本身", p("root"), p("root"), false},
+		{"目录内的 .. 仍在目录内", p("root/sub/../sub/a.txt"), p("root/sub/a.txt"), false},
+		{"目录外的文件", p("outside/secret.txt"), "", true},
+		{".. 跳出允许目录", p("root/sub/../../outside/secret.txt"), "", true},
+		{"指向目录外的文件链接", p("root/link.txt"), "", true},
+		{"指向目录外的目录链接", p("root/dirlink/secret.txt"), "", true},
+		{"前缀相同的兄弟目录", p("rootx/b.txt"), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sb.resolve(tt.path)
+			if tt.denied {
+				if !errors.Is(err, errPathDenied) {
+					t.Fatalf("resolve(%s) = %q, %v，期望 errPathDenied", tt.path, got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("resolve(%s) = %q, %v，期望 %q", tt.path, got, err, tt.want)
+			}
+		})
+	}
+
+	// 不存在的文件返回普通错误，不视为越权
+	if _, err := sb.resolve(p("root/missing.txt")); err == nil || errors.Is(err, errPathDenied) {
+		t.Errorf("不存在的文件: err = %v", err)
+	}
+	// 未配置 allowed_file_roots 时不作限制
+	var none *fileSandbox
+	if got, err := none.resolve(p("outside/secret.txt")); err != nil || got != p("outside/secret.txt") {
+		t.Errorf("nil sandbox: %q, %v", got, err)
+	}
+}
+
+func TestNewFileSandbox(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		roots   []string
+		nilSB   bool
+		wantErr bool
+	}{
+		{"未配置", nil, true, false},
+		{"只有空路径", []string{"", "  "}, false, true},
+		{"目录不存在", []string{filepath.Join(dir, "missing")}, false, true},
+		{"正常", []string{dir}, false, false},
+	}
+	for _, tt := range tests {
+		sb, err := newFileSandbox(tt.roots)
+		if (err != nil) != tt.wantErr || (sb == nil) != (tt.nilSB || tt.wantErr) {
+			t.Errorf("%s: newFileSandbox = %v, %v", tt.name, sb, err)
+		}
+	}
+}
+
+func TestWithinDir(t *testing.T) {
+	sep := string(filepath.Separator)
+	root := filepath.Join(sep+"data", "sealdice")
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{root, true},
+		{filepath.Join(root, "a.png"), true},
+		{filepath.Join(root, "deck", "b.png"), true},
+		{filepath.Join(root, "..a"), true}, // 以 .. 开头的文件名
+		{filepath.Join(sep+"data", "sealdice2", "a.png"), false},
+		{sep + "data", false},
+		{filepath.Join(sep+"etc", "shadow"), false},
+	}
+	for _, tt := range tests {
+		if got := withinDir(root, tt.path); got != tt.want {
+			t.Errorf("withinDir(%q, %q) = %v，期望 %v", root, tt.path, got, tt.want)
+		}
+	}
+}
+
+// loadSource 对 file:// 与本地路径执行同样的检查，base64:// 不受限制
+func TestLoadSourceSandbox(t *testing.T) {
+	dir := sandboxFixture(t)
+	sb, err := newFileSandbox([]string{filepath.Join(dir, "root")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		src    string
+		denied bool
+	}{
+		{"本地路径", filepath.Join(dir, "root", "sub", "a.txt"), false},
+		{"file:// 目录内", "file://" + filepath.ToSlash(filepath.Join(dir, "root", "sub", "a.txt")), false},
+		{"file:// 目录外", "file://" + filepath.ToSlash(filepath.Join(dir, "outside", "secret.txt")), true},
+		{"本地路径经链接跳出", filepath.Join(dir, "root", "link.txt"), true},
+		{"base64", "base64://aGVsbG8=", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _, err := loadSource(tt.src, "", sb)
+			if tt.denied != errors.Is(err, errPathDenied) {
+				t.Fatalf("loadSource(%s): err = %v", tt.src, err)
+			}
+			if !tt.denied && (err != nil || len(data) == 0) {
+				t.Fatalf("loadSource(%s) = %d 字节, %v", tt.src, len(data), err)
+			}
+		})
+	}
+}
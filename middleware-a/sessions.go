@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// session 为一对海豹-协议端 WebSocket 连接，登记在 sessions 中供管理接口查询与操作。
+type session struct {
+	id      string
+	route   string
+	remote  string
+	started time.Time
+	cfg     *Config // 建立连接时的路由配置，重连时经 liveRoute 取最新值
+
+	// ctx 在会话结束（任一方向的转发退出或经 close 关闭）时由 cancel 取消，进行中的上传随之中止
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	client   *websocket.Conn
+	clientMu sync.Mutex // 串行化向海豹的写入
+
+	mu          sync.Mutex
+	upstream    *websocket.Conn
+	upstreamURL string // 不含 access_token 查询参数
+	selfID      string
+	reconnects  int
+
+	audit auditPending
+
+	closed         atomic.Bool
+	toUpstream     atomic.Int64
+	toClient       atomic.Int64
+	pendingUploads atomic.Int64
+}
+
+// sessionInfo 为管理接口返回的会话快照
+type sessionInfo struct {
+	ID             string    `json:"id"`
+	Route          string    `json:"route"`
+	Remote         string    `json:"remote"`
+	SelfID         string    `json:"self_id,omitempty"`
+	UpstreamURL    string    `json:"upstream_url"`
+	StartedAt      time.Time `json:"started_at"`
+	ToUpstream     int64     `json:"messages_to_upstream"`
+	ToClient       int64     `json:"messages_to_client"`
+	PendingUploads int64     `json:"pending_uploads"`
+	Reconnects     int       `json:"reconnects"`
+}
+
+var sessions sync.Map // id -> *session
+
+func newSessionID() string { return randomHex(8) }
+
+func registerSession(s *session) { sessions.Store(s.id, s) }
+
+func unregisterSession(s *session) { sessions.Delete(s.id) }
+
+func lookupSession(id string) *session {
+	v, ok := sessions.Load(id)
+	if !ok {
+		return nil
+	}
+	return v.(*session)
+}
+
+func listSessions() []sessionInfo {
+	out := []sessionInfo{}
+	sessions.Range(func(_, v any) bool {
+		out = append(out, v.(*session).info())
+		return true
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAt.Before(out[j].StartedAt) })
+	return out
+}
+
+func (s *session) info() sessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sessionInfo{
+		ID:             s.id,
+		Route:          s.route,
+		Remote:         s.remote,
+		SelfID:         s.selfID,
+		UpstreamURL:    s.upstreamURL,
+		StartedAt:      s.started,
+		ToUpstream:     s.toUpstream.Load(),
+		ToClient:       s.toClient.Load(),
+		PendingUploads: s.pendingUploads.Load(),
+		Reconnects:     s.reconnects,
+	}
+}
+
+// writeClient 向海豹写入一条消息，可由多个协程调用
+func (s *session) writeClient(mt int, msg []byte) error {
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+	return s.client.WriteMessage(mt, msg)
+}
+
+func (s *session) upstreamConn() *websocket.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.upstream
+}
+
+// observeEvent 从上游事件中记录机器人账号，只解析首个携带 self_id 的事件。
+func (s *session) observeEvent(msg []byte) {
+	s.mu.Lock()
+	known := s.selfID != ""
+	s.mu.Unlock()
+	if known || !bytes.Contains(msg, []byte(`"self_id"`)) {
+		return
+	}
+	var ev struct {
+		SelfID json.Number `json:"self_id"`
+	}
+	if json.Unmarshal(msg, &ev) != nil || ev.SelfID == "" {
+		return
+	}
+	s.mu.Lock()
+	s.selfID = ev.SelfID.String()
+	s.mu.Unlock()
+}
+
+// reconnectUpstream 按路由最新配置建立新的上游连接再替换旧连接，转发协程随后切换到新连接。
+func (s *session) reconnectUpstream() error {
+	rc := liveRoute(s.cfg)
+	conn, _, err := dialUpstream(rc.upstreamDialer(upstreamHandshakeTimeout), rc)
+	if err != nil {
+		return err
+	}
+	rc.wsLimits().upstream().setup(conn)
+	s.mu.Lock()
+	old := s.upstream
+	s.upstream = conn
+	s.upstreamURL = rc.UpstreamWSURL
+	s.reconnects++
+	s.mu.Unlock()
+	if old != nil {
+		_ = old.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), timeNowPlus())
+		old.Close()
+	}
+	return nil
+}
+
+// close 强制关闭两端连接，转发协程随之退出。
+func (s *session) close(reason string) {
+	if !s.closed.CompareAndSwap(false, true) {
+		return
+	}
+	s.cancel()
+	_ = s.client.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason), timeNowPlus())
+	s.client.Close()
+	if up := s.upstreamConn(); up != nil {
+		_ = up.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason), timeNowPlus())
+		up.Close()
+	}
+}
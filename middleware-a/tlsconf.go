@@ -0,0 +1,142 @@
+// 共享文件：与其他模块中的同名文件保持一致，以 middleware-a 中的为准。
+// 修改后运行 scripts/shared-files.sh sync 同步，CI 中由 scripts/shared-files.sh check 检查。
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ServerTLSConfig 为监听端口的 TLS 配置，cert_file 为空时使用明文 HTTP。
+// 证书与私钥文件变更后在下一次握手时自动重新加载，无需重启。
+type ServerTLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ClientCAFile 校验客户端证书的 CA，设置后启用双向 TLS
+	ClientCAFile string `json:"client_ca_file"`
+	// ClientAuth 为 require（默认，必须提供证书）或 optional（提供时才校验）
+	ClientAuth string `json:"client_auth"`
+}
+
+// certReloader 在证书或私钥文件修改时间变化后重新加载，加载失败时继续使用旧证书。
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("cert_file 与 key_file 需同时设置")
+	}
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) load() error {
+	cst, err := os.Stat(cr.certFile)
+	if err != nil {
+		return err
+	}
+	kst, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.cert = &cert
+	cr.certMod, cr.keyMod = cst.ModTime(), kst.ModTime()
+	return nil
+}
+
+// get 返回当前证书；距上次检查超过 1 秒时比较文件修改时间，变化则重新加载。
+func (cr *certReloader) get() (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if time.Since(cr.checked) < time.Second {
+		return cr.cert, nil
+	}
+	cr.checked = time.Now()
+	cst, err1 := os.Stat(cr.certFile)
+	kst, err2 := os.Stat(cr.keyFile)
+	if err1 != nil || err2 != nil || (cst.ModTime().Equal(cr.certMod) && kst.ModTime().Equal(cr.keyMod)) {
+		return cr.cert, nil
+	}
+	if err := cr.load(); err != nil {
+		loggerA.Error("重新加载证书失败，继续使用旧证书", "err", err, "cert", cr.certFile)
+		return cr.cert, nil
+	}
+	loggerA.Info("已重新加载证书", "cert", cr.certFile)
+	return cr.cert, nil
+}
+
+func loadCertPool(file string, system bool) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if system {
+		if sys, err := x509.SystemCertPool(); err == nil {
+			pool = sys
+		}
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s 中没有可用的 PEM 证书", file)
+	}
+	return pool, nil
+}
+
+// build 生成监听使用的 *tls.Config，未配置证书时返回 nil。
+func (tc ServerTLSConfig) build() (*tls.Config, error) {
+	if tc.CertFile == "" && tc.KeyFile == "" {
+		return nil, nil
+	}
+	cr, err := newCertReloader(tc.CertFile, tc.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return cr.get() },
+	}
+	if tc.ClientCAFile != "" {
+		if cfg.ClientCAs, err = loadCertPool(tc.ClientCAFile, false); err != nil {
+			return nil, fmt.Errorf("tls.client_ca_file: %w", err)
+		}
+		switch tc.ClientAuth {
+		case "", "require":
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		case "optional":
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, fmt.Errorf("tls.client_auth 仅支持 require、optional，实际为 %q", tc.ClientAuth)
+		}
+	}
+	return cfg, nil
+}
+
+// listenAndServe 按 tlsCfg 以 HTTPS 或 HTTP 提供服务。
+func listenAndServe(addr string, h http.Handler, tlsCfg *tls.Config) error {
+	srv := &http.Server{Addr: addr, Handler: h, TLSConfig: tlsCfg}
+	if tlsCfg != nil {
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
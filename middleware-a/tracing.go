@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingConfig 为 OpenTelemetry 链路追踪配置，endpoint 为空时不导出。
+type TracingConfig struct {
+	// Endpoint OTLP/HTTP 接收地址，如 localhost:4318
+	Endpoint string `json:"endpoint"`
+	// URLPath 默认 /v1/traces
+	URLPath  string            `json:"url_path"`
+	Insecure bool              `json:"insecure"`
+	Headers  map[string]string `json:"headers"`
+	// ServiceName 默认 middleware-a
+	ServiceName string `json:"service_name"`
+	// SampleRatio 采样比例 0~1，默认 1
+	SampleRatio float64 `json:"sample_ratio"`
+}
+
+var tracer = otel.Tracer("middleware-a")
+
+// initTracing 按配置创建 OTLP 导出器并注册全局 TracerProvider 与 W3C trace context 传播器。
+// 返回的函数在退出前调用以刷新未导出的 span。
+func initTracing(tc TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if tc.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(tc.Endpoint)}
+	if tc.URLPath != "" {
+		opts = append(opts, otlptracehttp.WithURLPath(tc.URLPath))
+	}
+	if tc.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if len(tc.Headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(tc.Headers))
+	}
+	exp, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("otlp exporter: %w", err)
+	}
+	tp := newTracerProvider(tc, sdktrace.WithBatcher(exp))
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// newTracerProvider 创建 TracerProvider；span 处理器由调用方提供，
+// 测试时可传入 sdktrace.WithSyncer(tracetest.NewInMemoryExporter()) 在进程内收集 span。
+func newTracerProvider(tc TracingConfig, processor sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	name := tc.ServiceName
+	if name == "" {
+		name = "middleware-a"
+	}
+	ratio := tc.SampleRatio
+	if ratio <= 0 || ratio > 1 {
+		ratio = 1
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", name)))
+	if err != nil {
+		res = resource.NewSchemaless(attribute.String("service.name", name))
+	}
+	return sdktrace.NewTracerProvider(
+		processor,
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+}
+
+// startActionSpan 为海豹发出的一条 OneBot 动作分配请求 ID 并创建 span，记录 action 与 echo；
+// 非动作消息返回 nil span。
+func startActionSpan(ctx context.Context, msg []byte, route string, sess *session) (context.Context, trace.Span) {
+	var cmd struct {
+		Action string      `json:"action"`
+		Echo   interface{} `json:"echo"`
+	}
+	if json.Unmarshal(msg, &cmd) != nil || cmd.Action == "" {
+		return ctx, nil
+	}
+	rid := newRequestID()
+	ctx = withRequestID(ctx, rid)
+	loggerA.Debug("ws action", "rid", rid, "action", cmd.Action, "echo", cmd.Echo, "route", route, "session", sess.id)
+	attrs := []attribute.KeyValue{
+		attribute.String("request.id", rid),
+		attribute.String("onebot.action", cmd.Action),
+		attribute.String("middleware.route", route),
+		attribute.String("middleware.session", sess.id),
+	}
+	if cmd.Echo != nil {
+		attrs = append(attrs, attribute.String("onebot.echo", fmt.Sprint(cmd.Echo)))
+	}
+	return tracer.Start(ctx, "ws.action "+cmd.Action, trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(attrs...))
+}
+
+// endSpan 结束 span，err 非空时标记为失败。
+func endSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// shutdownTracing 在限定时间内刷新并关闭导出器
+func shutdownTracing(shutdown func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		loggerA.Warn("关闭链路追踪失败", "err", err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 经 a 转发的一条带图片的消息：动作 span 下应有 upload_via_b 子 span，
+// trace context 随上传请求传给 b。
+func TestUploadSpans(t *testing.T) {
+	type upload struct {
+		traceparent string
+		name        string
+		size        int
+	}
+	uploads := make(chan upload, 1)
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(f)
+		uploads <- upload{r.Header.Get("traceparent"), r.FormValue("name"), len(data)}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"url":"http://%s/files/t/1.png","name":%q}`, r.Host, r.FormValue("name"))
+	}))
+	defer b.Close()
+	up := newTestUpstream(t)
+	cfg := loadTestConfig(t, map[string]any{
+		"listen_ws_path":  "/ws",
+		"upstream_ws_url": up.wsURL(),
+		"upload_endpoint": b.URL + "/upload",
+	})
+	conn := dialTestA(t, cfg.routes[0])
+
+	img := []byte("\x89PNG\r\n\x1a\n-test-image")
+	msg := fmt.Sprintf(`{"action":"send_group_msg","params":{"group_id":1,"message":[{"type":"image","data":{"file":"base64://%s"}}]},"echo":"trace-1"}`,
+		base64.StdEncoding.EncodeToString(img))
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	got := up.next(t, "send_group_msg")
+	if !strings.Contains(string(got), b.URL+"/files/t/1.png") {
+		t.Fatalf("协议端收到的消息未改写为 b 的地址: %s", got)
+	}
+	var recv upload
+	select {
+	case recv = <-uploads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("b 未收到上传")
+	}
+
+	action := waitSpan(t, "ws.action send_group_msg")
+	upSpan := waitSpan(t, "upload_via_b")
+	if action.SpanKind() != trace.SpanKindProducer || upSpan.SpanKind() != trace.SpanKindClient {
+		t.Errorf("span kind = %v / %v", action.SpanKind(), upSpan.SpanKind())
+	}
+	if upSpan.Parent().SpanID() != action.SpanContext().SpanID() || upSpan.SpanContext().TraceID() != action.SpanContext().TraceID() {
+		t.Errorf("upload_via_b 不是动作 span 的子 span")
+	}
+	if upSpan.Status().Code == codes.Error {
+		t.Errorf("upload_via_b 标记为失败: %s", upSpan.Status().Description)
+	}
+	wantAttrs(t, action, map[attribute.Key]any{
+		"onebot.action":    "send_group_msg",
+		"onebot.echo":      "trace-1",
+		"middleware.route": "default",
+	})
+	if rid, ok := spanAttr(action, "request.id"); !ok || rid.AsString() == "" {
+		t.Errorf("动作 span 缺少 request.id")
+	}
+	wantAttrs(t, upSpan, map[attribute.Key]any{
+		"onebot.action":             "send_group_msg",
+		"upload.name":               recv.name,
+		"upload.bytes":              int64(len(img)),
+		"upload.endpoint":           b.URL + "/upload",
+		"http.response.status_code": int64(http.StatusOK),
+	})
+	if recv.size != len(img) {
+		t.Errorf("b 收到 %d 字节，期望 %d", recv.size, len(img))
+	}
+	want := fmt.Sprintf("00-%s-%s-01", upSpan.SpanContext().TraceID(), upSpan.SpanContext().SpanID())
+	if recv.traceparent != want {
+		t.Errorf("traceparent = %q，期望 %q", recv.traceparent, want)
+	}
+}
+
+// waitSpan 等待名为 name 的 span 结束（动作 span 在写入协议端后才结束）
+func waitSpan(t *testing.T, name string) sdktrace.ReadOnlySpan {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		spans := spanRecorder.Ended()
+		for i := len(spans) - 1; i >= 0; i-- {
+			if spans[i].Name() == name {
+				return spans[i]
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("未收到 span %s", name)
+	return nil
+}
+
+func spanAttr(s sdktrace.ReadOnlySpan, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range s.Attributes() {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func wantAttrs(t *testing.T, s sdktrace.ReadOnlySpan, want map[attribute.Key]any) {
+	t.Helper()
+	for k, v := range want {
+		got, ok := spanAttr(s, k)
+		if !ok {
+			t.Errorf("%s 缺少属性 %s", s.Name(), k)
+			continue
+		}
+		if g, _ := json.Marshal(got.AsInterface()); string(g) != mustJSON(v) {
+			t.Errorf("%s 的 %s = %s，期望 %s", s.Name(), k, g, mustJSON(v))
+		}
+	}
+}
+
+func mustJSON(v any) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 向 b 上传：独立的 HTTP 客户端（连接与总超时），对 b 暂时不可用（连接失败、502/503/504、429）
+// 按退避重试，连续失败后熔断一段时间，期间按 upload_fallback 直接回退。
+const (
+	defaultUploadConnectTimeout  = 5
+	defaultUploadTimeout         = 60
+	defaultUploadMessageTimeout  = 120
+	defaultUploadMaxRetries      = 2
+	defaultUploadRetryMaxWait    = 10
+	defaultUploadBreakerFailures = 5
+	defaultUploadBreakerCooldown = 30
+	uploadRetryBaseDelay         = 500 * time.Millisecond
+)
+
+// upload_fallback 的取值：b 不可用时保持原样，或将文件以 base64:// 内联发给协议端
+const (
+	uploadFallbackPassthrough = "passthrough"
+	uploadFallbackBase64      = "base64"
+)
+
+var (
+	errUploadCircuitOpen = errors.New("upload endpoint circuit open")
+	errNoUploadEndpoint  = errors.New("no upload endpoint configured")
+)
+
+// newUploadClient 返回向 b 上传使用的 HTTP 客户端，携带 upload_tls 配置。
+// timeout 为单次请求（含上传请求体与读取响应）的总超时。
+func newUploadClient(tlsCfg *tls.Config, connectTimeout, timeout time.Duration) *http.Client {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = (&net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	tr.TLSHandshakeTimeout = connectTimeout
+	tr.TLSClientConfig = tlsCfg
+	return &http.Client{Transport: tr, Timeout: timeout}
+}
+
+// retryableUploadError 判断请求错误是否可以向同一端点重试：连接阶段的失败（拒绝连接、连接超时、TLS 握手失败等）
+// 可以重试；总超时后该端点可能仍在处理，不再重试，但可以切换到其他端点。
+func retryableUploadError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var op *net.OpError
+	if errors.As(err, &op) && op.Op == "dial" {
+		return true
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return false
+	}
+	return true
+}
+
+// retryableUploadStatus 判断 b 的响应码是否表示暂时不可用（5xx 或 429）；其余 4xx 为 b 拒绝了该文件
+func retryableUploadStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// parseRetryAfter 解析秒数或 HTTP 日期形式的 Retry-After
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(max(secs, 0)) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(t.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// uploadRetryDelay 返回第 attempt 次（从 0 开始）重试前的等待时长
+func uploadRetryDelay(attempt int, retryAfter time.Duration) time.Duration {
+	d := uploadRetryBaseDelay << min(attempt, 6)
+	// ±20% 抖动，避免多个连接同时重试
+	d += time.Duration((rand.Float64()*0.4 - 0.2) * float64(d))
+	return max(d, retryAfter)
+}
+
+// uploadContext 返回一条动作改写时使用的 ctx：parent 为会话的 ctx，会话结束时进行中的上传随之取消；
+// 另按 upload_message_timeout 限制该动作全部上传的总时长，避免多个媒体依次上传阻塞转发过久。
+func (cfg *Config) uploadContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if cfg.UploadMessageTimeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, time.Duration(cfg.UploadMessageTimeout)*time.Second)
+}
+
+// sleepCtx 等待 d，ctx 取消时提前返回 false
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// uploadBreaker 为单个上传端点的熔断器：连续失败 threshold 次后打开，cooldown 内不再请求；
+// 冷却结束后放行一个探测请求并重新计时，探测成功则关闭，失败则保持打开。
+type uploadBreaker struct {
+	endpoint string
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = map[string]*uploadBreaker{}
+)
+
+// breakerFor 返回 endpoint 的熔断器，各路由共用
+func breakerFor(endpoint string) *uploadBreaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b := breakers[endpoint]
+	if b == nil {
+		b = &uploadBreaker{endpoint: endpoint}
+		breakers[endpoint] = b
+	}
+	return b
+}
+
+// allow 判断当前是否可以请求；threshold 不大于 0 时不熔断
+func (b *uploadBreaker) allow(threshold int, cooldown time.Duration, now time.Time) bool {
+	if threshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < threshold {
+		return true
+	}
+	if now.Before(b.openUntil) {
+		return false
+	}
+	// 探测请求：其余请求继续等待，探测没有结果（如连接被关闭）时冷却后再次探测
+	b.openUntil = now.Add(cooldown)
+	return true
+}
+
+// isOpen 判断熔断器当前是否处于打开状态（冷却中）
+func (b *uploadBreaker) isOpen(threshold int, now time.Time) bool {
+	if threshold <= 0 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= threshold && now.Before(b.openUntil)
+}
+
+func (b *uploadBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.openUntil.IsZero() {
+		loggerA.Info("上传端点已恢复，关闭熔断", "endpoint", b.endpoint)
+		metricUploadBreakerOpen.WithLabelValues(b.endpoint).Set(0)
+	}
+	b.failures, b.openUntil = 0, time.Time{}
+}
+
+func (b *uploadBreaker) failure(threshold int, cooldown time.Duration, now time.Time) {
+	if threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures >= threshold {
+		if b.failures == threshold {
+			loggerA.Warn("上传端点连续失败，熔断", "endpoint", b.endpoint, "failures", b.failures, "cooldown", cooldown.String())
+		}
+		b.openUntil = now.Add(cooldown)
+		metricUploadBreakerOpen.WithLabelValues(b.endpoint).Set(1)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"", 0, false},
+		{"  ", 0, false},
+		{"0", 0, true},
+		{"5", 5 * time.Second, true},
+		{" 120 ", 2 * time.Minute, true},
+		{"-3", 0, true},
+		{"1.5", 0, false},
+		{"soon", 0, false},
+		{now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+		{"Sunday, 01-Mar-26 12:00:10 GMT", 10 * time.Second, true}, // RFC 850
+		{"Sun Mar  1 12:00:20 2026", 20 * time.Second, true},       // ANSI C
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.in, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseRetryAfter(%q) = %v, %v，期望 %v, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestUploadRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempt    int
+		retryAfter time.Duration
+		min, max   time.Duration
+	}{
+		{0, 0, 400 * time.Millisecond, 600 * time.Millisecond},
+		{1, 0, 800 * time.Millisecond, 1200 * time.Millisecond},
+		{3, 0, 3200 * time.Millisecond, 4800 * time.Millisecond},
+		{6, 0, 25600 * time.Millisecond, 38400 * time.Millisecond},
+		{20, 0, 25600 * time.Millisecond, 38400 * time.Millisecond}, // 上限为 2^6 倍
+		{0, 5 * time.Second, 5 * time.Second, 5 * time.Second},      // 至少等待 Retry-After
+		{2, time.Second, 1600 * time.Millisecond, 2400 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 50; i++ {
+			if d := uploadRetryDelay(tt.attempt, tt.retryAfter); d < tt.min || d > tt.max {
+				t.Fatalf("uploadRetryDelay(%d, %v) = %v，超出 [%v, %v]", tt.attempt, tt.retryAfter, d, tt.min, tt.max)
+			}
+		}
+	}
+}
+
+func TestRetryableUpload(t *testing.T) {
+	for code, want := range map[int]bool{
+		200: false, 400: false, 401: false, 413: false, 415: false, 422: false,
+		429: true, 500: true, 502: true, 503: true, 504: true,
+	} {
+		if got := retryableUploadStatus(code); got != want {
+			t.Errorf("retryableUploadStatus(%d) = %v，期望 %v", code, got, want)
+		}
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{"连接失败", context.Background(), dial, true},
+		{"连接超时", context.Background(), &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, true},
+		{"总超时", context.Background(), timeoutError{}, false},
+		{"上传已取消", canceled, dial, false},
+		{"连接被重置", context.Background(), &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}, true},
+	}
+	for _, tt := range tests {
+		if got := retryableUploadError(tt.ctx, tt.err); got != tt.want {
+			t.Errorf("%s: retryableUploadError = %v，期望 %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "Client.Timeout exceeded" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestUploadBreaker(t *testing.T) {
+	const threshold, cooldown = 3, 10 * time.Second
+	base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	type step struct {
+		at     time.Duration
+		op     string // allow / fail / ok
+		want   bool   // allow 的结果
+		isOpen bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"未达到阈值", []step{
+			{0, "fail", false, false}, {0, "fail", false, false}, {0, "allow", true, false},
+		}},
+		{"成功后重新计数", []step{
+			{0, "fail", false, false}, {0, "fail", false, false}, {0, "ok", false, false},
+			{0, "fail", false, false}, {0, "fail", false, false}, {0, "allow", true, false},
+		}},
+		{"连续失败后打开", []step{
+			{0, "fail", false, false}, {0, "fail", false, false}, {0, "fail", false, true},
+			{0, "allow", false, true}, {9 * time.Second, "allow", false, true},
+		}},
+		{"半开探测成功后关闭", []step{
+			{0, "fail", false, false}, {0, "fail", false, false}, {0, "fail", false, true},
+			{10 * time.Second, "allow", true, true}, // 探测请求，其余请求继续等待
+			{10 * time.Second, "allow", false, true},
+			{11 * time.Second, "ok", false, false},
+			{11 * time.Second, "allow", true, false},
+		}},
+		{"半开探测失败后继续熔断", []step{
+			{0, "fail", false, false}, {0, "fail", false, false}, {0, "fail", false, true},
+			{10 * time.Second, "allow", true, true},
+			{11 * time.Second, "fail", false, true},
+			{20 * time.Second, "allow", false, true},
+			{21 * time.Second, "allow", true, true},
+		}},
+		{"探测没有结果时冷却后再次探测", []step{
+			{0, "fail", false, false}, {0, "fail", false, false}, {0, "fail", false, true},
+			{10 * time.Second, "allow", true, true},
+			{15 * time.Second, "allow", false, true},
+			{20 * time.Second, "allow", true, true},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &uploadBreaker{endpoint: "http://breaker.test/" + tt.name}
+			for i, s := range tt.steps {
+				now := base.Add(s.at)
+				switch s.op {
+				case "allow":
+					if got := b.allow(threshold, cooldown, now); got != s.want {
+						t.Fatalf("第 %d 步 allow = %v，期望 %v", i+1, got, s.want)
+					}
+				case "fail":
+					b.failure(threshold, cooldown, now)
+				case "ok":
+					b.success()
+				}
+				if got := b.isOpen(threshold, now); got != s.isOpen {
+					t.Fatalf("第 %d 步 isOpen = %v，期望 %v", i+1, got, s.isOpen)
+				}
+			}
+		})
+	}
+
+	// threshold 不大于 0 时不熔断
+	b := &uploadBreaker{endpoint: "http://breaker.test/disabled"}
+	for i := 0; i < 10; i++ {
+		b.failure(0, cooldown, base)
+	}
+	if !b.allow(0, cooldown, base) || b.isOpen(0, base) {
+		t.Error("threshold 为 0 时仍然熔断")
+	}
+}
+
+// newHangingB 模拟卡住的 b：请求一直挂起，直到 a 取消请求；每个请求到达时向 started 发送一次
+func newHangingB(t *testing.T) (b *httptest.Server, started, canceled chan struct{}) {
+	t.Helper()
+	started, canceled = make(chan struct{}, 8), make(chan struct{}, 8)
+	b = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 读完请求体后服务端才能察觉 a 断开连接
+		io.Copy(io.Discard, r.Body)
+		started <- struct{}{}
+		select {
+		case <-r.Context().Done():
+			canceled <- struct{}{}
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	t.Cleanup(b.Close)
+	return b, started, canceled
+}
+
+// upload_message_timeout 限制一条动作内全部上传的总时长，即使单次请求的 upload_timeout 更长
+func TestUploadMessageTimeout(t *testing.T) {
+	b, _, _ := newHangingB(t)
+	cfg := loadTestConfig(t, map[string]any{
+		"upstream_ws_url":        "ws://127.0.0.1:1",
+		"upload_endpoint":        b.URL + "/upload",
+		"upload_timeout":         30,
+		"upload_message_timeout": 1,
+	})
+	rc := cfg.routes[0]
+	msg := []byte(`{"action":"send_group_msg","params":{"group_id":1,"message":[{"type":"image","data":{"file":"base64://aGk="}},{"type":"image","data":{"file":"base64://aGk="}}]}}`)
+	ctx, cancel := rc.uploadContext(context.Background())
+	defer cancel()
+	start := time.Now()
+	out, err := rewriteIfUpload(ctx, msg, rc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("改写耗时 %v，未受 upload_message_timeout 限制", d)
+	}
+	if string(out) != string(msg) {
+		t.Fatalf("上传超时后应保持原样: %s", out)
+	}
+}
+
+// 经管理接口关闭会话时，阻塞在上传中的转发协程随之取消上传
+func TestSessionCloseCancelsUpload(t *testing.T) {
+	b, started, canceled := newHangingB(t)
+	up := newTestUpstream(t)
+	cfg := loadTestConfig(t, map[string]any{
+		"listen_ws_path":         "/ws",
+		"upstream_ws_url":        up.wsURL(),
+		"upload_endpoint":        b.URL + "/upload",
+		"upload_message_timeout": -1,
+	})
+	rc := cfg.routes[0]
+	conn := dialTestA(t, rc)
+	msg := `{"action":"send_group_msg","params":{"group_id":1,"message":[{"type":"image","data":{"file":"base64://aGk="}}]}}`
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("b 未收到上传")
+	}
+	var sess *session
+	sessions.Range(func(_, v any) bool {
+		if s := v.(*session); s.cfg == rc {
+			sess = s
+		}
+		return sess == nil
+	})
+	if sess == nil {
+		t.Fatal("未找到会话")
+	}
+	sess.close("test")
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("关闭会话后上传未被取消")
+	}
+}
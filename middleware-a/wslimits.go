@@ -0,0 +1,181 @@
+// 共享文件：与其他模块中的同名文件保持一致，以 middleware-a 中的为准。
+// 修改后运行 scripts/shared-files.sh sync 同步，CI 中由 scripts/shared-files.sh check 检查。
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 海豹连接的来源校验与并发上限，以及两端连接的消息大小上限与空闲超时。
+
+const (
+	defaultWSReadLimitMB      = 4
+	defaultWSMediaReadLimitMB = 64
+	// 协议端的响应（如 get_file 返回的 base64）可能远大于海豹发来的动作，单独取较大的上限
+	defaultWSUpstreamReadLimitMB = 256
+	defaultWSPingInterval        = 30
+	defaultWSIdleTimeout         = 90
+)
+
+// errMessageTooLarge 表示消息超过 ws_read_limit_mb 且不含 base64:// 负载
+var errMessageTooLarge = errors.New("websocket: message exceeds ws_read_limit_mb")
+
+var base64Marker = []byte("base64://")
+
+// activePairs 为进程内当前的连接对数量（a 中为全部路由合计），用于 max_ws_pairs
+var activePairs atomic.Int64
+
+// originAllowed 校验升级请求的 Origin：未携带 Origin 的非浏览器客户端（如海豹）总是放行；
+// 配置了 allowed_origins 时须与其中一项一致（"*" 表示任意），否则只接受同源请求。
+func originAllowed(r *http.Request, allowed []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(allowed) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	origin = strings.TrimRight(origin, "/")
+	for _, o := range allowed {
+		if o = strings.TrimRight(strings.TrimSpace(o), "/"); o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// acquirePair 占用一个连接对名额，max 不大于 0 时不限制；成功后须调用 releasePair。
+func acquirePair(max int) bool {
+	if n := activePairs.Add(1); max > 0 && n > int64(max) {
+		activePairs.Add(-1)
+		return false
+	}
+	return true
+}
+
+func releasePair() { activePairs.Add(-1) }
+
+// wsLimits 为单个连接的消息大小上限与保活参数，取值为 0 表示不限制或不启用。
+type wsLimits struct {
+	readLimit         int64 // 普通消息
+	mediaReadLimit    int64 // 含 base64:// 的消息
+	upstreamReadLimit int64 // 协议端连接的消息，见 upstream
+	pingInterval      time.Duration
+	idleTimeout       time.Duration
+}
+
+func (cfg *Config) wsLimits() wsLimits {
+	mb := func(v int) int64 {
+		if v < 0 {
+			return 0
+		}
+		return int64(v) << 20
+	}
+	sec := func(v int) time.Duration {
+		if v < 0 {
+			return 0
+		}
+		return time.Duration(v) * time.Second
+	}
+	return wsLimits{
+		readLimit:         mb(cfg.WSReadLimitMB),
+		mediaReadLimit:    mb(cfg.WSMediaReadLimitMB),
+		upstreamReadLimit: mb(cfg.WSUpstreamReadLimitMB),
+		pingInterval:      sec(cfg.WSPingInterval),
+		idleTimeout:       sec(cfg.WSIdleTimeout),
+	}
+}
+
+// upstream 返回协议端连接使用的限制：ws_read_limit_mb 只针对海豹，
+// 协议端的消息统一按 ws_upstream_read_limit_mb 限制，不区分是否含 base64://。
+func (l wsLimits) upstream() wsLimits {
+	l.readLimit = l.upstreamReadLimit
+	l.mediaReadLimit = l.upstreamReadLimit
+	return l
+}
+
+// setup 设置连接的读取上限与空闲超时，并在启用时定期发送 ping；
+// 收到 ping 或 pong、开始读取下一条消息时都会延长超时。ping 协程在连接关闭后退出。
+func (l wsLimits) setup(conn *websocket.Conn) {
+	switch {
+	case l.readLimit > 0 && l.mediaReadLimit > l.readLimit:
+		conn.SetReadLimit(l.mediaReadLimit)
+	case l.readLimit > 0 && l.mediaReadLimit > 0:
+		conn.SetReadLimit(l.readLimit)
+	}
+	if l.idleTimeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(l.idleTimeout))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(l.idleTimeout))
+		})
+		conn.SetPingHandler(func(data string) error {
+			_ = conn.SetReadDeadline(time.Now().Add(l.idleTimeout))
+			err := conn.WriteControl(websocket.PongMessage, []byte(data), timeNowPlus())
+			if errors.Is(err, websocket.ErrCloseSent) {
+				return nil
+			}
+			return err
+		})
+	}
+	if l.pingInterval > 0 {
+		go func() {
+			t := time.NewTicker(l.pingInterval)
+			defer t.Stop()
+			for range t.C {
+				if err := conn.WriteControl(websocket.PingMessage, nil, timeNowPlus()); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// readMessage 读取一条消息：超过 readLimit 的消息只有在前 readLimit 字节内出现 base64:// 时才继续读取，
+// 上限为 mediaReadLimit（由连接的 SetReadLimit 保证）；否则向对端发送 1009 并返回 errMessageTooLarge。
+// 超过 SetReadLimit 时由 gorilla 发送 1009，同样返回 errMessageTooLarge。
+// 空闲超时从开始读取时计算，处理上一条消息（如同步上传）的耗时不计入。
+func (l wsLimits) readMessage(conn *websocket.Conn) (int, []byte, error) {
+	if l.idleTimeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(l.idleTimeout))
+	}
+	mt, r, err := conn.NextReader()
+	if err != nil {
+		return mt, nil, readLimitErr(err)
+	}
+	var buf bytes.Buffer
+	if l.readLimit <= 0 {
+		_, err = buf.ReadFrom(r)
+	} else {
+		var n int64
+		n, err = buf.ReadFrom(io.LimitReader(r, l.readLimit+1))
+		if err == nil && n > l.readLimit {
+			if (l.mediaReadLimit > 0 && l.mediaReadLimit <= l.readLimit) || !bytes.Contains(buf.Bytes(), base64Marker) {
+				_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseMessageTooBig, ""), timeNowPlus())
+				return mt, nil, errMessageTooLarge
+			}
+			_, err = buf.ReadFrom(r)
+		}
+	}
+	if err != nil {
+		return mt, nil, readLimitErr(err)
+	}
+	return mt, buf.Bytes(), nil
+}
+
+func readLimitErr(err error) error {
+	if errors.Is(err, websocket.ErrReadLimit) {
+		return errMessageTooLarge
+	}
+	return err
+}
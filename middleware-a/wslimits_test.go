@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	cases := []struct {
+		name    string
+		origin  string
+		allowed []string
+		want    bool
+	}{
+		{name: "无 Origin 总是放行", allowed: []string{"https://panel.example.com"}, want: true},
+		{name: "未配置时同源放行", origin: "http://a.example.com:8080", want: true},
+		{name: "未配置时跨域拒绝", origin: "http://evil.example.com"},
+		{name: "未配置时非法 Origin 拒绝", origin: "://bad"},
+		{name: "列表匹配忽略大小写与末尾斜杠", origin: "https://Panel.Example.com/", allowed: []string{" https://panel.example.com "}, want: true},
+		{name: "不在列表中", origin: "https://evil.example.com", allowed: []string{"https://panel.example.com"}},
+		{name: "配置列表后同源也须在列表中", origin: "http://a.example.com:8080", allowed: []string{"https://panel.example.com"}},
+		{name: "星号放行任意来源", origin: "https://evil.example.com", allowed: []string{"https://panel.example.com", "*"}, want: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://a.example.com:8080/ws", nil)
+			if tc.origin != "" {
+				r.Header.Set("Origin", tc.origin)
+			}
+			if got := originAllowed(r, tc.allowed); got != tc.want {
+				t.Errorf("originAllowed = %v，期望 %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// waitNoPairs 等待之前测试中的会话退出并释放连接对名额
+func waitNoPairs(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for activePairs.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("仍有 %d 个连接对未释放", activePairs.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAcquirePair(t *testing.T) {
+	waitNoPairs(t)
+	if !acquirePair(2) || !acquirePair(2) {
+		t.Fatal("未达上限时应成功")
+	}
+	if acquirePair(2) {
+		t.Fatal("达到上限后应失败")
+	}
+	if n := activePairs.Load(); n != 2 {
+		t.Fatalf("失败的占用不应计数，当前 %d", n)
+	}
+	releasePair()
+	if !acquirePair(2) {
+		t.Fatal("释放后应可再次占用")
+	}
+	if !acquirePair(0) {
+		t.Fatal("max 为 0 时不限制")
+	}
+	for i := 0; i < 3; i++ {
+		releasePair()
+	}
+	if n := activePairs.Load(); n != 0 {
+		t.Fatalf("全部释放后为 %d", n)
+	}
+}
+
+// wsPair 返回一对已连接的 WebSocket：server 为服务端一侧，client 为拨号一侧
+func wsPair(t *testing.T) (server, client *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conns <- c
+	}))
+	t.Cleanup(s.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server = <-conns
+	t.Cleanup(func() { server.Close() })
+	return server, client
+}
+
+func TestWSLimitsReadMessage(t *testing.T) {
+	const kb = 1 << 10
+	l := wsLimits{readLimit: kb, mediaReadLimit: 4 * kb, upstreamReadLimit: 16 * kb}
+	media := func(n int) []byte {
+		return append([]byte(`{"file":"base64://`), bytes.Repeat([]byte("A"), n)...)
+	}
+	cases := []struct {
+		name    string
+		limits  wsLimits
+		msg     []byte
+		wantErr bool
+	}{
+		{name: "未超过普通上限", limits: l, msg: bytes.Repeat([]byte("x"), kb)},
+		{name: "超过普通上限且无 base64", limits: l, msg: bytes.Repeat([]byte("x"), 2*kb), wantErr: true},
+		{name: "含 base64 时按媒体上限读取", limits: l, msg: media(3 * kb)},
+		{name: "超过媒体上限", limits: l, msg: media(8 * kb), wantErr: true},
+		{name: "媒体上限不大于普通上限时不放宽", limits: wsLimits{readLimit: kb, mediaReadLimit: kb}, msg: media(2 * kb), wantErr: true},
+		{name: "普通上限为 0 不限制", limits: wsLimits{mediaReadLimit: kb}, msg: bytes.Repeat([]byte("x"), 32*kb)},
+		{name: "协议端不受海豹上限限制", limits: l.upstream(), msg: bytes.Repeat([]byte("x"), 8*kb)},
+		{name: "协议端超过自身上限", limits: l.upstream(), msg: bytes.Repeat([]byte("x"), 20*kb), wantErr: true},
+		{name: "协议端上限为 0 不限制", limits: wsLimits{readLimit: kb, mediaReadLimit: 4 * kb}.upstream(), msg: bytes.Repeat([]byte("x"), 32*kb)},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, client := wsPair(t)
+			tc.limits.setup(server)
+			go client.WriteMessage(websocket.TextMessage, tc.msg)
+			_, got, err := tc.limits.readMessage(server)
+			if tc.wantErr {
+				if !errors.Is(err, errMessageTooLarge) {
+					t.Fatalf("err = %v，期望 errMessageTooLarge", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("读取失败: %v", err)
+			}
+			if !bytes.Equal(got, tc.msg) {
+				t.Fatalf("读到 %d 字节，期望 %d", len(got), len(tc.msg))
+			}
+		})
+	}
+}
+
+// serveTestA 为 rc 启动 a，返回海豹连接用的 ws:// 地址
+func serveTestA(t *testing.T, rc *Config) string {
+	t.Helper()
+	a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { serveWS(w, r, rc) }))
+	t.Cleanup(a.Close)
+	return "ws" + strings.TrimPrefix(a.URL, "http") + rc.ListenWSPath
+}
+
+// ws_read_limit_mb 只限制海豹的消息：协议端推送的大消息照常转发，海豹发出的同样大小的消息被 1009 拒绝。
+func TestServeWSReadLimits(t *testing.T) {
+	big := append([]byte(`{"post_type":"meta_event","data":"`), bytes.Repeat([]byte("x"), 2<<20)...)
+	big = append(big, `"}`...)
+	closed := make(chan error, 1)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if err := c.WriteMessage(websocket.TextMessage, big); err != nil {
+			return
+		}
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				closed <- err
+				return
+			}
+		}
+	}))
+	defer up.Close()
+	cfg := loadTestConfig(t, map[string]any{
+		"listen_ws_path":         "/ws",
+		"upstream_ws_url":        "ws" + strings.TrimPrefix(up.URL, "http"),
+		"ws_read_limit_mb":       1,
+		"ws_media_read_limit_mb": 1,
+	})
+	conn, _, err := websocket.DefaultDialer.Dial(serveTestA(t, cfg.routes[0]), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, got, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("未收到协议端的大消息: %v", err)
+	}
+	if len(got) != len(big) {
+		t.Fatalf("收到 %d 字节，期望 %d", len(got), len(big))
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, big); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("海豹的大消息应以 1009 关闭，得到 %v", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("协议端连接未随之关闭")
+	}
+}
+
+func TestServeWSOriginAndPairs(t *testing.T) {
+	up := newTestUpstream(t)
+	cfg := loadTestConfig(t, map[string]any{
+		"listen_ws_path":  "/ws",
+		"upstream_ws_url": up.wsURL(),
+		"allowed_origins": []string{"https://panel.example.com"},
+		"max_ws_pairs":    1,
+	})
+	u := serveTestA(t, cfg.routes[0])
+	waitNoPairs(t)
+	dial := func(origin string) (*websocket.Conn, int) {
+		h := http.Header{}
+		if origin != "" {
+			h.Set("Origin", origin)
+		}
+		c, resp, err := websocket.DefaultDialer.Dial(u, h)
+		if err != nil {
+			if resp == nil {
+				t.Fatalf("连接失败: %v", err)
+			}
+			return nil, resp.StatusCode
+		}
+		return c, http.StatusSwitchingProtocols
+	}
+
+	if _, code := dial("https://evil.example.com"); code != http.StatusForbidden {
+		t.Fatalf("不允许的来源返回 %d，期望 403", code)
+	}
+	first, code := dial("https://panel.example.com")
+	if code != http.StatusSwitchingProtocols {
+		t.Fatalf("允许的来源返回 %d", code)
+	}
+	if _, code := dial(""); code != http.StatusServiceUnavailable {
+		t.Fatalf("连接对已满时返回 %d，期望 503", code)
+	}
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, code := dial("")
+		if c != nil {
+			c.Close()
+			break
+		}
+		if code != http.StatusServiceUnavailable || time.Now().After(deadline) {
+			t.Fatalf("关闭连接后仍无法连接: %d", code)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/subtle"
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//go:embed dashboard
+var dashboardFS embed.FS
+
+// storedFile 为文件管理页展示的一项
+type storedFile struct {
+	ID          string     `json:"id"`
+	Path        string     `json:"path"`
+	URL         string     `json:"url"`
+	Name        string     `json:"name"`
+	Size        int64      `json:"size"`
+	ContentType string     `json:"content_type"`
+	Uploader    string     `json:"uploader,omitempty"`
+	Remote      string     `json:"remote,omitempty"`
+	UploadedAt  time.Time  `json:"uploaded_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Downloads   int64      `json:"downloads"`
+}
+
+type usageTotals struct {
+	Files  int              `json:"files"`
+	Bytes  int64            `json:"bytes"`
+	ByType map[string]int64 `json:"bytes_by_type"`
+}
+
+// registerDashboard 在配置了 admin_token 时提供 /admin/ 文件管理页。
+// 页面本身不含数据，/admin/api/ 下的接口需携带 Authorization: Bearer <admin_token>。
+func registerDashboard(cfg *Config) {
+	if cfg.AdminToken == "" {
+		return
+	}
+	static, _ := fs.Sub(dashboardFS, "dashboard")
+	http.Handle("GET /admin/", withHTTPLoggingB(http.StripPrefix("/admin/", http.FileServer(http.FS(static)))))
+	http.Handle("GET /admin/api/files", withHTTPLoggingB(withAdminAuthB(cfg.AdminToken, func(w http.ResponseWriter, r *http.Request) {
+		files, totals, err := listStoredFiles()
+		if err != nil {
+			loggerB.Error("列出文件失败", "err", err)
+			writeJSONB(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSONB(w, http.StatusOK, map[string]any{"files": files, "totals": totals})
+	})))
+	http.Handle("DELETE /admin/api/files/{path...}", withHTTPLoggingB(withAdminAuthB(cfg.AdminToken, func(w http.ResponseWriter, r *http.Request) {
+		rel, ok := cleanStoredPath(r.PathValue("path"))
+		if !ok {
+			writeJSONB(w, http.StatusBadRequest, map[string]string{"error": "invalid path"})
+			return
+		}
+		if err := os.Remove(filepath.Join(cfg.StorageDir, filepath.FromSlash(rel))); err != nil {
+			code := http.StatusInternalServerError
+			if os.IsNotExist(err) {
+				code = http.StatusNotFound
+			}
+			writeJSONB(w, code, map[string]string{"error": err.Error()})
+			return
+		}
+		_ = os.Remove(metaPath(cfg.StorageDir, rel))
+		if err := uploadIndex.remove(rel); err != nil {
+			loggerB.Warn("删除文件索引失败", "err", err, "path", rel)
+		}
+		loggerB.Info("删除文件", "path", rel, "remote", r.RemoteAddr)
+		writeJSONB(w, http.StatusOK, map[string]string{"status": "deleted", "path": rel})
+	})))
+}
+
+func withAdminAuthB(token string, h http.HandlerFunc) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			loggerB.Warn("管理接口未授权访问", "remote", r.RemoteAddr, "path", r.URL.Path)
+			writeJSONB(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		h(w, r)
+	})
+}
+
+func writeJSONB(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// cleanStoredPath 校验存储目录内的相对路径，拒绝越界与元数据目录。
+func cleanStoredPath(p string) (string, bool) {
+	rel := strings.TrimLeft(path.Clean("/"+p), "/")
+	if rel == "" || rel == metaDirName || strings.HasPrefix(rel, metaDirName+"/") {
+		return "", false
+	}
+	return rel, true
+}
+
+// listStoredFiles 从文件索引按上传时间倒序返回文件及用量统计。
+func listStoredFiles() ([]storedFile, usageTotals, error) {
+	files := []storedFile{}
+	totals := usageTotals{ByType: map[string]int64{}}
+	recs, err := uploadIndex.list()
+	if err != nil {
+		return files, totals, err
+	}
+	for _, rec := range recs {
+		f := storedFile{
+			ID:          rec.ID,
+			Path:        rec.Path,
+			URL:         "/files/" + rec.Path,
+			Name:        rec.Name,
+			Size:        rec.Size,
+			ContentType: rec.ContentType,
+			Uploader:    rec.Uploader,
+			Remote:      rec.Remote,
+			UploadedAt:  rec.UploadedAt,
+			ExpiresAt:   rec.ExpiresAt,
+			Downloads:   rec.Downloads,
+		}
+		if f.ContentType == "" {
+			f.ContentType = "application/octet-stream"
+		}
+		files = append(files, f)
+		totals.Files++
+		totals.Bytes += f.Size
+		major, _, _ := strings.Cut(f.ContentType, "/")
+		totals.ByType[major] += f.Size
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].UploadedAt.After(files[j].UploadedAt) })
+	return files, totals, nil
+}
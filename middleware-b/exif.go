@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// metadataTypes 为 stripImageMetadata 处理的类型
+var metadataTypes = map[string]bool{"image/jpeg": true, "image/png": true, "image/webp": true}
+
+// stripImageMetadata 去除 JPEG / PNG / WebP 中的 EXIF、XMP、IPTC 与文本注释，其余类型原样返回。
+// 保留 ICC 色彩配置等影响显示的数据；注意 JPEG 的 EXIF 方向信息也会一并去除。
+func stripImageMetadata(data []byte, mime string) ([]byte, bool, error) {
+	var (
+		out []byte
+		err error
+	)
+	switch mime {
+	case "image/jpeg":
+		out, err = stripJPEG(data)
+	case "image/png":
+		out, err = stripPNG(data)
+	case "image/webp":
+		out, err = stripWebP(data)
+	default:
+		return data, false, nil
+	}
+	if err != nil {
+		return data, false, err
+	}
+	return out, len(out) != len(data), nil
+}
+
+var errMalformedImage = errors.New("malformed image")
+
+// stripJPEG 去除 APP1（EXIF / XMP）、APP13（IPTC）与 COM 段，SOS 之后的数据原样保留
+func stripJPEG(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, errMalformedImage
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, 0xff, 0xd8)
+	i := 2
+	for i < len(data) {
+		if data[i] != 0xff || i+1 >= len(data) {
+			return nil, errMalformedImage
+		}
+		marker := data[i+1]
+		if marker == 0xff { // 填充字节
+			i++
+			continue
+		}
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd8) {
+			out = append(out, data[i:i+2]...)
+			i += 2
+			continue
+		}
+		if marker == 0xd9 || marker == 0xda {
+			// EOI 或扫描数据开始：其后为图像数据
+			return append(out, data[i:]...), nil
+		}
+		if i+4 > len(data) {
+			return nil, errMalformedImage
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) || end < i+4 {
+			return nil, errMalformedImage
+		}
+		if marker != 0xe1 && marker != 0xed && marker != 0xfe {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return out, nil
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetaChunks 为去除的 PNG 辅助块
+var pngMetaChunks = map[string]bool{"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true}
+
+func stripPNG(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errMalformedImage
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, pngSignature...)
+	for i := len(pngSignature); i < len(data); {
+		if i+8 > len(data) {
+			return nil, errMalformedImage
+		}
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+		if end > len(data) || end < i+12 {
+			return nil, errMalformedImage
+		}
+		if !pngMetaChunks[string(data[i+4:i+8])] {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return out, nil
+}
+
+// stripWebP 去除 EXIF 与 XMP 块，并清除 VP8X 中对应的标志位
+func stripWebP(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errMalformedImage
+	}
+	out := make([]byte, 12, len(data))
+	copy(out, data[:12])
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, errMalformedImage
+		}
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + size + size&1
+		if end > len(data) || end < i+8 {
+			return nil, errMalformedImage
+		}
+		switch fourcc := string(data[i : i+4]); fourcc {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			start := len(out)
+			out = append(out, data[i:end]...)
+			if size > 0 {
+				out[start+8] &^= 0x08 | 0x04
+			}
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// jpegSeg 生成带长度的 JPEG 段
+func jpegSeg(marker byte, payload string) []byte {
+	seg := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+// pngChunk 生成 PNG 块，CRC 不参与校验，固定为 0
+func pngChunk(typ, payload string) []byte {
+	c := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	c = append(c, typ...)
+	c = append(c, payload...)
+	return append(c, 0, 0, 0, 0)
+}
+
+// webpChunk 生成 RIFF 块，奇数长度补一个填充字节
+func webpChunk(fourcc, payload string) []byte {
+	c := append([]byte(fourcc), binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))...)
+	c = append(c, payload...)
+	if len(payload)%2 == 1 {
+		c = append(c, 0)
+	}
+	return c
+}
+
+func webpFile(chunks ...[]byte) []byte {
+	body := []byte("WEBP")
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+	return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+func join(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+func TestStripImageMetadata(t *testing.T) {
+	soi, eoi := []byte{0xff, 0xd8}, []byte{0xff, 0xd9}
+	scan := append([]byte{0xff, 0xda, 0, 2}, "\x12\x34\xff\x00\xff\xd0scan"...) // SOS 后含 RST 与填充
+	app0 := jpegSeg(0xe0, "JFIF\x00\x01\x01")
+	icc := jpegSeg(0xe2, "ICC_PROFILE\x00\x01\x01")
+	dqt := jpegSeg(0xdb, "\x00quant")
+
+	ihdr := pngChunk("IHDR", "\x00\x00\x00\x01\x00\x00\x00\x01\x08\x02\x00\x00\x00")
+	iccp := pngChunk("iCCP", "srgb\x00\x00z")
+	idat := pngChunk("IDAT", "pixels")
+	iend := pngChunk("IEND", "")
+
+	vp8x := func(flags byte) []byte { return webpChunk("VP8X", string([]byte{flags, 0, 0, 0, 0, 0, 0, 0, 0, 0})) }
+	iccpW := webpChunk("ICCP", "icc")
+	vp8 := webpChunk("VP8 ", "frame")
+
+	tests := []struct {
+		name    string
+		mime    string
+		in      []byte
+		want    []byte
+		changed bool
+		wantErr bool
+	}{
+		{"JPEG 去除 EXIF、XMP、IPTC 与注释", "image/jpeg",
+			join(soi, app0, jpegSeg(0xe1, "Exif\x00\x00gps"), jpegSeg(0xe1, "http://ns.adobe.com/xap/1.0/\x00"), icc,
+				jpegSeg(0xed, "Photoshop 3.0\x00"), jpegSeg(0xfe, "comment"), dqt, scan, eoi),
+			join(soi, app0, icc, dqt, scan, eoi), true, false},
+		{"JPEG 段间填充字节被丢弃", "image/jpeg",
+			join(soi, []byte{0xff}, jpegSeg(0xfe, "c"), dqt, scan, eoi), join(soi, dqt, scan, eoi), true, false},
+		{"JPEG 没有元数据", "image/jpeg", join(soi, app0, dqt, scan, eoi), join(soi, app0, dqt, scan, eoi), false, false},
+		{"JPEG SOS 之后的 APP1 字节不处理", "image/jpeg",
+			join(soi, scan, jpegSeg(0xe1, "Exif"), eoi), join(soi, scan, jpegSeg(0xe1, "Exif"), eoi), false, false},
+		{"JPEG 段长度越界", "image/jpeg", join(soi, []byte{0xff, 0xe1, 0xff, 0xff, 'E'}), nil, false, true},
+		{"JPEG 段长度过小", "image/jpeg", join(soi, []byte{0xff, 0xe1, 0x00, 0x01}, scan), nil, false, true},
+		{"JPEG 缺少 SOI", "image/jpeg", join(app0, scan, eoi), nil, false, true},
+
+		{"PNG 去除文本、EXIF 与时间块", "image/png",
+			join(pngSignature, ihdr, pngChunk("tEXt", "Author\x00me"), iccp, pngChunk("eXIf", "MM\x00*"),
+				pngChunk("iTXt", "XML:com.adobe.xmp\x00"), pngChunk("zTXt", "k\x00\x00z"), pngChunk("tIME", "\x07\xea\x03\x01\x0c\x00\x00"), idat, iend),
+			join(pngSignature, ihdr, iccp, idat, iend), true, false},
+		{"PNG 没有元数据", "image/png", join(pngSignature, ihdr, idat, iend), join(pngSignature, ihdr, idat, iend), false, false},
+		{"PNG 块被截断", "image/png", join(pngSignature, ihdr, idat[:len(idat)-2]), nil, false, true},
+		{"PNG 签名错误", "image/png", join([]byte("\x89PNX\r\n\x1a\n"), ihdr, iend), nil, false, true},
+
+		{"WebP 去除 EXIF 与 XMP 并清除标志位", "image/webp",
+			webpFile(vp8x(0x20|0x08|0x04|0x10), iccpW, vp8, webpChunk("EXIF", "MM\x00*x"), webpChunk("XMP ", "<x:xmpmeta/>")),
+			webpFile(vp8x(0x20|0x10), iccpW, vp8), true, false},
+		{"WebP 没有扩展头", "image/webp", webpFile(vp8), webpFile(vp8), false, false},
+		{"WebP 块被截断", "image/webp", webpFile(vp8)[:20], nil, false, true},
+		{"WebP 文件头错误", "image/webp", append([]byte("RIFF\x00\x00\x00\x00WEBQ"), vp8...), nil, false, true},
+
+		{"其他类型原样返回", "image/gif", []byte("GIF89a\x00exif"), []byte("GIF89a\x00exif"), false, false},
+		{"非图片原样返回", "audio/amr", []byte("#!AMR\n"), []byte("#!AMR\n"), false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, changed, err := stripImageMetadata(tt.in, tt.mime)
+			if tt.wantErr {
+				// 解析失败时返回原数据，由调用方决定是否拒绝
+				if err == nil || changed || !bytes.Equal(got, tt.in) {
+					t.Fatalf("err = %v, changed = %v，期望返回原数据与错误", err, changed)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed != tt.changed || !bytes.Equal(got, tt.want) {
+				t.Fatalf("changed = %v，期望 %v\n  得到 %q\n  期望 %q", changed, tt.changed, got, tt.want)
+			}
+		})
+	}
+}
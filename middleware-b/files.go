@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// serveFiles 提供 /files/ 下的文件（路径已去除 /files/ 前缀）：按索引记录设置 Content-Type、
+// 以原始文件名设置 Content-Disposition，以内容 SHA-256 作为强 ETag，并统计下载次数；
+// Range、If-Range、If-None-Match 等条件请求由 http.ServeContent 处理。目录仍按 http.FileServer 列出。
+// 文件与 /admin/ 同源，响应一律带 CSP sandbox，仅图片、音频、视频内联显示，见 servedContentType。
+func serveFiles(storageDir string, maxAge int) http.Handler {
+	root := http.Dir(storageDir)
+	dirs := http.FileServer(root)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rel := strings.TrimLeft(path.Clean("/"+r.URL.Path), "/")
+		f, err := root.Open("/" + rel)
+		if err != nil {
+			switch {
+			case os.IsNotExist(err):
+				http.NotFound(w, r)
+			case os.IsPermission(err):
+				http.Error(w, "403 Forbidden", http.StatusForbidden)
+			default:
+				http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			}
+			return
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		if err != nil {
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if st.IsDir() {
+			dirs.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		name := storedFileName(path.Base(rel))
+		var ct string
+		m, indexed := uploadIndex.byPath(rel)
+		if indexed {
+			if m.Name != "" {
+				name = m.Name
+			}
+			ct = m.ContentType
+			if m.SHA256 != "" && m.Size == st.Size() {
+				h.Set("ETag", `"`+m.SHA256+`"`)
+			}
+		}
+		if ct == "" {
+			// 没有记录的旧文件按内容识别，不按扩展名，避免 .html 等被当作网页
+			head := make([]byte, 512)
+			n, _ := io.ReadFull(f, head)
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			ct = detectContentType(head[:n])
+		}
+		ct, disposition := servedContentType(ct)
+		h.Set("Content-Type", ct)
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Content-Security-Policy", "sandbox")
+		h.Set("Content-Disposition", contentDisposition(disposition, name))
+		if maxAge > 0 {
+			// 存储的文件名唯一且内容不再修改
+			h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", maxAge))
+		}
+		rw := &statusRecorderB{ResponseWriter: w}
+		http.ServeContent(rw, r, name, st.ModTime(), f)
+		// 只统计完整下载与从头开始的分段请求，视频拖动产生的后续分段不重复计数
+		if indexed && r.Method == http.MethodGet && (rw.status == http.StatusOK ||
+			rw.status == http.StatusPartialContent && strings.HasPrefix(r.Header.Get("Range"), "bytes=0-")) {
+			uploadIndex.countDownload(rel)
+		}
+	})
+}
+
+// activeContentTypes 为浏览器中可以执行脚本的类型，/files/ 一律按 application/octet-stream 返回
+var activeContentTypes = map[string]bool{
+	"text/html":             true,
+	"application/xhtml+xml": true,
+	"image/svg+xml":         true,
+	"text/xml":              true,
+	"application/xml":       true,
+}
+
+// servedContentType 返回 /files/ 响应使用的 Content-Type 与 disposition：可执行脚本的类型强制为
+// application/octet-stream，图片、音频、视频以 inline 返回，其余以 attachment 下载。
+func servedContentType(ct string) (string, string) {
+	mime := strings.ToLower(strings.TrimSpace(strings.SplitN(ct, ";", 2)[0]))
+	switch {
+	case mime == "" || activeContentTypes[mime]:
+		return "application/octet-stream", "attachment"
+	case strings.HasPrefix(mime, "image/"), strings.HasPrefix(mime, "audio/"), strings.HasPrefix(mime, "video/"):
+		return ct, "inline"
+	}
+	return ct, "attachment"
+}
+
+// storedFileExists 判断存储目录内的相对路径 rel 是否仍为普通文件
+func storedFileExists(storageDir, rel string) bool {
+	st, err := os.Stat(filepath.Join(storageDir, filepath.FromSlash(rel)))
+	return err == nil && st.Mode().IsRegular()
+}
+
+// fileMetaView 为 /files/{id}/meta 公开返回的字段；上传者与来源地址仅在携带 admin_token 时返回
+type fileMetaView struct {
+	ID          string     `json:"id"`
+	URL         string     `json:"url"`
+	Name        string     `json:"name"`
+	Size        int64      `json:"size"`
+	ContentType string     `json:"content_type"`
+	SHA256      string     `json:"sha256,omitempty"`
+	UploadedAt  time.Time  `json:"uploaded_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Downloads   int64      `json:"downloads"`
+	Uploader    string     `json:"uploader,omitempty"`
+	TokenID     string     `json:"token_id,omitempty"`
+	Remote      string     `json:"remote,omitempty"`
+}
+
+// handleFileMeta 处理 GET /files/{id}/meta
+func handleFileMeta(cfg *Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec, ok := uploadIndex.get(r.PathValue("id"))
+		if !ok {
+			writeJSONB(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+		v := fileMetaView{
+			ID:          rec.ID,
+			URL:         fmt.Sprintf("%s/files/%s", strings.TrimRight(cfg.PublicBaseURL, "/"), rec.Path),
+			Name:        rec.Name,
+			Size:        rec.Size,
+			ContentType: rec.ContentType,
+			SHA256:      rec.SHA256,
+			UploadedAt:  rec.UploadedAt,
+			ExpiresAt:   rec.ExpiresAt,
+			Downloads:   rec.Downloads + uploadIndex.pendingDownloads(rec.Path),
+		}
+		if cfg.AdminToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+cfg.AdminToken)) == 1 {
+			v.Uploader, v.TokenID, v.Remote = rec.Uploader, rec.TokenID, rec.Remote
+		}
+		writeJSONB(w, http.StatusOK, v)
+	})
+}
+
+// storedFileName 去掉存储文件名的 "<纳秒时间戳>_" 前缀，用于没有元数据的旧文件
+func storedFileName(base string) string {
+	prefix, rest, ok := strings.Cut(base, "_")
+	if !ok || rest == "" || strings.Trim(prefix, "0123456789") != "" {
+		return base
+	}
+	return rest
+}
+
+// contentDisposition 生成同时带 ASCII 回退名与 RFC 5987 UTF-8 文件名的 Content-Disposition
+func contentDisposition(disposition, name string) string {
+	var fallback, encoded strings.Builder
+	for _, r := range name {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(r)
+		}
+	}
+	for _, b := range []byte(name) {
+		if isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, disposition, fallback.String(), encoded.String())
+}
+
+// isAttrChar 为 RFC 5987 中无需转义的 attr-char
+func isAttrChar(b byte) bool {
+	switch {
+	case b >= 'a' && b <= 'z', b >= 'A' && b <= 'Z', b >= '0' && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		disposition, name, want string
+	}{
+		{"inline", "a.png", `inline; filename="a.png"; filename*=UTF-8''a.png`},
+		{"attachment", "骰子 结果.png", `attachment; filename="__ __.png"; filename*=UTF-8''%E9%AA%B0%E5%AD%90%20%E7%BB%93%E6%9E%9C.png`},
+		{"inline", `a"b\c.txt`, `inline; filename="a_b_c.txt"; filename*=UTF-8''a%22b%5Cc.txt`},
+		{"inline", "x\r\ny.png", `inline; filename="x__y.png"; filename*=UTF-8''x%0D%0Ay.png`},
+		{"inline", "50%;off'.jpg", `inline; filename="50%;off'.jpg"; filename*=UTF-8''50%25%3Boff%27.jpg`},
+		{"inline", "a!#$&+-.^_`|~b", "inline; filename=\"a!#$&+-.^_`|~b\"; filename*=UTF-8''a!#$&+-.^_`|~b"},
+	}
+	for _, tt := range tests {
+		if got := contentDisposition(tt.disposition, tt.name); got != tt.want {
+			t.Errorf("contentDisposition(%q, %q)\n  得到 %s\n  期望 %s", tt.disposition, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStoredFileName(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"1712345678901234567_a.png", "a.png"},
+		{"1712345678901234567_a_b.png", "a_b.png"},
+		{"1712345678901234567_", "1712345678901234567_"},
+		{"abc_a.png", "abc_a.png"},
+		{"_a.png", "a.png"},
+		{"a.png", "a.png"},
+	}
+	for _, tt := range tests {
+		if got := storedFileName(tt.in); got != tt.want {
+			t.Errorf("storedFileName(%q) = %q，期望 %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestServedContentType(t *testing.T) {
+	tests := []struct {
+		in, ct, disposition string
+	}{
+		{"image/png", "image/png", "inline"},
+		{"audio/amr", "audio/amr", "inline"},
+		{"video/mp4", "video/mp4", "inline"},
+		{"text/plain; charset=utf-8", "text/plain; charset=utf-8", "attachment"},
+		{"application/pdf", "application/pdf", "attachment"},
+		{"text/html; charset=utf-8", "application/octet-stream", "attachment"},
+		{"Image/SVG+XML", "application/octet-stream", "attachment"},
+		{"application/xhtml+xml", "application/octet-stream", "attachment"},
+		{"text/xml; charset=utf-8", "application/octet-stream", "attachment"},
+		{"", "application/octet-stream", "attachment"},
+	}
+	for _, tt := range tests {
+		ct, disposition := servedContentType(tt.in)
+		if ct != tt.ct || disposition != tt.disposition {
+			t.Errorf("servedContentType(%q) = %q, %q，期望 %q, %q", tt.in, ct, disposition, tt.ct, tt.disposition)
+		}
+	}
+}
+
+// /files/ 的响应头：有索引记录的文件按记录的类型与文件名返回，没有记录的旧文件按内容识别
+func TestServeFiles(t *testing.T) {
+	dir := t.TempDir()
+	ix, err := openFileIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := uploadIndex
+	uploadIndex = ix
+	t.Cleanup(func() { uploadIndex = old; ix.Close() })
+
+	files := map[string]string{
+		"2026/03/01/1_a.png":      "\x89PNG\r\n\x1a\n-image",
+		"2026/03/01/2_page.html":  "<html><script>alert(1)</script></html>",
+		"2026/03/01/3_voice.amr":  "#!AMR\n-voice",
+		"2026/03/01/4_notes.txt":  "hello",
+		"2026/03/01/5_x.png":      "<!DOCTYPE html><html></html>", // 扩展名不可信
+		"2026/03/01/6_record.png": "\x89PNG\r\n\x1a\n-indexed",
+	}
+	for rel, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ix.put(fileRecord{ID: "rec1", Path: "2026/03/01/6_record.png", fileMeta: fileMeta{
+		Name: "骰子.png", Size: int64(len(files["2026/03/01/6_record.png"])), ContentType: "image/png",
+		SHA256: "abc123", UploadedAt: time.Now(),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := serveFiles(dir, 3600)
+	tests := []struct {
+		path, ct, disposition, etag string
+	}{
+		{"2026/03/01/1_a.png", "image/png", `inline; filename="a.png"; filename*=UTF-8''a.png`, ""},
+		{"2026/03/01/2_page.html", "application/octet-stream", `attachment; filename="page.html"; filename*=UTF-8''page.html`, ""},
+		{"2026/03/01/3_voice.amr", "audio/amr", `inline; filename="voice.amr"; filename*=UTF-8''voice.amr`, ""},
+		{"2026/03/01/4_notes.txt", "text/plain; charset=utf-8", `attachment; filename="notes.txt"; filename*=UTF-8''notes.txt`, ""},
+		{"2026/03/01/5_x.png", "application/octet-stream", `attachment; filename="x.png"; filename*=UTF-8''x.png`, ""},
+		{"2026/03/01/6_record.png", "image/png", `inline; filename="__.png"; filename*=UTF-8''%E9%AA%B0%E5%AD%90.png`, `"abc123"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/"+tt.path, nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("status = %d", rr.Code)
+			}
+			if body := rr.Body.String(); body != files[tt.path] {
+				t.Errorf("body = %q", body)
+			}
+			hdr := rr.Header()
+			for k, want := range map[string]string{
+				"Content-Type":            tt.ct,
+				"Content-Disposition":     tt.disposition,
+				"X-Content-Type-Options":  "nosniff",
+				"Content-Security-Policy": "sandbox",
+				"Cache-Control":           "public, max-age=3600, immutable",
+				"ETag":                    tt.etag,
+			} {
+				if got := hdr.Get(k); got != want {
+					t.Errorf("%s = %q，期望 %q", k, got, want)
+				}
+			}
+		})
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/2026/03/01/missing.png", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("不存在的文件 status = %d", rr.Code)
+	}
+}
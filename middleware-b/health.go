@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type checkResult struct {
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+	// FreeBytes 仅 storage_free 检查填写
+	FreeBytes uint64 `json:"free_bytes,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+func writeHealth(w http.ResponseWriter, rep healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if rep.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(rep)
+}
+
+// handleHealthz 仅表示进程存活。
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, healthReport{Status: "ok"})
+}
+
+// readyzHandler 检查 storage_dir 可写且剩余空间不低于 min_free_mb。
+func readyzHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rep := healthReport{Status: "ok", Checks: map[string]checkResult{}}
+
+		start := time.Now()
+		err := checkStorageWritable(cfg.StorageDir)
+		res := checkResult{OK: err == nil, Duration: time.Since(start).String()}
+		if err != nil {
+			res.Error = err.Error()
+			rep.Status = "fail"
+		}
+		rep.Checks["storage_writable"] = res
+
+		start = time.Now()
+		free, err := diskFree(cfg.StorageDir)
+		minFree := uint64(cfg.MinFreeMB) << 20
+		if err == nil && free < minFree {
+			err = fmt.Errorf("free space %d bytes below %d MB", free, cfg.MinFreeMB)
+		}
+		res = checkResult{OK: err == nil, Duration: time.Since(start).String(), FreeBytes: free}
+		if err != nil {
+			res.Error = err.Error()
+			rep.Status = "fail"
+		}
+		rep.Checks["storage_free"] = res
+
+		writeHealth(w, rep)
+	}
+}
+
+// checkStorageWritable 在存储目录下的 .meta/readyz 中写入并删除一个临时文件。
+// 探测文件放在元数据目录内，不会被索引或经 /files/ 列出。
+func checkStorageWritable(storageDir string) error {
+	dir := filepath.Join(storageDir, metaDirName, "readyz")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "probe-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	_, werr := f.Write([]byte("ok"))
+	cerr := f.Close()
+	rerr := os.Remove(name)
+	if werr != nil {
+		return werr
+	}
+	if cerr != nil {
+		return cerr
+	}
+	return rerr
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 可写性探测只在 .meta/readyz 下创建临时文件，探测后不留下文件
+func TestCheckStorageWritable(t *testing.T) {
+	dir := t.TempDir()
+	if err := checkStorageWritable(dir); err != nil {
+		t.Fatal(err)
+	}
+	top, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 1 || top[0].Name() != metaDirName {
+		t.Errorf("存储目录顶层出现探测文件: %v", top)
+	}
+	probes, err := os.ReadDir(filepath.Join(dir, metaDirName, "readyz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probes) != 0 {
+		t.Errorf("探测文件未删除: %v", probes)
+	}
+	if err := checkStorageWritable(filepath.Join(dir, "missing", "\x00")); err == nil {
+		t.Error("无效目录应报错")
+	}
+}
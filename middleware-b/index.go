@@ -0,0 +1,420 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// 上传文件索引：storage_dir/.meta/index.db（bbolt），记录每个文件的 ID、哈希、原始文件名、
+// 类型、上传者、过期时间与下载次数，供去重、保留期清理、文件管理页与 /files/{id}/meta 使用。
+// .meta/ 下的 JSON 元数据仍会写入，索引丢失后启动时据此重建。
+
+const indexFileName = "index.db"
+
+var (
+	bucketFiles  = []byte("files")   // id -> fileRecord JSON
+	bucketByPath = []byte("by_path") // 相对路径 -> id
+	bucketByHash = []byte("by_hash") // sha256 -> id
+)
+
+// fileRecord 为索引中的一个文件
+type fileRecord struct {
+	ID   string `json:"id"`
+	Path string `json:"path"` // 存储目录内的相对路径
+	fileMeta
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// RenewedAt 最近一次去重命中的时间，过期时间从它与 UploadedAt 中较晚的一个起算
+	RenewedAt *time.Time `json:"renewed_at,omitempty"`
+	Downloads int64      `json:"downloads"`
+}
+
+// fileIndex 为上传文件索引；下载次数先在内存中累计，定期批量写入。
+type fileIndex struct {
+	db *bolt.DB
+
+	mu        sync.Mutex
+	downloads map[string]int64 // 相对路径 -> 未写入的下载次数
+}
+
+// uploadIndex 在启动时打开
+var uploadIndex *fileIndex
+
+func openFileIndex(storageDir string) (*fileIndex, error) {
+	dir := filepath.Join(storageDir, metaDirName)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(dir, indexFileName), 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketFiles, bucketByPath, bucketByHash} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	ix := &fileIndex{db: db, downloads: map[string]int64{}}
+	go ix.flushLoop(10 * time.Second)
+	return ix, nil
+}
+
+func newFileID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// tokenID 返回上传请求 Bearer token 的指纹，不保存 token 本身
+func tokenID(authorization string) string {
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok || strings.TrimSpace(token) == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	return hex.EncodeToString(sum[:6])
+}
+
+// put 写入记录；去重产生的硬链接记录只在该内容还没有 by_hash 时登记，by_hash 尽量指向原始上传
+func (ix *fileIndex) put(rec fileRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return ix.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bucketFiles).Put([]byte(rec.ID), b); err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketByPath).Put([]byte(rec.Path), []byte(rec.ID)); err != nil {
+			return err
+		}
+		if rec.SHA256 == "" || (rec.Dedup && tx.Bucket(bucketByHash).Get([]byte(rec.SHA256)) != nil) {
+			return nil
+		}
+		return tx.Bucket(bucketByHash).Put([]byte(rec.SHA256), []byte(rec.ID))
+	})
+}
+
+func getRecord(tx *bolt.Tx, id []byte) (fileRecord, bool) {
+	var rec fileRecord
+	b := tx.Bucket(bucketFiles).Get(id)
+	if b == nil || json.Unmarshal(b, &rec) != nil {
+		return rec, false
+	}
+	return rec, true
+}
+
+func (ix *fileIndex) lookup(bucket []byte, key string) (rec fileRecord, ok bool) {
+	_ = ix.db.View(func(tx *bolt.Tx) error {
+		id := []byte(key)
+		if bucket != nil {
+			if id = tx.Bucket(bucket).Get(id); id == nil {
+				return nil
+			}
+		}
+		rec, ok = getRecord(tx, id)
+		return nil
+	})
+	return rec, ok
+}
+
+func (ix *fileIndex) get(id string) (fileRecord, bool) { return ix.lookup(nil, id) }
+
+func (ix *fileIndex) byPath(rel string) (fileRecord, bool) { return ix.lookup(bucketByPath, rel) }
+
+func (ix *fileIndex) byHash(sum string) (fileRecord, bool) { return ix.lookup(bucketByHash, sum) }
+
+// renew 记录去重命中的时间 now，并按 retention_days 顺延过期时间
+func (ix *fileIndex) renew(id string, now time.Time, retentionDays int) error {
+	return ix.db.Update(func(tx *bolt.Tx) error {
+		rec, ok := getRecord(tx, []byte(id))
+		if !ok {
+			return nil
+		}
+		rec.RenewedAt = &now
+		rec.ExpiresAt = rec.expiry(retentionDays)
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketFiles).Put([]byte(id), b)
+	})
+}
+
+// remove 删除 rel 对应的记录，不存在时不报错；by_hash 指向该记录时改为指向相同内容的其他记录
+func (ix *fileIndex) remove(rel string) error {
+	return ix.db.Update(func(tx *bolt.Tx) error {
+		id := tx.Bucket(bucketByPath).Get([]byte(rel))
+		if id == nil {
+			return nil
+		}
+		rec, ok := getRecord(tx, id)
+		if ok && rec.SHA256 != "" {
+			if cur := tx.Bucket(bucketByHash).Get([]byte(rec.SHA256)); string(cur) == string(id) {
+				if err := repointHash(tx, rec.SHA256, id); err != nil {
+					return err
+				}
+			}
+		}
+		if err := tx.Bucket(bucketFiles).Delete(id); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketByPath).Delete([]byte(rel))
+	})
+}
+
+// repointHash 将 by_hash 中的 sum 改为指向除 removed 以外内容相同的记录，优先原始上传；没有时删除
+func repointHash(tx *bolt.Tx, sum string, removed []byte) error {
+	var next []byte
+	err := tx.Bucket(bucketFiles).ForEach(func(k, v []byte) error {
+		if string(k) == string(removed) {
+			return nil
+		}
+		var rec fileRecord
+		if json.Unmarshal(v, &rec) != nil || rec.SHA256 != sum {
+			return nil
+		}
+		if next == nil || !rec.Dedup {
+			next = k
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if next == nil {
+		return tx.Bucket(bucketByHash).Delete([]byte(sum))
+	}
+	return tx.Bucket(bucketByHash).Put([]byte(sum), append([]byte(nil), next...))
+}
+
+// list 返回全部记录，下载次数包含尚未写入的部分
+func (ix *fileIndex) list() ([]fileRecord, error) {
+	out := []fileRecord{}
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketFiles).ForEach(func(_, v []byte) error {
+			var rec fileRecord
+			if json.Unmarshal(v, &rec) == nil {
+				out = append(out, rec)
+			}
+			return nil
+		})
+	})
+	ix.mu.Lock()
+	for i := range out {
+		out[i].Downloads += ix.downloads[out[i].Path]
+	}
+	ix.mu.Unlock()
+	return out, err
+}
+
+// pendingDownloads 返回 rel 尚未写入的下载次数
+func (ix *fileIndex) pendingDownloads(rel string) int64 {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	return ix.downloads[rel]
+}
+
+func (ix *fileIndex) countDownload(rel string) {
+	ix.mu.Lock()
+	ix.downloads[rel]++
+	ix.mu.Unlock()
+}
+
+func (ix *fileIndex) flushLoop(every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for range t.C {
+		if err := ix.flushDownloads(); err != nil {
+			loggerB.Error("写入下载次数失败", "err", err)
+		}
+	}
+}
+
+func (ix *fileIndex) flushDownloads() error {
+	ix.mu.Lock()
+	pending := ix.downloads
+	ix.downloads = map[string]int64{}
+	ix.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	return ix.db.Update(func(tx *bolt.Tx) error {
+		for rel, n := range pending {
+			id := tx.Bucket(bucketByPath).Get([]byte(rel))
+			if id == nil {
+				continue
+			}
+			rec, ok := getRecord(tx, id)
+			if !ok {
+				continue
+			}
+			rec.Downloads += n
+			b, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(bucketFiles).Put(id, b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// expiresAt 按 retention_days 计算过期时间，0 表示永久保留
+func expiresAt(from time.Time, retentionDays int) *time.Time {
+	if retentionDays <= 0 {
+		return nil
+	}
+	t := from.Add(time.Duration(retentionDays) * 24 * time.Hour)
+	return &t
+}
+
+// expiry 按 retention_days 计算记录的过期时间，从上传时间与最近一次去重命中中较晚的一个起算
+func (rec *fileRecord) expiry(retentionDays int) *time.Time {
+	from := rec.UploadedAt
+	if rec.RenewedAt != nil && rec.RenewedAt.After(from) {
+		from = *rec.RenewedAt
+	}
+	return expiresAt(from, retentionDays)
+}
+
+// syncIndex 使索引与存储目录一致：为没有记录的文件（旧文件或索引丢失）补充记录，
+// 优先使用 .meta/ 下的 JSON 元数据；删除文件已不存在的记录；按当前的 retention_days
+// 重新计算已有记录的过期时间。
+func (ix *fileIndex) syncIndex(storageDir string, retentionDays int) (added, removed, updated int, err error) {
+	seen := map[string]bool{}
+	err = filepath.WalkDir(storageDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == metaDirName {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(storageDir, p)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		seen[rel] = true
+		if rec, ok := ix.byPath(rel); ok {
+			want := rec.expiry(retentionDays)
+			if sameTime(want, rec.ExpiresAt) {
+				return nil
+			}
+			rec.ExpiresAt = want
+			if err := ix.put(rec); err != nil {
+				return err
+			}
+			updated++
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rec := fileRecord{ID: newFileID(), Path: rel}
+		if m, ok := readMeta(storageDir, rel); ok {
+			rec.fileMeta = m
+		} else {
+			rec.Name = storedFileName(d.Name())
+			rec.ContentType = mime.TypeByExtension(filepath.Ext(rec.Name))
+			rec.UploadedAt = info.ModTime()
+		}
+		rec.Size = info.Size()
+		rec.ExpiresAt = rec.expiry(retentionDays)
+		if err := ix.put(rec); err != nil {
+			return err
+		}
+		added++
+		return nil
+	})
+	if err != nil {
+		return added, removed, updated, err
+	}
+	recs, err := ix.list()
+	if err != nil {
+		return added, removed, updated, err
+	}
+	for _, rec := range recs {
+		if !seen[rec.Path] {
+			if err := ix.remove(rec.Path); err != nil {
+				return added, removed, updated, err
+			}
+			removed++
+		}
+	}
+	return added, removed, updated, nil
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// sweepExpired 删除已过期的文件及其元数据与记录，返回删除的文件数
+func (ix *fileIndex) sweepExpired(storageDir string, now time.Time) (int, error) {
+	recs, err := ix.list()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, rec := range recs {
+		if rec.ExpiresAt == nil || now.Before(*rec.ExpiresAt) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(storageDir, filepath.FromSlash(rec.Path))); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			loggerB.Error("删除过期文件失败", "err", err, "path", rec.Path)
+			continue
+		}
+		_ = os.Remove(metaPath(storageDir, rec.Path))
+		if err := ix.remove(rec.Path); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// retentionLoop 每小时清理一次过期文件
+func (ix *fileIndex) retentionLoop(storageDir string) {
+	for {
+		if n, err := ix.sweepExpired(storageDir, time.Now()); err != nil {
+			loggerB.Error("清理过期文件失败", "err", err)
+		} else if n > 0 {
+			loggerB.Info("已清理过期文件", "files", n)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+func (ix *fileIndex) Close() error {
+	if err := ix.flushDownloads(); err != nil {
+		loggerB.Error("写入下载次数失败", "err", err)
+	}
+	return ix.db.Close()
+}
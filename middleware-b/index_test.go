@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestIndex 在临时存储目录打开索引，并替换全局的 uploadIndex
+func newTestIndex(t *testing.T) (string, *fileIndex) {
+	t.Helper()
+	dir := t.TempDir()
+	ix, err := openFileIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := uploadIndex
+	uploadIndex = ix
+	t.Cleanup(func() {
+		uploadIndex = old
+		ix.Close()
+	})
+	return dir, ix
+}
+
+func testRecord(id, rel, sum string, dedup bool) fileRecord {
+	return fileRecord{ID: id, Path: rel, fileMeta: fileMeta{Name: id, SHA256: sum, Dedup: dedup, UploadedAt: time.Now()}}
+}
+
+// by_hash 始终指向仍存在的相同内容，删除其中任何一份都不影响之后的去重
+func TestFileIndexByHash(t *testing.T) {
+	tests := []struct {
+		name   string
+		recs   []fileRecord
+		remove []string // 依次删除的路径
+		want   string   // 删除后 byHash 返回的 ID，空表示没有
+	}{
+		{"只有原始上传", []fileRecord{testRecord("orig", "a/orig", "s", false)}, nil, "orig"},
+		{"硬链接记录不改变 by_hash", []fileRecord{testRecord("orig", "a/orig", "s", false), testRecord("link", "a/link", "s", true)}, nil, "orig"},
+		{"删除硬链接后仍指向原始上传", []fileRecord{testRecord("orig", "a/orig", "s", false), testRecord("link", "a/link", "s", true)}, []string{"a/link"}, "orig"},
+		{"删除原始上传后指向硬链接", []fileRecord{testRecord("orig", "a/orig", "s", false), testRecord("link", "a/link", "s", true)}, []string{"a/orig"}, "link"},
+		{"优先改为指向其他原始上传", []fileRecord{
+			testRecord("orig", "a/orig", "s", false), testRecord("link", "a/link", "s", true), testRecord("orig2", "a/orig2", "s", false),
+		}, []string{"a/orig2"}, "orig"},
+		{"全部删除", []fileRecord{testRecord("orig", "a/orig", "s", false), testRecord("link", "a/link", "s", true)}, []string{"a/orig", "a/link"}, ""},
+		{"没有原始上传时登记硬链接", []fileRecord{testRecord("link", "a/link", "s", true)}, nil, "link"},
+		{"不同内容互不影响", []fileRecord{testRecord("orig", "a/orig", "s", false), testRecord("other", "a/other", "t", false)}, []string{"a/other"}, "orig"},
+		{"删除不存在的路径", []fileRecord{testRecord("orig", "a/orig", "s", false)}, []string{"a/missing"}, "orig"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ix := newTestIndex(t)
+			for _, rec := range tt.recs {
+				if err := ix.put(rec); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, rel := range tt.remove {
+				if err := ix.remove(rel); err != nil {
+					t.Fatal(err)
+				}
+				if _, ok := ix.byPath(rel); ok {
+					t.Errorf("%s 删除后仍有记录", rel)
+				}
+			}
+			rec, ok := ix.byHash("s")
+			if got := map[bool]string{true: rec.ID}[ok]; got != tt.want {
+				t.Errorf("byHash = %q，期望 %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileIndexRenew(t *testing.T) {
+	up := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	tests := []struct {
+		name      string
+		renewedAt *time.Time
+		at        time.Time
+		retention int
+		want      *time.Time
+	}{
+		{"从命中时间顺延", nil, up.Add(3 * day), 7, ptr(up.Add(10 * day))},
+		{"早于上一次命中时不缩短", ptr(up.Add(5 * day)), up.Add(2 * day), 7, ptr(up.Add(9 * day))},
+		{"永久保留", nil, up.Add(3 * day), 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ix := newTestIndex(t)
+			rec := testRecord("r", "a/r", "s", false)
+			rec.UploadedAt, rec.RenewedAt = up, tt.renewedAt
+			rec.ExpiresAt = rec.expiry(tt.retention)
+			if err := ix.put(rec); err != nil {
+				t.Fatal(err)
+			}
+			if err := ix.renew("r", tt.at, tt.retention); err != nil {
+				t.Fatal(err)
+			}
+			got, _ := ix.get("r")
+			if !sameTime(got.ExpiresAt, tt.want) || got.RenewedAt == nil || !got.RenewedAt.Equal(tt.at) {
+				t.Errorf("expires_at = %v, renewed_at = %v，期望 %v", got.ExpiresAt, got.RenewedAt, tt.want)
+			}
+		})
+	}
+	_, ix := newTestIndex(t)
+	if err := ix.renew("missing", up, 7); err != nil {
+		t.Errorf("renew 不存在的记录: %v", err)
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func writeStored(t *testing.T, dir, rel, content string) {
+	t.Helper()
+	p := filepath.Join(dir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 文件被直接删除或放入存储目录后，启动时的 syncIndex 使索引与目录一致
+func TestSyncIndex(t *testing.T) {
+	dir, ix := newTestIndex(t)
+	up := time.Now().Add(-time.Hour).Truncate(time.Second)
+	writeStored(t, dir, "2026/03/01/1_keep.png", "keep")
+	keep := testRecord("keep", "2026/03/01/1_keep.png", "s-keep", false)
+	keep.UploadedAt = up
+	keep.ExpiresAt = keep.expiry(30)
+	// 有 .meta 元数据、没有索引记录的文件
+	writeStored(t, dir, "2026/03/01/2_meta.png", "meta")
+	if err := writeMeta(dir, "2026/03/01/2_meta.png", fileMeta{Name: "原名.png", ContentType: "image/png", SHA256: "s-meta", UploadedAt: up}); err != nil {
+		t.Fatal(err)
+	}
+	// 没有元数据的旧文件
+	writeStored(t, dir, "2026/03/01/1712345678000000000_old.txt", "old")
+	// 已被直接删除的文件，其硬链接仍在
+	gone := testRecord("gone", "2026/03/01/3_gone.png", "s-gone", false)
+	writeStored(t, dir, "2026/03/01/4_link.png", "gone")
+	link := testRecord("link", "2026/03/01/4_link.png", "s-gone", true)
+	link.UploadedAt = up
+	link.ExpiresAt = link.expiry(5)
+	// 临时目录中的文件不计入
+	writeStored(t, dir, ".meta/tmp/upload-1", "tmp")
+	for _, rec := range []fileRecord{keep, gone, link} {
+		if err := ix.put(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	added, removed, updated, err := ix.syncIndex(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 2 || removed != 1 || updated != 1 {
+		t.Errorf("added, removed, updated = %d, %d, %d，期望 2, 1, 1", added, removed, updated)
+	}
+	if rec, _ := ix.byPath(keep.Path); !sameTime(rec.ExpiresAt, ptr(up.Add(5*24*time.Hour))) {
+		t.Errorf("按当前 retention_days 重算 expires_at = %v", rec.ExpiresAt)
+	}
+	if rec, ok := ix.byPath("2026/03/01/2_meta.png"); !ok || rec.Name != "原名.png" || rec.SHA256 != "s-meta" || rec.Size != 4 {
+		t.Errorf("按元数据补充的记录 = %+v, %v", rec, ok)
+	}
+	if rec, ok := ix.byPath("2026/03/01/1712345678000000000_old.txt"); !ok || rec.Name != "old.txt" || !strings.HasPrefix(rec.ContentType, "text/plain") {
+		t.Errorf("旧文件的记录 = %+v, %v", rec, ok)
+	}
+	if _, ok := ix.byPath(gone.Path); ok {
+		t.Error("文件已删除的记录仍在")
+	}
+	if rec, ok := ix.byHash("s-gone"); !ok || rec.ID != "link" {
+		t.Errorf("by_hash 未改为指向硬链接: %+v, %v", rec, ok)
+	}
+	if _, ok := ix.byPath(".meta/tmp/upload-1"); ok {
+		t.Error(".meta 下的文件被加入索引")
+	}
+
+	// 再次同步没有变化
+	if added, removed, updated, err := ix.syncIndex(dir, 5); err != nil || added+removed+updated != 0 {
+		t.Errorf("再次同步: %d, %d, %d, %v", added, removed, updated, err)
+	}
+}
+
+func TestSweepExpired(t *testing.T) {
+	dir, ix := newTestIndex(t)
+	now := time.Now()
+	recs := []struct {
+		rel     string
+		expires *time.Time
+		file    bool
+		swept   bool
+	}{
+		{"a/expired.png", ptr(now.Add(-time.Minute)), true, true},
+		{"a/expired-missing.png", ptr(now.Add(-time.Hour)), false, true},
+		{"a/exact.png", ptr(now), true, true},
+		{"a/fresh.png", ptr(now.Add(time.Minute)), true, false},
+		{"a/forever.png", nil, true, false},
+	}
+	for i, r := range recs {
+		if r.file {
+			writeStored(t, dir, r.rel, r.rel)
+			if err := writeMeta(dir, r.rel, fileMeta{Name: r.rel}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		rec := testRecord(fmt.Sprint(i), r.rel, "", false)
+		rec.ExpiresAt = r.expires
+		if err := ix.put(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := ix.sweepExpired(dir, now)
+	if err != nil || n != 3 {
+		t.Fatalf("sweepExpired = %d, %v，期望 3", n, err)
+	}
+	for _, r := range recs {
+		_, indexed := ix.byPath(r.rel)
+		_, statErr := os.Stat(filepath.Join(dir, filepath.FromSlash(r.rel)))
+		_, metaErr := os.Stat(metaPath(dir, r.rel))
+		if indexed == r.swept || (r.file && (statErr == nil) == r.swept) || (r.file && (metaErr == nil) == r.swept) {
+			t.Errorf("%s: 记录 %v，文件 %v，元数据 %v，期望清理 %v", r.rel, indexed, statErr, metaErr, r.swept)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+// 共享文件：与其他模块中的同名文件保持一致，以 middleware-a 中的为准。
+// 修改后运行 scripts/shared-files.sh sync 同步，CI 中由 scripts/shared-files.sh check 检查。
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat 为轮转后文件名中的时间戳，如 app.log 轮转为 app-2024-05-01T00-00-00.000.log
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// rotatingFile 为按大小 / 时间轮转的日志文件，轮转后的旧文件可压缩，并按数量与天数清理。
+type rotatingFile struct {
+	path       string
+	maxSize    int64         // 单个文件上限，0 表示不按大小轮转
+	interval   time.Duration // 按时间轮转的周期，0 表示不按时间轮转
+	maxBackups int           // 保留的旧文件数，0 表示不限
+	maxAge     time.Duration // 旧文件保留时长，0 表示不限
+	compress   bool
+
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// logRotateOptions 对应配置中的 log_max_size_mb 等轮转字段
+type logRotateOptions struct {
+	MaxSizeMB  int
+	Interval   string
+	MaxBackups int
+	MaxAgeDays int
+	Compress   bool
+}
+
+func parseRotateInterval(s string) (time.Duration, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "none":
+		return 0, nil
+	case "hourly":
+		return time.Hour, nil
+	case "daily":
+		return 24 * time.Hour, nil
+	case "weekly":
+		return 7 * 24 * time.Hour, nil
+	}
+	return 0, fmt.Errorf("log_rotate_interval 仅支持 hourly、daily、weekly，实际为 %q", s)
+}
+
+func openRotatingFile(path string, opt logRotateOptions) (*rotatingFile, error) {
+	interval, err := parseRotateInterval(opt.Interval)
+	if err != nil {
+		return nil, err
+	}
+	rf := &rotatingFile{
+		path:       path,
+		interval:   interval,
+		maxBackups: opt.MaxBackups,
+		compress:   opt.Compress,
+	}
+	if opt.MaxSizeMB > 0 {
+		rf.maxSize = int64(opt.MaxSizeMB) << 20
+	}
+	if opt.MaxAgeDays > 0 {
+		rf.maxAge = time.Duration(opt.MaxAgeDays) * 24 * time.Hour
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(rf.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	rf.f = f
+	rf.size = 0
+	rf.openedAt = time.Now()
+	if st, err := f.Stat(); err == nil {
+		rf.size = st.Size()
+		rf.openedAt = st.ModTime()
+		if rf.size == 0 {
+			rf.openedAt = time.Now()
+		}
+	}
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	if rf.shouldRotate(int64(len(p))) {
+		if err := rf.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "log rotate: %v\n", err)
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) shouldRotate(next int64) bool {
+	if rf.size == 0 {
+		return false
+	}
+	if rf.maxSize > 0 && rf.size+next > rf.maxSize {
+		return true
+	}
+	if rf.interval > 0 && !sameBucket(rf.openedAt, time.Now(), rf.interval) {
+		return true
+	}
+	return false
+}
+
+// sameBucket 判断两个时刻是否处于同一个本地时间周期（整点 / 自然日 / 自然周）内。
+func sameBucket(a, b time.Time, interval time.Duration) bool {
+	switch interval {
+	case time.Hour:
+		return a.Truncate(time.Hour).Equal(b.Truncate(time.Hour))
+	case 7 * 24 * time.Hour:
+		ay, aw := a.ISOWeek()
+		by, bw := b.ISOWeek()
+		return ay == by && aw == bw
+	default:
+		ay, am, ad := a.Date()
+		by, bm, bd := b.Date()
+		return ay == by && am == bm && ad == bd
+	}
+}
+
+// rotate 将当前文件改名为带时间戳的旧文件并新建日志文件，随后在后台压缩与清理。
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	rf.f = nil
+	ext := filepath.Ext(rf.path)
+	backup := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(rf.path, ext), time.Now().Format(backupTimeFormat), ext)
+	if err := os.Rename(rf.path, backup); err != nil && !os.IsNotExist(err) {
+		_ = rf.open()
+		return err
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+	go rf.cleanup(backup)
+	return nil
+}
+
+// Reopen 关闭并重新打开日志文件，供外部 logrotate 移走文件后调用。
+func (rf *rotatingFile) Reopen() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f != nil {
+		_ = rf.f.Close()
+		rf.f = nil
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) cleanup(justRotated string) {
+	if rf.compress && justRotated != "" {
+		if err := gzipFile(justRotated); err != nil {
+			fmt.Fprintf(os.Stderr, "log compress: %v\n", err)
+		}
+	}
+	ext := filepath.Ext(rf.path)
+	prefix := filepath.Base(strings.TrimSuffix(rf.path, ext)) + "-"
+	entries, err := os.ReadDir(filepath.Dir(rf.path))
+	if err != nil {
+		return
+	}
+	type backup struct {
+		path string
+		at   time.Time
+	}
+	var backups []backup
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".gz"), ext)
+		at, err := time.ParseInLocation(backupTimeFormat, stamp, time.Local)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{filepath.Join(filepath.Dir(rf.path), name), at})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].at.After(backups[j].at) })
+	cutoff := time.Now().Add(-rf.maxAge)
+	for i, b := range backups {
+		if (rf.maxBackups > 0 && i >= rf.maxBackups) || (rf.maxAge > 0 && b.at.Before(cutoff)) {
+			_ = os.Remove(b.path)
+		}
+	}
+}
+
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	in.Close()
+	return os.Remove(path)
+}
+
+// watchLogReopen 收到 SIGUSR1（Windows 下不支持）时重新打开日志文件。
+func watchLogReopen(rf *rotatingFile) {
+	sig := make(chan os.Signal, 1)
+	if !notifyLogReopen(sig) {
+		return
+	}
+	for range sig {
+		if err := rf.Reopen(); err != nil {
+			loggerB.Error("重新打开日志文件失败", "err", err, "path", rf.path)
+			continue
+		}
+		loggerB.Info("已重新打开日志文件", "path", rf.path)
+	}
+}
@@ -2,15 +2,22 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Config struct {
@@ -21,6 +28,37 @@ type Config struct {
 	LogFile       string `json:"log_file"`
 	LogFormat     string `json:"log_format"`
 	LogConsole    bool   `json:"log_console"`
+	// 日志轮转：单文件上限（MB，默认 100，负数不限）、按时间轮转（hourly/daily/weekly）、
+	// 保留的旧文件数（默认 7，负数不限）与天数（0 不限），以及是否 gzip 压缩旧文件
+	LogMaxSizeMB      int    `json:"log_max_size_mb"`
+	LogRotateInterval string `json:"log_rotate_interval"`
+	LogMaxBackups     int    `json:"log_max_backups"`
+	LogMaxAgeDays     int    `json:"log_max_age_days"`
+	LogCompress       bool   `json:"log_compress"`
+	// AdminToken 文件管理页 /admin/ 的访问令牌，为空时不启用
+	AdminToken string `json:"admin_token"`
+	// Tracing OpenTelemetry 链路追踪
+	Tracing TracingConfig `json:"tracing"`
+	// MinFreeMB 为 /readyz 要求的存储目录最小剩余空间（MB），默认 100
+	MinFreeMB int `json:"min_free_mb"`
+	// TLS 监听端口的 TLS 配置；证书文件变更自动重新加载
+	TLS ServerTLSConfig `json:"tls"`
+	// UploadRequireClientCert 要求 /upload 的请求携带经 tls.client_ca_file 校验的客户端证书，
+	// 配合 client_auth=optional 使 /files/ 仍可匿名访问
+	UploadRequireClientCert bool `json:"upload_require_client_cert"`
+	// Upload 上传文件的类型、大小校验与扫描
+	Upload UploadPolicy `json:"upload"`
+	// FilesMaxAge /files/ 响应的缓存时长（秒），默认 7 天，负数不发送 Cache-Control
+	FilesMaxAge int `json:"files_max_age"`
+	// RetentionDays 文件保留天数，过期后自动删除，0 为永久保留
+	RetentionDays int `json:"retention_days"`
+	// DisableDedup 关闭按内容去重；默认相同内容的上传直接返回已有文件的 URL
+	DisableDedup bool `json:"disable_dedup"`
+	// UploadTokens 允许的上传 token（Authorization: Bearer），为空时不校验；
+	// 配置后配额按 token 计算，否则按来源 IP
+	UploadTokens []string `json:"upload_tokens"`
+	// Quota 每个上传者的每日配额与 /upload 请求速率限制
+	Quota QuotaConfig `json:"quota"`
 }
 
 var (
@@ -35,6 +73,16 @@ func initLoggerBDefault() {
 	slog.SetDefault(loggerB)
 }
 
+func (cfg *Config) logRotateOptions() logRotateOptions {
+	return logRotateOptions{
+		MaxSizeMB:  cfg.LogMaxSizeMB,
+		Interval:   cfg.LogRotateInterval,
+		MaxBackups: cfg.LogMaxBackups,
+		MaxAgeDays: cfg.LogMaxAgeDays,
+		Compress:   cfg.LogCompress,
+	}
+}
+
 func initLoggerBFromConfig(cfg *Config) {
 	switch strings.ToLower(strings.TrimSpace(cfg.LogLevel)) {
 	case "debug":
@@ -56,9 +104,12 @@ func initLoggerBFromConfig(cfg *Config) {
 		lf = filepath.Join("logs", "middleware-b.log")
 	}
 	if lf != "" {
-		_ = os.MkdirAll(filepath.Dir(lf), 0o755)
-		if f, err := os.OpenFile(lf, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644); err == nil {
-			out = append(out, f)
+		rf, err := openRotatingFile(lf, cfg.logRotateOptions())
+		if err != nil {
+			loggerB.Error("打开日志文件失败", "err", err, "path", lf)
+		} else {
+			out = append(out, rf)
+			go watchLogReopen(rf)
 		}
 	}
 	var w io.Writer = os.Stdout
@@ -94,10 +145,15 @@ func (w *statusRecorderB) Write(b []byte) (int, error) {
 func withHTTPLoggingB(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		rid := fmt.Sprintf("%x", time.Now().UnixNano())
+		// 沿用 A 传来的 X-Request-ID，便于在两端日志中检索同一次上传
+		rid := r.Header.Get(requestIDHeader)
+		if !validRequestID(rid) {
+			rid = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, rid)
 		rw := &statusRecorderB{ResponseWriter: w}
 		loggerB.Info("http start", "rid", rid, "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
-		h.ServeHTTP(rw, r)
+		h.ServeHTTP(rw, r.WithContext(withRequestID(r.Context(), rid)))
 		dur := time.Since(start)
 		loggerB.Info("http end", "rid", rid, "status", rw.status, "bytes", rw.bytes, "duration", dur)
 	})
@@ -132,6 +188,30 @@ func loadConfig(path string) (*Config, error) {
 	if !cfg.LogConsole {
 		cfg.LogConsole = true
 	}
+	if cfg.LogMaxSizeMB == 0 {
+		cfg.LogMaxSizeMB = 100
+	}
+	if cfg.LogMaxBackups == 0 {
+		cfg.LogMaxBackups = 7
+	}
+	if _, err := parseRotateInterval(cfg.LogRotateInterval); err != nil {
+		return nil, err
+	}
+	if cfg.MinFreeMB == 0 {
+		cfg.MinFreeMB = 100
+	}
+	if cfg.UploadRequireClientCert && cfg.TLS.ClientCAFile == "" {
+		return nil, fmt.Errorf("upload_require_client_cert 需要配置 tls.client_ca_file")
+	}
+	if cfg.FilesMaxAge == 0 {
+		cfg.FilesMaxAge = 7 * 24 * 3600
+	}
+	if err := cfg.Upload.prepare(); err != nil {
+		return nil, err
+	}
+	if q := cfg.Quota; q.BytesPerDayMB < 0 || q.FilesPerDay < 0 || q.RatePerMinute < 0 || q.Burst < 0 {
+		return nil, fmt.Errorf("quota 的取值不能为负数")
+	}
 	return &cfg, nil
 }
 
@@ -147,25 +227,134 @@ func main() {
 		os.Exit(1)
 	}
 	initLoggerBFromConfig(cfg)
+	shutdown, err := initTracing(cfg.Tracing)
+	if err != nil {
+		loggerB.Error("初始化链路追踪失败", "err", err)
+		os.Exit(1)
+	}
+	if cfg.Tracing.Endpoint != "" {
+		loggerB.Info("链路追踪已启用", "endpoint", cfg.Tracing.Endpoint)
+	}
 	if err := os.MkdirAll(cfg.StorageDir, 0o755); err != nil {
 		loggerB.Error("创建存储目录失败", "err", err)
 		os.Exit(1)
 	}
+	// 上传先写入临时目录，通过校验后再移入存储目录
+	tmpDir := filepath.Join(cfg.StorageDir, metaDirName, "tmp")
+	if err := os.MkdirAll(tmpDir, 0o755); err != nil {
+		loggerB.Error("创建临时目录失败", "err", err)
+		os.Exit(1)
+	}
+	if uploadIndex, err = openFileIndex(cfg.StorageDir); err != nil {
+		loggerB.Error("打开文件索引失败", "err", err)
+		os.Exit(1)
+	}
+	if added, removed, updated, err := uploadIndex.syncIndex(cfg.StorageDir, cfg.RetentionDays); err != nil {
+		loggerB.Error("同步文件索引失败", "err", err)
+	} else if added > 0 || removed > 0 || updated > 0 {
+		loggerB.Info("已同步文件索引", "added", added, "removed", removed, "expiry_updated", updated)
+	}
+	go uploadIndex.retentionLoop(cfg.StorageDir)
+	// 按索引恢复当日已用配额
+	if recs, err := uploadIndex.list(); err == nil {
+		limiter.seed(recs, len(cfg.UploadTokens) > 0, time.Now())
+	}
+	// 退出前刷新尚未导出的 span 与下载次数
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		shutdownTracing(shutdown)
+		if err := uploadIndex.Close(); err != nil {
+			loggerB.Error("关闭文件索引失败", "err", err)
+		}
+		os.Exit(0)
+	}()
+
+	http.Handle("/upload", withHTTPLoggingB(withTracingB("upload", handleUpload(cfg, tmpDir))))
 
-	http.Handle("/upload", withHTTPLoggingB(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	files := serveFiles(cfg.StorageDir, cfg.FilesMaxAge)
+	http.Handle("/files/", withHTTPLoggingB(withServedMetrics(http.StripPrefix("/files/", hideMetaDir(files)))))
+	http.Handle("GET /files/{id}/meta", withHTTPLoggingB(handleFileMeta(cfg)))
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", readyzHandler(cfg))
+	registerDashboard(cfg)
+
+	tlsCfg, err := cfg.TLS.build()
+	if err != nil {
+		loggerB.Error("加载 TLS 证书失败", "err", err)
+		os.Exit(1)
+	}
+	loggerB.Info("服务启动", "http", cfg.ListenHTTP, "tls", tlsCfg != nil, "storage", cfg.StorageDir)
+	if err := listenAndServe(cfg.ListenHTTP, nil, tlsCfg); err != nil {
+		loggerB.Error("HTTP 服务启动失败", "err", err)
+		os.Exit(1)
+	}
+}
+
+// handleUpload 处理 POST /upload：写入 tmpDir 并校验，通过后移入存储目录或按内容去重，记录元数据与索引。
+func handleUpload(cfg *Config, tmpDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
+		lg := loggerB.With("rid", requestIDFrom(r.Context()))
+		if cfg.UploadRequireClientCert && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			metricUploadFailures.WithLabelValues("client_cert").Inc()
+			http.Error(w, "client certificate required", http.StatusForbidden)
+			lg.Warn("上传请求未携带有效的客户端证书", "remote", r.RemoteAddr)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if len(cfg.UploadTokens) > 0 && !uploadTokenValid(auth, cfg.UploadTokens) {
+			metricUploadFailures.WithLabelValues("unauthorized").Inc()
+			w.Header().Set("WWW-Authenticate", `Bearer realm="upload"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			lg.Warn("上传请求未授权", "remote", r.RemoteAddr)
+			return
+		}
+		// 按 Content-Length 预占配额，处理结束后按实际存储结果结算；
+		// 只有配置了 upload_tokens（token 已通过校验）时按 token 区分，否则按来源 IP
+		var fp string
+		if len(cfg.UploadTokens) > 0 {
+			fp = tokenID(auth)
+		}
+		key := uploaderKey(fp, r.RemoteAddr)
+		reserved := max(r.ContentLength, 0)
+		if wait, reason := limiter.reserve(key, cfg.Quota, reserved, time.Now()); reason != "" {
+			metricUploadFailures.WithLabelValues(reason).Inc()
+			writeTooManyRequests(w, wait, "upload "+reason+" limit exceeded")
+			lg.Warn("上传请求超出限制", "reason", reason, "uploader", key, "retry_after", wait.Round(time.Second).String())
+			return
+		}
+		var (
+			stored     bool
+			storedSize int64
+		)
+		defer func() { limiter.settle(key, reserved, storedSize, stored, time.Now()) }()
+		if limit := cfg.Upload.bodyLimit(); limit > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
 		if err := r.ParseMultipartForm(64 << 20); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				metricUploadFailures.WithLabelValues("too_large").Inc()
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				lg.Warn("上传文件超过大小上限", "limit", tooLarge.Limit)
+				return
+			}
+			metricUploadFailures.WithLabelValues("form").Inc()
 			http.Error(w, fmt.Sprintf("parse form: %v", err), http.StatusBadRequest)
-			loggerB.Error("解析表单失败", "err", err)
+			lg.Error("解析表单失败", "err", err)
 			return
 		}
 		file, hdr, err := r.FormFile("file")
 		if err != nil {
+			metricUploadFailures.WithLabelValues("form").Inc()
 			http.Error(w, fmt.Sprintf("form file: %v", err), http.StatusBadRequest)
-			loggerB.Error("获取表单文件失败", "err", err)
+			lg.Error("获取表单文件失败", "err", err)
 			return
 		}
 		defer file.Close()
@@ -173,64 +362,163 @@ func main() {
 		if n := r.FormValue("name"); n != "" {
 			name = n
 		}
+		_, span := tracer.Start(r.Context(), "storage.write", trace.WithAttributes(attribute.String("upload.name", name)))
 		// create dated dir
 		sub := time.Now().Format("2006/01/02")
 		dir := filepath.Join(cfg.StorageDir, sub)
 		if err = os.MkdirAll(dir, 0o755); err != nil {
+			endSpan(span, err)
+			metricUploadFailures.WithLabelValues("storage").Inc()
 			http.Error(w, fmt.Sprintf("mkdir: %v", err), http.StatusInternalServerError)
-			loggerB.Error("创建目录失败", "err", err)
+			lg.Error("创建目录失败", "err", err)
 			return
 		}
 		// ensure clean name
 		name = filepath.Base(name)
 		safeName := strings.ReplaceAll(name, " ", "_")
 		outPath := filepath.Join(dir, fmt.Sprintf("%d_%s", time.Now().UnixNano(), safeName))
-		out, err := os.Create(outPath)
+		out, err := os.CreateTemp(tmpDir, "upload-*")
 		if err != nil {
+			endSpan(span, err)
+			metricUploadFailures.WithLabelValues("storage").Inc()
 			http.Error(w, fmt.Sprintf("create: %v", err), http.StatusInternalServerError)
-			loggerB.Error("创建文件失败", "err", err)
+			lg.Error("创建文件失败", "err", err)
 			return
 		}
-		defer out.Close()
+		tmpPath := out.Name()
+		// CreateTemp 创建的文件为 0600；移入存储目录后 Remove 为空操作
+		_ = out.Chmod(0o644)
+		defer os.Remove(tmpPath)
 		wrote, copyErr := io.Copy(out, file)
+		if err := out.Close(); copyErr == nil {
+			copyErr = err
+		}
 		if copyErr != nil {
+			endSpan(span, copyErr)
+			metricUploadFailures.WithLabelValues("write").Inc()
 			http.Error(w, fmt.Sprintf("write: %v", copyErr), http.StatusInternalServerError)
-			loggerB.Error("写入文件失败", "err", copyErr)
+			lg.Error("写入文件失败", "err", copyErr)
 			return
 		}
-
-		absOut := outPath
-		if !filepath.IsAbs(absOut) {
-			if a, err := filepath.Abs(absOut); err == nil {
-				absOut = a
+		checked, err := cfg.Upload.check(r.Context(), tmpPath, name, wrote)
+		if err != nil {
+			endSpan(span, err)
+			var rej *uploadRejection
+			if errors.As(err, &rej) {
+				metricUploadFailures.WithLabelValues(rej.reason).Inc()
+				http.Error(w, rej.msg, rej.status)
+				lg.Warn("上传文件未通过校验", "reason", rej.reason, "err", rej.msg, "name", name, "content_type", checked.ContentType)
+				return
+			}
+			metricUploadFailures.WithLabelValues("storage").Inc()
+			http.Error(w, fmt.Sprintf("check: %v", err), http.StatusInternalServerError)
+			lg.Error("校验上传文件失败", "err", err)
+			return
+		}
+		now := time.Now()
+		expires := expiresAt(now, cfg.RetentionDays)
+		if !cfg.DisableDedup {
+			// 相同内容已存在时丢弃本次上传：文件名相同则直接返回已有文件，
+			// 否则以本次的文件名硬链接到已有文件，使 /files/ 按本次的文件名下载
+			if rec, ok := uploadIndex.byHash(checked.SHA256); ok && storedFileExists(cfg.StorageDir, rec.Path) {
+				endSpan(span, nil)
+				metricDedupHits.Inc()
+				if rec.Name != name {
+					linked, err := linkDedup(cfg.StorageDir, rec, outPath, name, now, expires)
+					if err == nil {
+						linked.Uploader, linked.TokenID, linked.Remote = r.FormValue("uploader"), tokenID(auth), r.RemoteAddr
+						if err := writeMeta(cfg.StorageDir, linked.Path, linked.fileMeta); err != nil {
+							lg.Warn("写入文件元数据失败", "err", err, "path", linked.Path)
+						}
+						if err := uploadIndex.put(linked); err != nil {
+							lg.Warn("写入文件索引失败", "err", err, "path", linked.Path)
+						}
+						writeUploadResponse(w, lg, cfg, linked, true)
+						return
+					}
+					lg.Warn("链接已有文件失败，返回已有文件", "err", err, "id", rec.ID)
+					rec.Name = name
+				}
+				if err := uploadIndex.renew(rec.ID, now, cfg.RetentionDays); err != nil {
+					lg.Warn("更新过期时间失败", "err", err, "id", rec.ID)
+				}
+				writeUploadResponse(w, lg, cfg, rec, true)
+				return
 			}
 		}
+		if err := os.Rename(tmpPath, outPath); err != nil {
+			endSpan(span, err)
+			metricUploadFailures.WithLabelValues("storage").Inc()
+			http.Error(w, fmt.Sprintf("rename: %v", err), http.StatusInternalServerError)
+			lg.Error("移动文件失败", "err", err)
+			return
+		}
+		wrote = checked.Size
+		stored, storedSize = true, wrote
+		span.SetAttributes(attribute.String("storage.path", outPath), attribute.Int64("upload.bytes", wrote))
+		endSpan(span, nil)
+		metricStoredBytes.Add(float64(wrote))
+		metricStoredFiles.Inc()
+
 		rel, err := filepath.Rel(cfg.StorageDir, outPath)
 		if err != nil {
 			rel = strings.TrimPrefix(outPath, cfg.StorageDir)
 		}
 		rel = filepath.ToSlash(rel)
 		rel = strings.TrimLeft(rel, "/")
-		publicURL := fmt.Sprintf("%s/files/%s", strings.TrimRight(cfg.PublicBaseURL, "/"), rel)
-
-		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(map[string]string{
-			"url":        publicURL,
-			"name":       name,
-			"local_path": absOut,
-		}); err != nil {
-			loggerB.Error("编码响应失败", "err", err)
-		} else {
-			loggerB.Info("upload success", "name", name, "bytes", wrote, "local_path", absOut, "url", publicURL)
+		meta := fileMeta{
+			Name:        name,
+			Size:        wrote,
+			ContentType: checked.ContentType,
+			SHA256:      checked.SHA256,
+			Uploader:    r.FormValue("uploader"),
+			TokenID:     tokenID(auth),
+			Remote:      r.RemoteAddr,
+			UploadedAt:  now,
 		}
-	})))
+		if err := writeMeta(cfg.StorageDir, rel, meta); err != nil {
+			lg.Warn("写入文件元数据失败", "err", err, "path", rel)
+		}
+		rec := fileRecord{ID: newFileID(), Path: rel, fileMeta: meta, ExpiresAt: expires}
+		if err := uploadIndex.put(rec); err != nil {
+			lg.Warn("写入文件索引失败", "err", err, "path", rel)
+		}
+		writeUploadResponse(w, lg, cfg, rec, false)
+	}
+}
 
-	fs := http.FileServer(http.Dir(cfg.StorageDir))
-	http.Handle("/files/", withHTTPLoggingB(http.StripPrefix("/files/", fs)))
+// linkDedup 将已有文件 rec 硬链接到 outPath，返回以 name 为文件名的新记录（不占用额外空间）
+func linkDedup(storageDir string, rec fileRecord, outPath, name string, now time.Time, expires *time.Time) (fileRecord, error) {
+	if err := os.Link(filepath.Join(storageDir, filepath.FromSlash(rec.Path)), outPath); err != nil {
+		return fileRecord{}, err
+	}
+	rel, err := filepath.Rel(storageDir, outPath)
+	if err != nil {
+		os.Remove(outPath)
+		return fileRecord{}, err
+	}
+	meta := rec.fileMeta
+	meta.Name, meta.UploadedAt, meta.Dedup = name, now, true
+	return fileRecord{ID: newFileID(), Path: filepath.ToSlash(rel), fileMeta: meta, ExpiresAt: expires}, nil
+}
 
-	loggerB.Info("服务启动", "http", cfg.ListenHTTP, "storage", cfg.StorageDir)
-	if err := http.ListenAndServe(cfg.ListenHTTP, nil); err != nil {
-		loggerB.Error("HTTP 服务启动失败", "err", err)
-		os.Exit(1)
+// writeUploadResponse 返回上传结果；dedup 表示内容与已有文件相同，返回的是已有文件。
+func writeUploadResponse(w http.ResponseWriter, lg *slog.Logger, cfg *Config, rec fileRecord, dedup bool) {
+	absOut := filepath.Join(cfg.StorageDir, filepath.FromSlash(rec.Path))
+	if a, err := filepath.Abs(absOut); err == nil {
+		absOut = a
+	}
+	publicURL := fmt.Sprintf("%s/files/%s", strings.TrimRight(cfg.PublicBaseURL, "/"), rec.Path)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{
+		"id":         rec.ID,
+		"url":        publicURL,
+		"name":       rec.Name,
+		"local_path": absOut,
+		"dedup":      dedup,
+	}); err != nil {
+		lg.Error("编码响应失败", "err", err)
+	} else {
+		lg.Info("upload success", "id", rec.ID, "name", rec.Name, "bytes", rec.Size, "local_path", absOut, "url", publicURL, "dedup", dedup)
 	}
 }
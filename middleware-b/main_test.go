@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	loggerB = slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: levelVarB}))
+	os.Exit(m.Run())
+}
+
+// testUploadServer 以临时存储目录与索引启动 /upload，配额按测试重置
+func testUploadServer(t *testing.T, cfg *Config) (*Config, *fileIndex) {
+	t.Helper()
+	dir, ix := newTestIndex(t)
+	cfg.StorageDir, cfg.PublicBaseURL = dir, "http://b.test"
+	if err := cfg.Upload.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	tmpDir := filepath.Join(dir, metaDirName, "tmp")
+	if err := os.MkdirAll(tmpDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	old := limiter
+	limiter = newTestLimiter()
+	t.Cleanup(func() { limiter = old })
+	srv := httptest.NewServer(handleUpload(cfg, tmpDir))
+	t.Cleanup(srv.Close)
+	cfg.ListenHTTP = srv.URL
+	return cfg, ix
+}
+
+type uploadReply struct {
+	ID        string `json:"id"`
+	URL       string `json:"url"`
+	Name      string `json:"name"`
+	LocalPath string `json:"local_path"`
+	Dedup     bool   `json:"dedup"`
+}
+
+func postUpload(t *testing.T, cfg *Config, name string, data []byte) uploadReply {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, _ := w.CreateFormFile("file", name)
+	part.Write(data)
+	w.WriteField("name", name)
+	w.Close()
+	resp, err := http.Post(cfg.ListenHTTP+"/upload", w.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("上传 %s: %d %s", name, resp.StatusCode, b)
+	}
+	var r uploadReply
+	if err := json.Unmarshal(b, &r); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// storedFiles 返回存储目录中（不含 .meta）的文件数
+func storedFiles(t *testing.T, dir string) int {
+	t.Helper()
+	n := 0
+	filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if d.IsDir() && d.Name() == metaDirName {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+func TestUploadDedup(t *testing.T) {
+	cfg, ix := testUploadServer(t, &Config{RetentionDays: 30})
+	png := []byte("\x89PNG\r\n\x1a\n-dedup")
+
+	first := postUpload(t, cfg, "a.png", png)
+	if first.Dedup || storedFiles(t, cfg.StorageDir) != 1 {
+		t.Fatalf("首次上传: %+v", first)
+	}
+
+	// 文件名相同：返回已有文件并顺延过期时间
+	same := postUpload(t, cfg, "a.png", png)
+	if !same.Dedup || same.ID != first.ID || same.URL != first.URL || storedFiles(t, cfg.StorageDir) != 1 {
+		t.Errorf("文件名相同的去重: %+v", same)
+	}
+	if rec, _ := ix.get(first.ID); rec.RenewedAt == nil {
+		t.Error("去重命中未记录 renewed_at")
+	}
+
+	// 文件名不同：以新文件名硬链接到已有文件
+	other := postUpload(t, cfg, "b.png", png)
+	if !other.Dedup || other.ID == first.ID || other.Name != "b.png" || other.URL == first.URL {
+		t.Fatalf("文件名不同的去重: %+v", other)
+	}
+	st1, err1 := os.Stat(first.LocalPath)
+	st2, err2 := os.Stat(other.LocalPath)
+	if err1 != nil || err2 != nil || !os.SameFile(st1, st2) {
+		t.Errorf("未硬链接到已有文件: %v, %v", err1, err2)
+	}
+	orig, _ := ix.get(first.ID)
+	linked, ok := ix.get(other.ID)
+	if !ok || !linked.Dedup || linked.Name != "b.png" || linked.SHA256 != orig.SHA256 {
+		t.Errorf("硬链接记录 = %+v, %v", linked, ok)
+	}
+	if m, ok := readMeta(cfg.StorageDir, linked.Path); !ok || !m.Dedup || m.Name != "b.png" {
+		t.Errorf("硬链接的元数据 = %+v, %v", m, ok)
+	}
+	if rec, _ := ix.byHash(linked.SHA256); rec.ID != first.ID {
+		t.Errorf("by_hash 指向 %s，期望原始上传 %s", rec.ID, first.ID)
+	}
+
+	// 原始文件过期删除后，相同内容仍通过硬链接去重
+	orig.ExpiresAt = ptr(time.Now().Add(-time.Minute))
+	if err := ix.put(orig); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ix.sweepExpired(cfg.StorageDir, time.Now()); n != 1 || err != nil {
+		t.Fatalf("sweepExpired = %d, %v", n, err)
+	}
+	again := postUpload(t, cfg, "b.png", png)
+	if !again.Dedup || again.ID != other.ID {
+		t.Errorf("删除原始文件后的去重: %+v，期望命中 %s", again, other.ID)
+	}
+
+	// 内容不同的文件正常存储
+	if r := postUpload(t, cfg, "b.png", []byte("\x89PNG\r\n\x1a\n-other")); r.Dedup {
+		t.Errorf("内容不同的文件被去重: %+v", r)
+	}
+}
+
+func TestUploadDedupDisabled(t *testing.T) {
+	cfg, _ := testUploadServer(t, &Config{DisableDedup: true})
+	data := []byte("\x89PNG\r\n\x1a\n-same")
+	a, b := postUpload(t, cfg, "a.png", data), postUpload(t, cfg, "a.png", data)
+	if a.Dedup || b.Dedup || a.ID == b.ID || storedFiles(t, cfg.StorageDir) != 2 {
+		t.Errorf("disable_dedup 时仍去重: %+v / %+v", a, b)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// metaDirName 为存储目录下保存文件元数据的子目录，不经 /files/ 对外提供。
+const metaDirName = ".meta"
+
+// fileMeta 为上传时记录的文件元数据，以 JSON 保存在 .meta/<相对路径>.json。
+type fileMeta struct {
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	SHA256      string    `json:"sha256,omitempty"`
+	Uploader    string    `json:"uploader,omitempty"`
+	TokenID     string    `json:"token_id,omitempty"` // 上传请求 Bearer token 的指纹
+	Remote      string    `json:"remote,omitempty"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+	// Dedup 为去重命中时硬链接到已有文件的记录，不占用额外空间
+	Dedup bool `json:"dedup,omitempty"`
+}
+
+func metaPath(storageDir, rel string) string {
+	return filepath.Join(storageDir, metaDirName, filepath.FromSlash(rel)+".json")
+}
+
+func writeMeta(storageDir, rel string, m fileMeta) error {
+	p := metaPath(storageDir, rel)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, b, 0o644)
+}
+
+// readMeta 读取文件元数据；旧文件没有元数据时返回 false。
+func readMeta(storageDir, rel string) (fileMeta, bool) {
+	var m fileMeta
+	b, err := os.ReadFile(metaPath(storageDir, rel))
+	if err != nil || json.Unmarshal(b, &m) != nil {
+		return m, false
+	}
+	return m, true
+}
+
+// hideMetaDir 拒绝通过 /files/ 访问元数据目录
+func hideMetaDir(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimLeft(path.Clean("/"+r.URL.Path), "/")
+		if p == metaDirName || strings.HasPrefix(p, metaDirName+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus 指标，经 /metrics 暴露。
+var (
+	metricStoredBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "middleware_b_stored_bytes_total",
+		Help: "经 /upload 写入存储目录的字节数",
+	})
+	metricStoredFiles = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "middleware_b_stored_files_total",
+		Help: "经 /upload 写入存储目录的文件数",
+	})
+	metricUploadFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "middleware_b_upload_failures_total",
+		Help: "/upload 失败次数，reason 为 client_cert、unauthorized、form、storage、write，" +
+			"限流的 rate、quota，或校验未通过的 too_large、type、executable、infected、scan_error",
+	}, []string{"reason"})
+	metricDedupHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "middleware_b_dedup_hits_total",
+		Help: "内容与已有文件相同、直接返回已有文件的上传次数",
+	})
+	metricServedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "middleware_b_served_bytes_total",
+		Help: "经 /files/ 提供下载的字节数",
+	})
+	metricServedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "middleware_b_served_requests_total",
+		Help: "/files/ 请求数，按状态码区分",
+	}, []string{"code"})
+)
+
+// withServedMetrics 统计 /files/ 的下载字节数与状态码。
+func withServedMetrics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &statusRecorderB{ResponseWriter: w}
+		h.ServeHTTP(rw, r)
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+		metricServedBytes.Add(float64(rw.bytes))
+		metricServedRequests.WithLabelValues(strconv.Itoa(rw.status)).Inc()
+	})
+}
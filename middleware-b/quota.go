@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QuotaConfig 为每个上传者的配额与速率限制，上传者按 token（配置了 upload_tokens 时）或来源 IP 区分；
+// 取值为 0 表示不限制。
+type QuotaConfig struct {
+	// BytesPerDayMB / FilesPerDay 每个自然日（本地时间）允许存储的字节数（MB）与文件数，
+	// 去重命中的上传不计入
+	BytesPerDayMB int `json:"bytes_per_day_mb"`
+	FilesPerDay   int `json:"files_per_day"`
+	// RatePerMinute 每分钟允许的 /upload 请求数，Burst 为允许的突发数（默认同 RatePerMinute）
+	RatePerMinute int `json:"rate_per_minute"`
+	Burst         int `json:"burst"`
+}
+
+// uploaderKey 返回配额使用的上传者标识：token 指纹（仅限已校验的 token）或来源 IP
+func uploaderKey(tokenFP, remoteAddr string) string {
+	if tokenFP != "" {
+		return "token:" + tokenFP
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return "ip:" + host
+}
+
+// uploadTokenValid 以常量时间校验上传请求的 Bearer token
+func uploadTokenValid(authorization string, tokens []string) bool {
+	got, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok {
+		return false
+	}
+	sum := sha256.Sum256([]byte(strings.TrimSpace(got)))
+	match := 0
+	for _, t := range tokens {
+		want := sha256.Sum256([]byte(t))
+		match |= subtle.ConstantTimeCompare(sum[:], want[:])
+	}
+	return match == 1
+}
+
+// maxUploaders 为 uploadLimiter 最多记录的上传者数，超出时先清理过期记录，再淘汰最久未出现的上传者
+const maxUploaders = 4096
+
+// uploadLimiter 记录各上传者的当日用量与请求令牌桶
+type uploadLimiter struct {
+	mu    sync.Mutex
+	users map[string]*uploaderState
+}
+
+type uploaderState struct {
+	day    string // 用量所属日期 2006-01-02
+	bytes  int64
+	files  int
+	tokens float64 // 令牌桶剩余令牌
+	refill time.Time
+	seen   time.Time // 最近一次请求
+}
+
+var limiter = &uploadLimiter{users: map[string]*uploaderState{}}
+
+func (l *uploadLimiter) state(key string, now time.Time) *uploaderState {
+	st := l.users[key]
+	if st == nil {
+		if len(l.users) >= maxUploaders {
+			l.prune(now)
+		}
+		st = &uploaderState{tokens: math.Inf(1)}
+		l.users[key] = st
+	}
+	st.seen = now
+	if day := now.Format(time.DateOnly); st.day != day {
+		st.day, st.bytes, st.files = day, 0, 0
+	}
+	return st
+}
+
+// prune 清理不是当日且令牌桶已满的记录；仍超过 maxUploaders 的 7/8 时按最近请求时间淘汰当日记录，
+// 被淘汰的上传者当日用量重新计算。需持有 l.mu
+func (l *uploadLimiter) prune(now time.Time) {
+	day := now.Format(time.DateOnly)
+	for k, st := range l.users {
+		if st.day != day && now.Sub(st.refill) > time.Minute {
+			delete(l.users, k)
+		}
+	}
+	keep := maxUploaders * 7 / 8
+	if len(l.users) <= keep {
+		return
+	}
+	keys := make([]string, 0, len(l.users))
+	for k := range l.users {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return l.users[keys[i]].seen.Before(l.users[keys[j]].seen) })
+	for _, k := range keys[:len(keys)-keep] {
+		delete(l.users, k)
+	}
+}
+
+// untilMidnight 返回距下一个本地自然日开始的时长
+func untilMidnight(now time.Time) time.Duration {
+	y, m, d := now.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, now.Location()).Sub(now)
+}
+
+// reserve 检查速率与当日配额并预占一个文件与 size 字节；被拒绝时返回需等待的时长与原因（rate 或 quota）。
+// 预占成功后须调用 settle。
+func (l *uploadLimiter) reserve(key string, q QuotaConfig, size int64, now time.Time) (time.Duration, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st := l.state(key, now)
+	if q.RatePerMinute > 0 {
+		burst := float64(q.Burst)
+		if burst <= 0 {
+			burst = float64(q.RatePerMinute)
+		}
+		perSec := float64(q.RatePerMinute) / 60
+		st.tokens = math.Min(burst, st.tokens+now.Sub(st.refill).Seconds()*perSec)
+		st.refill = now
+		if st.tokens < 1 {
+			return time.Duration((1 - st.tokens) / perSec * float64(time.Second)), "rate"
+		}
+		st.tokens--
+	}
+	if (q.FilesPerDay > 0 && st.files+1 > q.FilesPerDay) ||
+		(q.BytesPerDayMB > 0 && st.bytes+size > int64(q.BytesPerDayMB)<<20) {
+		return untilMidnight(now), "quota"
+	}
+	st.files++
+	st.bytes += size
+	return 0, ""
+}
+
+// settle 结算预占：stored 为 false（校验失败、去重命中等）时退还，否则按实际大小修正
+func (l *uploadLimiter) settle(key string, reserved, actual int64, stored bool, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st := l.state(key, now)
+	if !stored {
+		st.files = max(st.files-1, 0)
+		st.bytes = max(st.bytes-reserved, 0)
+		return
+	}
+	st.bytes += actual - reserved
+}
+
+// seed 按索引中当日上传的文件恢复用量，避免重启后配额被重置；byToken 同 /upload 是否按 token 区分。
+// 去重产生的记录在上传时已退还配额，不计入。
+func (l *uploadLimiter) seed(recs []fileRecord, byToken bool, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	day := now.Format(time.DateOnly)
+	for _, rec := range recs {
+		if rec.Dedup || rec.UploadedAt.Local().Format(time.DateOnly) != day {
+			continue
+		}
+		var fp string
+		if byToken {
+			fp = rec.TokenID
+		}
+		st := l.state(uploaderKey(fp, rec.Remote), now)
+		st.files++
+		st.bytes += rec.Size
+	}
+}
+
+// writeTooManyRequests 返回 429 与 Retry-After（向上取整到秒）
+func writeTooManyRequests(w http.ResponseWriter, wait time.Duration, msg string) {
+	w.Header().Set("Retry-After", formatRetryAfter(wait))
+	http.Error(w, msg, http.StatusTooManyRequests)
+}
+
+func formatRetryAfter(wait time.Duration) string {
+	secs := int64(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.FormatInt(secs, 10)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestLimiter() *uploadLimiter {
+	return &uploadLimiter{users: map[string]*uploaderState{}}
+}
+
+func TestUploadLimiterReserve(t *testing.T) {
+	// 23:59:00 起步，便于覆盖跨日
+	base := time.Date(2026, 3, 1, 23, 59, 0, 0, time.Local)
+	type step struct {
+		at     time.Duration // 相对 base
+		size   int64
+		reason string
+	}
+	tests := []struct {
+		name  string
+		q     QuotaConfig
+		steps []step
+	}{
+		{"不限制", QuotaConfig{}, []step{{0, 1 << 30, ""}, {0, 1 << 30, ""}, {0, 1 << 30, ""}}},
+		{"速率与突发", QuotaConfig{RatePerMinute: 60, Burst: 2}, []step{
+			{0, 1, ""}, {0, 1, ""}, {0, 1, "rate"}, {time.Second, 1, ""}, {time.Second, 1, "rate"},
+		}},
+		{"突发默认等于速率", QuotaConfig{RatePerMinute: 2}, []step{{0, 1, ""}, {0, 1, ""}, {0, 1, "rate"}, {30 * time.Second, 1, ""}}},
+		{"每日文件数与跨日", QuotaConfig{FilesPerDay: 2}, []step{
+			{0, 1, ""}, {0, 1, ""}, {30 * time.Second, 1, "quota"}, {time.Minute, 1, ""}, {time.Minute, 1, ""}, {time.Minute, 1, "quota"},
+		}},
+		{"每日字节数", QuotaConfig{BytesPerDayMB: 1}, []step{
+			{0, 600 << 10, ""}, {0, 600 << 10, "quota"}, {0, 424 << 10, ""}, {0, 1, "quota"}, {2 * time.Minute, 1 << 20, ""},
+		}},
+		{"被限流的请求不占用配额", QuotaConfig{RatePerMinute: 60, Burst: 1, FilesPerDay: 2}, []step{
+			{0, 1, ""}, {0, 1, "rate"}, {time.Second, 1, ""}, {2 * time.Second, 1, "quota"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLimiter()
+			for i, s := range tt.steps {
+				now := base.Add(s.at)
+				wait, reason := l.reserve("ip:127.0.0.1", tt.q, s.size, now)
+				if reason != s.reason {
+					t.Fatalf("第 %d 步 reason = %q，期望 %q", i+1, reason, s.reason)
+				}
+				switch reason {
+				case "":
+					l.settle("ip:127.0.0.1", s.size, s.size, true, now)
+				case "quota":
+					if wait != untilMidnight(now) {
+						t.Errorf("第 %d 步 wait = %v，期望到次日零点 %v", i+1, wait, untilMidnight(now))
+					}
+				case "rate":
+					if wait <= 0 || wait > time.Minute/time.Duration(tt.q.RatePerMinute) {
+						t.Errorf("第 %d 步 wait = %v", i+1, wait)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestUploadLimiterSettle(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.Local)
+	q := QuotaConfig{BytesPerDayMB: 1, FilesPerDay: 2}
+	tests := []struct {
+		name     string
+		reserved int64
+		actual   int64
+		stored   bool
+		next     int64 // 结算后再预占的大小
+		reason   string
+	}{
+		{"按实际大小修正", 1 << 20, 100 << 10, true, 900 << 10, ""},
+		{"实际大小超出预占", 0, 1 << 20, true, 1, "quota"},
+		{"未存储时退还字节", 1 << 20, 0, false, 1 << 20, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLimiter()
+			if _, reason := l.reserve("k", q, tt.reserved, now); reason != "" {
+				t.Fatalf("预占被拒绝: %s", reason)
+			}
+			l.settle("k", tt.reserved, tt.actual, tt.stored, now)
+			if _, reason := l.reserve("k", q, tt.next, now); reason != tt.reason {
+				t.Errorf("reason = %q，期望 %q", reason, tt.reason)
+			}
+		})
+	}
+
+	// 未存储的上传退还文件数
+	l := newTestLimiter()
+	q = QuotaConfig{FilesPerDay: 1}
+	for i := 0; i < 3; i++ {
+		if _, reason := l.reserve("k", q, 0, now); reason != "" {
+			t.Fatalf("第 %d 次预占被拒绝: %s", i+1, reason)
+		}
+		l.settle("k", 0, 0, false, now)
+	}
+}
+
+func TestUploadLimiterSeed(t *testing.T) {
+	now := time.Date(2026, 3, 2, 9, 0, 0, 0, time.Local)
+	rec := func(at time.Time, token, remote string, size int64) fileRecord {
+		return fileRecord{fileMeta: fileMeta{UploadedAt: at, TokenID: token, Remote: remote, Size: size}}
+	}
+	recs := []fileRecord{
+		rec(now.Add(-time.Hour), "t1", "10.0.0.1:5000", 400<<10),
+		rec(now.Add(-2*time.Hour), "t1", "10.0.0.2:5001", 400<<10),
+		rec(now.Add(-10*time.Hour), "t1", "10.0.0.1:5002", 1<<20), // 前一天
+		rec(now.Add(-time.Minute), "", "10.0.0.3:5003", 100<<10),
+	}
+	q := QuotaConfig{BytesPerDayMB: 1}
+	tests := []struct {
+		name    string
+		byToken bool
+		key     string
+		size    int64
+		reason  string
+	}{
+		{"按 token 恢复当日用量", true, "token:t1", 300 << 10, "quota"},
+		{"按 token 未超出", true, "token:t1", 200 << 10, ""},
+		{"按 IP 恢复", false, "ip:10.0.0.1", 700 << 10, "quota"},
+		{"按 IP 未超出", false, "ip:10.0.0.1", 600 << 10, ""},
+		{"前一天的上传不计入", false, "ip:10.0.0.2", 600 << 10, ""},
+		{"未配置 upload_tokens 时忽略 token", false, "token:t1", 1 << 20, ""},
+		{"没有 token 的记录按 IP", true, "ip:10.0.0.3", 1000 << 10, "quota"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLimiter()
+			l.seed(recs, tt.byToken, now)
+			if _, reason := l.reserve(tt.key, q, tt.size, now); reason != tt.reason {
+				t.Errorf("reason = %q，期望 %q", reason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestUploadLimiterEvict(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.Local)
+	l := newTestLimiter()
+	q := QuotaConfig{FilesPerDay: 1}
+	for i := 0; i < maxUploaders; i++ {
+		l.reserve(fmt.Sprintf("ip:%d", i), q, 0, now.Add(time.Duration(i)*time.Millisecond))
+	}
+	l.reserve("ip:new", q, 0, now.Add(time.Hour))
+	if n := len(l.users); n > maxUploaders*7/8+1 {
+		t.Fatalf("淘汰后仍有 %d 条记录", n)
+	}
+	if _, ok := l.users["ip:0"]; ok {
+		t.Error("最久未出现的上传者未被淘汰")
+	}
+	last := fmt.Sprintf("ip:%d", maxUploaders-1)
+	if _, ok := l.users[last]; !ok {
+		t.Error("最近出现的上传者被淘汰")
+	}
+	if _, reason := l.reserve(last, q, 0, now.Add(time.Hour)); reason != "quota" {
+		t.Errorf("保留的上传者用量被重置: %q", reason)
+	}
+}
+
+func TestUploaderKey(t *testing.T) {
+	tests := []struct {
+		fp, remote, want string
+	}{
+		{"abc", "10.0.0.1:1234", "token:abc"},
+		{"", "10.0.0.1:1234", "ip:10.0.0.1"},
+		{"", "[::1]:1234", "ip:::1"},
+		{"", "10.0.0.1", "ip:10.0.0.1"},
+	}
+	for _, tt := range tests {
+		if got := uploaderKey(tt.fp, tt.remote); got != tt.want {
+			t.Errorf("uploaderKey(%q, %q) = %q，期望 %q", tt.fp, tt.remote, got, tt.want)
+		}
+	}
+}
+
+func TestUploadTokenValid(t *testing.T) {
+	tokens := []string{"alpha", "beta"}
+	tests := []struct {
+		auth string
+		want bool
+	}{
+		{"Bearer alpha", true},
+		{"Bearer beta ", true},
+		{"Bearer gamma", false},
+		{"alpha", false},
+		{"Bearer ", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := uploadTokenValid(tt.auth, tokens); got != tt.want {
+			t.Errorf("uploadTokenValid(%q) = %v，期望 %v", tt.auth, got, tt.want)
+		}
+	}
+}
+
+// 重启后按索引恢复的用量与运行中的用量一致：去重命中（含硬链接）已退还，不计入
+func TestUploadLimiterSeedMatchesLive(t *testing.T) {
+	cfg, ix := testUploadServer(t, &Config{Quota: QuotaConfig{FilesPerDay: 100}})
+	png := []byte("\x89PNG\r\n\x1a\n-quota")
+	postUpload(t, cfg, "a.png", png)
+	postUpload(t, cfg, "a.png", png)                                   // 文件名相同的去重
+	postUpload(t, cfg, "b.png", png)                                   // 硬链接
+	postUpload(t, cfg, "c.txt", []byte("plain text upload for quota")) // 新文件
+
+	live := limiter.users["ip:127.0.0.1"]
+	if live == nil || live.files != 2 {
+		t.Fatalf("运行中的用量 = %+v，期望 2 个文件", live)
+	}
+	recs, err := ix.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeded := newTestLimiter()
+	seeded.seed(recs, false, time.Now())
+	got := seeded.users["ip:127.0.0.1"]
+	if got == nil || got.files != live.files || got.bytes != live.bytes {
+		t.Errorf("恢复的用量 = %+v，运行中为 files=%d bytes=%d", got, live.files, live.bytes)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingConfig 为 OpenTelemetry 链路追踪配置，endpoint 为空时不导出。
+type TracingConfig struct {
+	// Endpoint OTLP/HTTP 接收地址，如 localhost:4318
+	Endpoint string `json:"endpoint"`
+	// URLPath 默认 /v1/traces
+	URLPath  string            `json:"url_path"`
+	Insecure bool              `json:"insecure"`
+	Headers  map[string]string `json:"headers"`
+	// ServiceName 默认 middleware-b
+	ServiceName string `json:"service_name"`
+	// SampleRatio 采样比例 0~1，默认 1
+	SampleRatio float64 `json:"sample_ratio"`
+}
+
+var tracer = otel.Tracer("middleware-b")
+
+// initTracing 按配置创建 OTLP 导出器并注册全局 TracerProvider 与 W3C trace context 传播器。
+// 返回的函数在退出前调用以刷新未导出的 span。
+func initTracing(tc TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if tc.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(tc.Endpoint)}
+	if tc.URLPath != "" {
+		opts = append(opts, otlptracehttp.WithURLPath(tc.URLPath))
+	}
+	if tc.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if len(tc.Headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(tc.Headers))
+	}
+	exp, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("otlp exporter: %w", err)
+	}
+	tp := newTracerProvider(tc, sdktrace.WithBatcher(exp))
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// newTracerProvider 创建 TracerProvider；span 处理器由调用方提供，
+// 测试时可传入 sdktrace.WithSyncer(tracetest.NewInMemoryExporter()) 在进程内收集 span。
+func newTracerProvider(tc TracingConfig, processor sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	name := tc.ServiceName
+	if name == "" {
+		name = "middleware-b"
+	}
+	ratio := tc.SampleRatio
+	if ratio <= 0 || ratio > 1 {
+		ratio = 1
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", name)))
+	if err != nil {
+		res = resource.NewSchemaless(attribute.String("service.name", name))
+	}
+	return sdktrace.NewTracerProvider(
+		processor,
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+}
+
+// withTracingB 从请求头提取 A 传来的 trace context 并创建服务端 span，供处理函数创建子 span。
+func withTracingB(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("http.request.method", r.Method), attribute.String("url.path", r.URL.Path),
+				attribute.String("request.id", requestIDFrom(r.Context()))))
+		defer span.End()
+		rw := &statusRecorderB{ResponseWriter: w}
+		h.ServeHTTP(rw, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.response.status_code", rw.status))
+		if rw.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rw.status))
+		}
+	})
+}
+
+// endSpan 结束 span，err 非空时标记为失败。
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// shutdownTracing 在限定时间内刷新并关闭导出器
+func shutdownTracing(shutdown func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		loggerB.Warn("关闭链路追踪失败", "err", err)
+	}
+}
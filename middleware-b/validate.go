@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// UploadPolicy 为 /upload 的文件校验规则，文件通过全部检查后才会移入存储目录并返回 URL。
+type UploadPolicy struct {
+	// AllowedTypes 允许的 MIME 类型（按文件内容识别），支持 image/* 形式，为空或 ["*"] 时不限制
+	AllowedTypes []string `json:"allowed_types"`
+	// MaxSizeMB 按 MIME 类型的大小上限（MB），键同 allowed_types，另有 "*" 匹配其余类型；
+	// 精确类型优先于 image/*，负数不限。未配置 "*" 时默认 100
+	MaxSizeMB map[string]int `json:"max_size_mb"`
+	// KeepMetadata 保留图片中的 EXIF / XMP 等元数据，默认去除
+	KeepMetadata bool `json:"keep_metadata"`
+	// AllowExecutables 允许上传可执行文件与脚本，默认拒绝
+	AllowExecutables bool `json:"allow_executables"`
+	// ScanCommand 扫描命令，如 ["clamscan", "--no-summary", "{file}"]；{file} 替换为待扫描文件路径，
+	// 未包含时追加在末尾。退出码 0 为通过，1 为发现威胁，其余视为扫描失败
+	ScanCommand []string `json:"scan_command"`
+	// ScanTimeout 扫描超时（秒），默认 60
+	ScanTimeout int `json:"scan_timeout"`
+}
+
+const defaultUploadMaxSizeMB = 100
+
+// uploadRejection 为未通过校验的上传，status 与 reason 分别用于响应码与失败指标。
+type uploadRejection struct {
+	status int
+	reason string
+	msg    string
+}
+
+func (e *uploadRejection) Error() string { return e.msg }
+
+func reject(status int, reason, format string, args ...any) error {
+	return &uploadRejection{status: status, reason: reason, msg: fmt.Sprintf(format, args...)}
+}
+
+func (pol *UploadPolicy) prepare() error {
+	sizes := map[string]int{"*": defaultUploadMaxSizeMB}
+	for k, mb := range pol.MaxSizeMB {
+		k = strings.ToLower(strings.TrimSpace(k))
+		if k != "*" && !strings.Contains(k, "/") {
+			return fmt.Errorf("upload.max_size_mb: 无效的类型 %q", k)
+		}
+		sizes[k] = mb
+	}
+	pol.MaxSizeMB = sizes
+	if len(pol.AllowedTypes) == 0 {
+		pol.AllowedTypes = []string{"*"}
+	}
+	for _, t := range pol.AllowedTypes {
+		if t != "*" && !strings.Contains(t, "/") {
+			return fmt.Errorf("upload.allowed_types: 无效的类型 %q", t)
+		}
+	}
+	if pol.ScanTimeout <= 0 {
+		pol.ScanTimeout = 60
+	}
+	return nil
+}
+
+// mimeMatches 判断 mime 是否匹配 pattern（精确类型、type/* 或 *）
+func mimeMatches(pattern, mime string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if pattern == "*" || pattern == "*/*" || pattern == mime {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(mime, prefix+"/")
+	}
+	return false
+}
+
+func (pol *UploadPolicy) typeAllowed(mime string) bool {
+	for _, t := range pol.AllowedTypes {
+		if mimeMatches(t, mime) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxSize 返回 mime 对应的大小上限（字节），0 表示不限
+func (pol *UploadPolicy) maxSize(mime string) int64 {
+	mb, ok := pol.MaxSizeMB[mime]
+	if !ok {
+		if mb, ok = pol.MaxSizeMB[strings.SplitN(mime, "/", 2)[0]+"/*"]; !ok {
+			mb = pol.MaxSizeMB["*"]
+		}
+	}
+	if mb < 0 {
+		return 0
+	}
+	return int64(mb) << 20
+}
+
+// bodyLimit 返回请求体允许的最大字节数（各类型上限中的最大值加表单开销），0 表示不限
+func (pol *UploadPolicy) bodyLimit() int64 {
+	var max int64
+	for _, mb := range pol.MaxSizeMB {
+		if mb < 0 {
+			return 0
+		}
+		if n := int64(mb) << 20; n > max {
+			max = n
+		}
+	}
+	return max + 1<<20
+}
+
+// executableExts 为按扩展名拒绝的可执行文件与脚本
+var executableExts = map[string]bool{
+	".exe": true, ".dll": true, ".scr": true, ".com": true, ".msi": true, ".cpl": true,
+	".bat": true, ".cmd": true, ".ps1": true, ".vbs": true, ".vbe": true, ".wsf": true, ".hta": true,
+	".sh": true, ".jar": true, ".apk": true, ".elf": true, ".so": true, ".dylib": true,
+}
+
+// isExecutable 按文件头（PE、ELF、Mach-O、#! 脚本）与扩展名识别可执行文件；
+// #!AMR、#!SILK 等语音文件头不以 / 开头，不视为脚本
+func isExecutable(head []byte, name string) bool {
+	switch {
+	case bytes.HasPrefix(head, []byte("MZ")),
+		bytes.HasPrefix(head, []byte("\x7fELF")),
+		bytes.HasPrefix(head, []byte("#!/")), bytes.HasPrefix(head, []byte("#! /")),
+		bytes.HasPrefix(head, []byte{0xfe, 0xed, 0xfa, 0xce}), bytes.HasPrefix(head, []byte{0xfe, 0xed, 0xfa, 0xcf}),
+		bytes.HasPrefix(head, []byte{0xce, 0xfa, 0xed, 0xfe}), bytes.HasPrefix(head, []byte{0xcf, 0xfa, 0xed, 0xfe}),
+		bytes.HasPrefix(head, []byte{0xca, 0xfe, 0xba, 0xbe}):
+		return true
+	}
+	return executableExts[strings.ToLower(path.Ext(name))]
+}
+
+// checkedUpload 为通过校验的上传：ContentType 含 charset 等参数，用于 /files/ 的响应头
+type checkedUpload struct {
+	ContentType string
+	Size        int64
+	SHA256      string
+}
+
+// detectContentType 在 http.DetectContentType 的基础上识别 QQ 常用的 AMR 与 SILK 语音，
+// 以及 http.DetectContentType 只认 mp4 品牌的 ISO 媒体文件（isom、avc1、qt 等）
+func detectContentType(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("#!AMR")):
+		return "audio/amr"
+	case bytes.HasPrefix(head, []byte("#!SILK")), bytes.HasPrefix(head, []byte("\x02#!SILK")):
+		return "audio/silk"
+	}
+	ct := http.DetectContentType(head)
+	if ct == "application/octet-stream" && len(head) >= 12 && string(head[4:8]) == "ftyp" {
+		switch string(head[8:12]) {
+		case "qt  ":
+			return "video/quicktime"
+		case "M4A ", "M4B ":
+			return "audio/mp4"
+		case "heic", "heix", "mif1":
+			return "image/heic"
+		}
+		return "video/mp4"
+	}
+	return ct
+}
+
+// check 对已写入临时文件 p 的上传依次执行类型、大小、可执行文件检查，去除图片元数据并调用扫描命令；
+// 未通过时返回 *uploadRejection。
+func (pol *UploadPolicy) check(ctx context.Context, p, name string, size int64) (checkedUpload, error) {
+	head, err := readHead(p, 512)
+	if err != nil {
+		return checkedUpload{}, err
+	}
+	res := checkedUpload{ContentType: detectContentType(head), Size: size}
+	mime := strings.TrimSpace(strings.SplitN(res.ContentType, ";", 2)[0])
+	if !pol.AllowExecutables && isExecutable(head, name) {
+		return res, reject(http.StatusUnprocessableEntity, "executable", "executable files are not allowed")
+	}
+	if !pol.typeAllowed(mime) {
+		return res, reject(http.StatusUnsupportedMediaType, "type", "content type %s is not allowed", mime)
+	}
+	if limit := pol.maxSize(mime); limit > 0 && size > limit {
+		return res, reject(http.StatusRequestEntityTooLarge, "too_large", "%s exceeds %d MB limit", mime, limit>>20)
+	}
+	if !pol.KeepMetadata && metadataTypes[mime] {
+		// 只有需要去除元数据的图片整个读入内存
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return res, err
+		}
+		stripped, changed, err := stripImageMetadata(data, mime)
+		if err != nil {
+			loggerB.Warn("去除图片元数据失败，保留原文件", "err", err, "name", name)
+		} else if changed {
+			if err := os.WriteFile(p, stripped, 0o644); err != nil {
+				return res, err
+			}
+			res.Size = int64(len(stripped))
+		}
+	}
+	if len(pol.ScanCommand) > 0 {
+		if err := pol.scan(ctx, p); err != nil {
+			return res, err
+		}
+	}
+	if res.SHA256, err = fileSHA256(p); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// readHead 读取文件开头至多 n 字节，用于识别类型
+func readHead(p string, n int) ([]byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	head := make([]byte, n)
+	got, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return head[:got], nil
+}
+
+// fileSHA256 以流的方式计算文件的 SHA-256
+func fileSHA256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// scan 以待扫描文件路径调用 scan_command
+func (pol *UploadPolicy) scan(ctx context.Context, p string) error {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return err
+	}
+	args := make([]string, 0, len(pol.ScanCommand)+1)
+	replaced := false
+	for _, a := range pol.ScanCommand {
+		if strings.Contains(a, "{file}") {
+			a = strings.ReplaceAll(a, "{file}", abs)
+			replaced = true
+		}
+		args = append(args, a)
+	}
+	if !replaced {
+		args = append(args, abs)
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(pol.ScanTimeout)*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	detail := strings.TrimSpace(string(out))
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		loggerB.Warn("扫描发现威胁，拒绝上传", "output", detail)
+		return reject(http.StatusUnprocessableEntity, "infected", "file rejected by scanner")
+	}
+	// 扫描命令本身的故障不应让 a 重试或切换节点（a 把 5xx 视为暂时不可用），按拒绝处理
+	loggerB.Error("扫描命令执行失败", "err", err, "output", detail)
+	return reject(http.StatusUnprocessableEntity, "scan_error", "scanner unavailable")
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsExecutable(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+		file string
+		want bool
+	}{
+		{"PE", "MZ\x90\x00", "a.png", true},
+		{"ELF", "\x7fELF\x02\x01", "a", true},
+		{"shebang", "#!/bin/sh\necho", "run", true},
+		{"带空格的 shebang", "#! /usr/bin/env python", "a.txt", true},
+		{"Mach-O", "\xcf\xfa\xed\xfe\x07", "a", true},
+		{"Mach-O 通用二进制", "\xca\xfe\xba\xbe", "a", true},
+		{"AMR 语音", "#!AMR\n", "voice.amr", false},
+		{"SILK 语音", "#!SILK_V3", "voice.silk", false},
+		{"带前缀字节的 SILK", "\x02#!SILK_V3", "voice.silk", false},
+		{"PNG", "\x89PNG\r\n\x1a\n", "a.png", false},
+		{"按扩展名", "plain text", "install.BAT", true},
+		{"按扩展名 apk", "PK\x03\x04", "app.apk", true},
+		{"zip 不按内容拒绝", "PK\x03\x04", "a.zip", false},
+		{"没有扩展名", "hello", "README", false},
+	}
+	for _, tt := range tests {
+		if got := isExecutable([]byte(tt.head), tt.file); got != tt.want {
+			t.Errorf("%s: isExecutable(%q, %q) = %v，期望 %v", tt.name, tt.head, tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+		want string
+	}{
+		{"AMR", "#!AMR\n\x3c", "audio/amr"},
+		{"AMR-WB", "#!AMR-WB\n", "audio/amr"},
+		{"SILK", "#!SILK_V3\x0c", "audio/silk"},
+		{"QQ 语音的 SILK", "\x02#!SILK_V3", "audio/silk"},
+		{"PNG", "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", "image/png"},
+		{"mp4 品牌", "\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom", "video/mp4"},
+		{"isom 品牌", "\x00\x00\x00\x20ftypisom\x00\x00\x02\x00isomiso2", "video/mp4"},
+		{"QuickTime", "\x00\x00\x00\x14ftypqt  \x00\x00\x02\x00qt  ", "video/quicktime"},
+		{"M4A", "\x00\x00\x00\x1cftypM4A \x00\x00\x00\x00M4A isom", "audio/mp4"},
+		{"HEIC", "\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic", "image/heic"},
+		{"shebang 不是语音", "#!/bin/sh\necho hi\n", "text/plain; charset=utf-8"},
+		{"HTML", "<!DOCTYPE html><html>", "text/html; charset=utf-8"},
+		{"过短的 ftyp", "\x00\x00\x00\x08ftyp", "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		if got := detectContentType([]byte(tt.head)); got != tt.want {
+			t.Errorf("%s: detectContentType = %q，期望 %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUploadPolicyTypes(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		mime    string
+		want    bool
+	}{
+		{"未配置时不限制图片", nil, "image/png", true},
+		{"未配置时不限制文档", nil, "application/pdf", true},
+		{"未配置时不限制压缩包", nil, "application/zip", true},
+		{"空列表不限制", []string{}, "text/plain", true},
+		{"* 不限制", []string{"*"}, "text/html", true},
+		{"只允许媒体时拒绝文档", []string{"image/*", "audio/*", "video/*"}, "application/pdf", false},
+		{"只允许媒体时允许语音", []string{"image/*", "audio/*", "video/*"}, "audio/amr", true},
+		{"精确类型", []string{"image/png"}, "image/png", true},
+		{"精确类型不匹配", []string{"image/png"}, "image/jpeg", false},
+		{"type/* 大小写与空白", []string{" Image/* "}, "image/gif", true},
+		{"type/* 不匹配前缀相同的类型", []string{"image/*"}, "imagex/png", false},
+	}
+	for _, tt := range tests {
+		pol := &UploadPolicy{AllowedTypes: tt.allowed}
+		if err := pol.prepare(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := pol.typeAllowed(tt.mime); got != tt.want {
+			t.Errorf("%s: typeAllowed(%q) = %v，期望 %v", tt.name, tt.mime, got, tt.want)
+		}
+	}
+
+	for _, bad := range [][]string{{"image"}, {"image/*", "png"}} {
+		if err := (&UploadPolicy{AllowedTypes: bad}).prepare(); err == nil {
+			t.Errorf("allowed_types %q 应校验失败", bad)
+		}
+	}
+}
+
+func TestUploadPolicyMaxSize(t *testing.T) {
+	pol := &UploadPolicy{MaxSizeMB: map[string]int{"image/*": 10, "image/gif": 2, "video/*": -1}}
+	if err := pol.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		mime string
+		want int64
+	}{
+		{"image/gif", 2 << 20},
+		{"image/png", 10 << 20},
+		{"audio/amr", defaultUploadMaxSizeMB << 20},
+		{"video/mp4", 0},
+	}
+	for _, tt := range tests {
+		if got := pol.maxSize(tt.mime); got != tt.want {
+			t.Errorf("maxSize(%q) = %d，期望 %d", tt.mime, got, tt.want)
+		}
+	}
+	if got := pol.bodyLimit(); got != 0 {
+		t.Errorf("存在不限大小的类型时 bodyLimit = %d，期望 0", got)
+	}
+	if err := (&UploadPolicy{MaxSizeMB: map[string]int{"png": 1}}).prepare(); err == nil {
+		t.Error("max_size_mb 无效的键应校验失败")
+	}
+}
+
+func TestUploadPolicyCheck(t *testing.T) {
+	png := join(pngSignature, pngChunk("IHDR", "\x00\x00\x00\x01\x00\x00\x00\x01\x08\x02\x00\x00\x00"), pngChunk("IDAT", "pixels"), pngChunk("IEND", ""))
+	pngWithText := join(png[:len(png)-12], pngChunk("tEXt", "Author\x00me"), png[len(png)-12:])
+	video := append([]byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"), bytes.Repeat([]byte{0xab}, 2<<20)...)
+	tests := []struct {
+		name   string
+		pol    UploadPolicy
+		file   string
+		data   []byte
+		want   []byte // 检查后文件的内容
+		ct     string
+		status int
+		reason string
+	}{
+		{"去除元数据后按新内容计算大小与哈希", UploadPolicy{}, "a.png", pngWithText, png, "image/png", 0, ""},
+		{"保留元数据", UploadPolicy{KeepMetadata: true}, "a.png", pngWithText, pngWithText, "image/png", 0, ""},
+		{"大文件流式计算哈希", UploadPolicy{}, "v.mp4", video, video, "video/mp4", 0, ""},
+		{"空文件", UploadPolicy{}, "empty.txt", nil, nil, "text/plain; charset=utf-8", 0, ""},
+		{"可执行文件", UploadPolicy{}, "run", []byte("#!/bin/sh\n"), nil, "", http.StatusUnprocessableEntity, "executable"},
+		{"类型不允许", UploadPolicy{AllowedTypes: []string{"image/*"}}, "v.mp4", video, nil, "", http.StatusUnsupportedMediaType, "type"},
+		{"超过大小上限", UploadPolicy{MaxSizeMB: map[string]int{"video/*": 1}}, "v.mp4", video, nil, "", http.StatusRequestEntityTooLarge, "too_large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "upload")
+			if err := os.WriteFile(p, tt.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			pol := tt.pol
+			if err := pol.prepare(); err != nil {
+				t.Fatal(err)
+			}
+			res, err := pol.check(context.Background(), p, tt.file, int64(len(tt.data)))
+			if tt.status != 0 {
+				var rej *uploadRejection
+				if !errors.As(err, &rej) || rej.status != tt.status || rej.reason != tt.reason {
+					t.Fatalf("err = %v，期望 %d %s", err, tt.status, tt.reason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := os.ReadFile(p)
+			sum := sha256.Sum256(tt.want)
+			if !bytes.Equal(got, tt.want) || res.Size != int64(len(tt.want)) || res.SHA256 != hex.EncodeToString(sum[:]) || res.ContentType != tt.ct {
+				t.Errorf("check = %+v，文件 %d 字节，期望 %d 字节、类型 %s", res, len(got), len(tt.want), tt.ct)
+			}
+		})
+	}
+}
+
+// 扫描失败按拒绝处理（422），不返回会让 a 重试、熔断的 5xx
+func TestUploadPolicyScan(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("需要 /bin/sh")
+	}
+	tests := []struct {
+		name   string
+		cmd    []string
+		status int
+		reason string
+	}{
+		{"通过", []string{"/bin/sh", "-c", "exit 0"}, 0, ""},
+		{"发现威胁", []string{"/bin/sh", "-c", "echo FOUND; exit 1"}, http.StatusUnprocessableEntity, "infected"},
+		{"扫描命令出错", []string{"/bin/sh", "-c", "exit 2"}, http.StatusUnprocessableEntity, "scan_error"},
+		{"扫描命令不存在", []string{"/nonexistent/clamscan"}, http.StatusUnprocessableEntity, "scan_error"},
+		{"文件路径替换", []string{"/bin/sh", "-c", `test -f "$0"`, "{file}"}, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "upload")
+			if err := os.WriteFile(p, []byte("hello"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			pol := UploadPolicy{ScanCommand: tt.cmd}
+			if err := pol.prepare(); err != nil {
+				t.Fatal(err)
+			}
+			_, err := pol.check(context.Background(), p, "a.txt", 5)
+			var rej *uploadRejection
+			if tt.status == 0 {
+				if err != nil {
+					t.Fatalf("err = %v", err)
+				}
+				return
+			}
+			if !errors.As(err, &rej) || rej.status != tt.status || rej.reason != tt.reason {
+				t.Fatalf("err = %v，期望 %d %s", err, tt.status, tt.reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+)
+
+// registerAdminHandlers 在配置了 admin_token 时注册 /admin/ 管理接口。
+func registerAdminHandlers(cfg *Config) {
+	if cfg.AdminToken == "" {
+		return
+	}
+	http.HandleFunc("GET /admin/sessions", withAdminAuth(cfg.AdminToken, func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, map[string]any{"sessions": listSessions()})
+	}))
+	http.HandleFunc("POST /admin/sessions/{id}/close", withAdminAuth(cfg.AdminToken, func(w http.ResponseWriter, r *http.Request) {
+		sess := lookupSession(r.PathValue("id"))
+		if sess == nil {
+			writeAdminJSON(w, http.StatusNotFound, map[string]string{"error": "session not found"})
+			return
+		}
+		loggerC.Info("管理接口关闭会话", "session", sess.id, "remote", r.RemoteAddr)
+		sess.close("closed by admin")
+		writeAdminJSON(w, http.StatusOK, map[string]string{"status": "closed", "id": sess.id})
+	}))
+	http.HandleFunc("POST /admin/sessions/{id}/reconnect", withAdminAuth(cfg.AdminToken, func(w http.ResponseWriter, r *http.Request) {
+		sess := lookupSession(r.PathValue("id"))
+		if sess == nil {
+			writeAdminJSON(w, http.StatusNotFound, map[string]string{"error": "session not found"})
+			return
+		}
+		if err := sess.reconnectUpstream(); err != nil {
+			loggerC.Error("管理接口重连协议端失败", "session", sess.id, "err", err)
+			writeAdminJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+			return
+		}
+		loggerC.Info("管理接口重连协议端", "session", sess.id, "remote", r.RemoteAddr)
+		writeAdminJSON(w, http.StatusOK, sess.info())
+	}))
+}
+
+// withAdminAuth 校验 Authorization: Bearer <admin_token>
+func withAdminAuth(token string, h http.HandlerFunc) http.HandlerFunc {
+	expected := []byte("Bearer " + token)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			loggerC.Warn("管理接口未授权访问", "remote", r.RemoteAddr, "path", r.URL.Path)
+			writeAdminJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		h(w, r)
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
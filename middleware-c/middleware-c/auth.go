@@ -0,0 +1,154 @@
+// 共享文件：与其他模块中的同名文件保持一致，以 middleware-a 中的为准。
+// 修改后运行 scripts/shared-files.sh sync 同步，CI 中由 scripts/shared-files.sh check 检查。
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverTokens 返回海豹连接时可使用的全部 token，为空表示不鉴权。
+// 配置多个 token 便于轮换：先加入新 token，海豹全部切换后再移除旧的。
+func (cfg *Config) serverTokens() []string {
+	var out []string
+	for _, t := range append([]string{cfg.ServerAccessToken}, cfg.ServerAccessTokens...) {
+		if t = strings.TrimSpace(t); t != "" {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// requestToken 取出连接携带的 token：Authorization 头（Bearer 或 Token），其次为 access_token 查询参数。
+func requestToken(r *http.Request) string {
+	if auth := strings.TrimSpace(r.Header.Get("Authorization")); auth != "" {
+		for _, prefix := range []string{"Bearer ", "Token "} {
+			if len(auth) > len(prefix) && strings.EqualFold(auth[:len(prefix)], prefix) {
+				return strings.TrimSpace(auth[len(prefix):])
+			}
+		}
+		return ""
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// tokenMatches 以常量时间逐一比较全部 token；先取摘要使比较耗时与 token 长度无关。
+func tokenMatches(got string, tokens []string) bool {
+	if got == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(got))
+	ok := 0
+	for _, t := range tokens {
+		want := sha256.Sum256([]byte(t))
+		ok |= subtle.ConstantTimeCompare(sum[:], want[:])
+	}
+	return ok == 1
+}
+
+// authGuard 按来源 IP 统计鉴权失败，窗口内失败次数达到上限后临时封禁。
+type authGuard struct {
+	mu      sync.Mutex
+	clients map[string]*authState
+}
+
+type authState struct {
+	failures    int
+	windowStart time.Time
+	bannedUntil time.Time
+}
+
+var serverAuthGuard = &authGuard{clients: map[string]*authState{}}
+
+// bannedFor 返回 ip 剩余的封禁时长，未封禁时为 0
+func (g *authGuard) bannedFor(ip string, now time.Time) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if st := g.clients[ip]; st != nil && now.Before(st.bannedUntil) {
+		return st.bannedUntil.Sub(now)
+	}
+	return 0
+}
+
+// fail 记录一次失败，达到上限时开始封禁并返回 true；maxFailures 为负数时只记录不封禁。
+func (g *authGuard) fail(ip string, maxFailures int, window, ban time.Duration, now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.clients) > 4096 {
+		g.prune(now, window)
+	}
+	st := g.clients[ip]
+	if st == nil || now.Sub(st.windowStart) > window {
+		st = &authState{windowStart: now}
+		g.clients[ip] = st
+	}
+	st.failures++
+	if maxFailures <= 0 || st.failures < maxFailures {
+		return false
+	}
+	st.failures = 0
+	st.windowStart = now
+	st.bannedUntil = now.Add(ban)
+	return true
+}
+
+func (g *authGuard) reset(ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.clients, ip)
+}
+
+// prune 清理窗口已过且未被封禁的记录，需持有 g.mu
+func (g *authGuard) prune(now time.Time, window time.Duration) {
+	for ip, st := range g.clients {
+		if now.Sub(st.windowStart) > window && !now.Before(st.bannedUntil) {
+			delete(g.clients, ip)
+		}
+	}
+}
+
+// remoteIP 取连接的来源 IP；不信任 X-Forwarded-For，以免被伪造绕过封禁。
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// authorizeServer 校验海豹连接的 token，失败时写入 401，来源 IP 被封禁时写入 429。
+func authorizeServer(w http.ResponseWriter, r *http.Request, cfg *Config) bool {
+	tokens := cfg.serverTokens()
+	if len(tokens) == 0 {
+		return true
+	}
+	ip := remoteIP(r)
+	now := time.Now()
+	if d := serverAuthGuard.bannedFor(ip, now); d > 0 {
+		cfg.countAuthFailure("banned")
+		w.Header().Set("Retry-After", strconv.Itoa(int((d+time.Second-1)/time.Second)))
+		http.Error(w, "too many failed auth attempts", http.StatusTooManyRequests)
+		return false
+	}
+	if tokenMatches(requestToken(r), tokens) {
+		serverAuthGuard.reset(ip)
+		return true
+	}
+	cfg.countAuthFailure("invalid")
+	window := time.Duration(cfg.AuthFailureWindow) * time.Second
+	ban := time.Duration(cfg.AuthBanSeconds) * time.Second
+	if serverAuthGuard.fail(ip, cfg.AuthMaxFailures, window, ban, now) {
+		loggerC.Warn("鉴权失败次数过多，临时封禁", cfg.logAttrs("ip", ip, "ban_seconds", cfg.AuthBanSeconds)...)
+	} else {
+		loggerC.Warn("未授权访问", cfg.logAttrs("remote", r.RemoteAddr, "path", r.URL.Path)...)
+	}
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
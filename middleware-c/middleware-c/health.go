@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// healthCheckTimeout 为单项就绪检查的超时时间
+const healthCheckTimeout = 5 * time.Second
+
+type checkResult struct {
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+func writeHealth(w http.ResponseWriter, rep healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if rep.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(rep)
+}
+
+// handleHealthz 仅表示进程存活。
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, healthReport{Status: "ok"})
+}
+
+// readyzHandler 检查上游 WS 是否可连接。
+func readyzHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rep := healthReport{Status: "ok", Checks: map[string]checkResult{}}
+		start := time.Now()
+		err := checkUpstream(cfg)
+		res := checkResult{OK: err == nil, Duration: time.Since(start).String()}
+		if err != nil {
+			res.Error = err.Error()
+			rep.Status = "fail"
+		}
+		rep.Checks["upstream"] = res
+		writeHealth(w, rep)
+	}
+}
+
+func checkUpstream(cfg *Config) error {
+	conn, err := dialUpstream(cfg.upstreamDialer(healthCheckTimeout), cfg)
+	if err != nil {
+		return err
+	}
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), timeNowPlus())
+	return conn.Close()
+}
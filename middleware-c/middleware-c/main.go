@@ -1,12 +1,14 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
@@ -18,6 +20,7 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type Config struct {
@@ -27,44 +30,140 @@ type Config struct {
 	UpstreamAccessToken   string `json:"upstream_access_token"`
 	UpstreamUseQueryToken bool   `json:"upstream_use_query_token"`
 	ServerAccessToken     string `json:"server_access_token"`
+	LogLevel              string `json:"log_level"`
+	LogFile               string `json:"log_file"`
+	LogFormat             string `json:"log_format"`
+	LogConsole            bool   `json:"log_console"`
+	// 日志轮转：单文件上限（MB，默认 100，负数不限）、按时间轮转（hourly/daily/weekly）、
+	// 保留的旧文件数（默认 7，负数不限）与天数（0 不限），以及是否 gzip 压缩旧文件
+	LogMaxSizeMB      int    `json:"log_max_size_mb"`
+	LogRotateInterval string `json:"log_rotate_interval"`
+	LogMaxBackups     int    `json:"log_max_backups"`
+	LogMaxAgeDays     int    `json:"log_max_age_days"`
+	LogCompress       bool   `json:"log_compress"`
 	// UploadEndpoint 已弃用：改为全部使用 base64:// 内联，不再上传到外部服务
-	UploadEndpoint        string `json:"upload_endpoint"`
-}
+	UploadEndpoint string `json:"upload_endpoint"`
+	// RewriteRules 追加或覆盖内置的动作改写规则
+	RewriteRules []RewriteRule `json:"rewrite_rules"`
+	// MediaSegmentTypes 需要改写的消息段 / CQ 码类型，留空使用 defaultMediaSegmentTypes
+	MediaSegmentTypes []string `json:"media_segment_types"`
+	// CompatProfile 上游实现：generic、go-cqhttp、napcat、llonebot、lagrange、shamrock
+	CompatProfile string          `json:"compat_profile"`
+	Compat        *CompatOverride `json:"compat"`
+	// AllowedFileRoots 允许读取的本地目录（如海豹的 data/、backups/），消息中引用其他路径的动作会被拒绝；
+	// 为空时不限制
+	AllowedFileRoots []string `json:"allowed_file_roots"`
+	// AdminToken 管理接口 /admin/ 的 Bearer token，为空时不启用管理接口
+	AdminToken string `json:"admin_token"`
+	// ServerAccessTokens 除 server_access_token 外额外接受的 token，便于轮换
+	ServerAccessTokens []string `json:"server_access_tokens"`
+	// 海豹侧鉴权失败限制：同一 IP 在 auth_failure_window 秒内失败 auth_max_failures 次（默认 5，负数不限）后
+	// 封禁 auth_ban_seconds 秒（默认 600）
+	AuthMaxFailures   int `json:"auth_max_failures"`
+	AuthFailureWindow int `json:"auth_failure_window"`
+	AuthBanSeconds    int `json:"auth_ban_seconds"`
+	// AllowedOrigins 允许的浏览器来源（如 https://panel.example.com，"*" 为任意）；为空时只接受同源，
+	// 未携带 Origin 的客户端不受限制
+	AllowedOrigins []string `json:"allowed_origins"`
+	// MaxWSPairs 同时存在的连接对上限，0 为不限制
+	MaxWSPairs int `json:"max_ws_pairs"`
+	// 海豹连接的单条消息上限（MB）：普通消息默认 4，含 base64:// 的消息默认 64；负数不限
+	WSReadLimitMB      int `json:"ws_read_limit_mb"`
+	WSMediaReadLimitMB int `json:"ws_media_read_limit_mb"`
+	// WSUpstreamReadLimitMB 协议端连接的单条消息上限（MB），默认 256，负数不限
+	WSUpstreamReadLimitMB int `json:"ws_upstream_read_limit_mb"`
+	// 两端连接的 ping 间隔与空闲超时（秒），默认 30 与 90，负数不启用
+	WSPingInterval int `json:"ws_ping_interval"`
+	WSIdleTimeout  int `json:"ws_idle_timeout"`
+	// TLS 监听端口的 TLS 配置；证书文件变更自动重新加载
+	TLS ServerTLSConfig `json:"tls"`
+	// UpstreamTLS 连接 wss:// 协议端时的 CA 与客户端证书
+	UpstreamTLS ClientTLSConfig `json:"upstream_tls"`
 
-type oneBotCommand struct {
-	Action string      `json:"action"`
-	Params interface{} `json:"params"`
-	Echo   interface{} `json:"echo"`
+	ruleTable  map[string][]RewriteRule
+	mediaTypes map[string]bool
+	profile    CompatProfile
+	sandbox    *fileSandbox
+
+	upstreamTLS *tls.Config // 由 upstream_tls 生成
 }
 
-type uploadPrivateFileParams struct {
-	UserID int64  `json:"user_id"`
-	File   string `json:"file"`
-	Name   string `json:"name"`
+var (
+	levelVarC = new(slog.LevelVar)
+	loggerC   *slog.Logger
+)
+
+func initLoggerCDefault() {
+	levelVarC.Set(slog.LevelInfo)
+	h := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: levelVarC})
+	loggerC = slog.New(h).With("component", "middleware-c")
+	slog.SetDefault(loggerC)
 }
 
-type uploadGroupFileParams struct {
-	GroupID int64  `json:"group_id"`
-	File    string `json:"file"`
-	Name    string `json:"name"`
+// logAttrs 返回日志属性；c 只有一个路由，不附加路由名，与 a 共用 auth.go 等文件。
+func (cfg *Config) logAttrs(args ...any) []any { return args }
+
+func (cfg *Config) logRotateOptions() logRotateOptions {
+	return logRotateOptions{
+		MaxSizeMB:  cfg.LogMaxSizeMB,
+		Interval:   cfg.LogRotateInterval,
+		MaxBackups: cfg.LogMaxBackups,
+		MaxAgeDays: cfg.LogMaxAgeDays,
+		Compress:   cfg.LogCompress,
+	}
 }
 
-type sendPrivateMsgParams struct {
-	UserID  int64  `json:"user_id"`
-	Message string `json:"message"`
+func initLoggerCFromConfig(cfg *Config) {
+	switch strings.ToLower(strings.TrimSpace(cfg.LogLevel)) {
+	case "debug":
+		levelVarC.Set(slog.LevelDebug)
+	case "warn":
+		levelVarC.Set(slog.LevelWarn)
+	case "error":
+		levelVarC.Set(slog.LevelError)
+	default:
+		levelVarC.Set(slog.LevelInfo)
+	}
+	out := []io.Writer{}
+	if cfg.LogConsole {
+		out = append(out, os.Stdout)
+	}
+	if cfg.LogFile != "" {
+		rf, err := openRotatingFile(cfg.LogFile, cfg.logRotateOptions())
+		if err != nil {
+			loggerC.Error("打开日志文件失败", "err", err, "path", cfg.LogFile)
+		} else {
+			out = append(out, rf)
+			go watchLogReopen(rf)
+		}
+	}
+	var w io.Writer = os.Stdout
+	if len(out) > 0 {
+		w = io.MultiWriter(out...)
+	}
+	var h slog.Handler
+	if strings.ToLower(strings.TrimSpace(cfg.LogFormat)) == "text" {
+		h = slog.NewTextHandler(w, &slog.HandlerOptions{Level: levelVarC})
+	} else {
+		h = slog.NewJSONHandler(w, &slog.HandlerOptions{Level: levelVarC})
+	}
+	loggerC = slog.New(h).With("component", "middleware-c")
+	slog.SetDefault(loggerC)
 }
 
-type sendGroupMsgParams struct {
-	GroupID int64  `json:"group_id"`
-	Message string `json:"message"`
+type oneBotCommand struct {
+	Action string      `json:"action"`
+	Params interface{} `json:"params"`
+	Echo   interface{} `json:"echo"`
 }
 
-// cqMediaKinds are CQ types we rewrite for cross-machine sending
-var cqMediaKinds = map[string]bool{"image": true, "record": true}
+// defaultMediaSegmentTypes are CQ / segment types we rewrite for cross-machine sending,
+// including the file and mface extensions from NapCat / LLOneBot
+var defaultMediaSegmentTypes = []string{"image", "record", "file", "mface"}
 
 // rewriteCQMediaInText scans CQ codes in text and rewrites media file/path/base64 to remote URL
-func rewriteCQMediaInText(s string, cfg *Config) string {
-	re := regexp.MustCompile(`\[CQ:(image|record)([^\]]*)]`)
+func rewriteCQMediaInText(s string, job *rewriteJob) string {
+	re := regexp.MustCompile(`\[CQ:([A-Za-z_]+)([^\]]*)]`)
 	return re.ReplaceAllStringFunc(s, func(seg string) string {
 		// parse key=value pairs
 		m := re.FindStringSubmatch(seg)
@@ -72,6 +171,13 @@ func rewriteCQMediaInText(s string, cfg *Config) string {
 			return seg
 		}
 		kind := m[1]
+		if !job.cfg.isMediaSegment(kind) {
+			return seg
+		}
+		if kind == "file" && !job.cfg.profile.CQFileSupported {
+			loggerC.Warn("上游不支持 CQ:file，保持原样", "profile", job.cfg.CompatProfile)
+			return seg
+		}
 		argsStr := m[2]
 		args := map[string]string{}
 		for _, kv := range strings.Split(strings.TrimLeft(argsStr, ","), ",") {
@@ -98,10 +204,11 @@ func rewriteCQMediaInText(s string, cfg *Config) string {
 			return seg
 		}
 		// 统一改为 base64:// 内联：从本地/路径读取文件并编码
-		b64, name := localFileToBase64URI(file, args["name"])
+		b64, name := localFileToBase64URI(file, args["name"], job)
 		if b64 == "" {
 			return seg
 		}
+		job.countRewrite(kind)
 		args["file"] = escapeCommaMaybe(b64)
 		if name != "" {
 			args["name"] = name
@@ -137,7 +244,7 @@ func rewriteCQMediaInText(s string, cfg *Config) string {
 }
 
 // rewritePictureTagInText converts custom "[图:<path>]" to CQ:image with remote URL
-func rewritePictureTagInText(s string, cfg *Config) string {
+func rewritePictureTagInText(s string, job *rewriteJob) string {
 	re := regexp.MustCompile(`\[图:([^\]]+)]`)
 	return re.ReplaceAllStringFunc(s, func(seg string) string {
 		m := re.FindStringSubmatch(seg)
@@ -146,10 +253,11 @@ func rewritePictureTagInText(s string, cfg *Config) string {
 		}
 		src := strings.TrimSpace(m[1])
 		// 将 [图:路径] 直接转成 base64://
-		b64, _ := localFileToBase64URI(src, "")
+		b64, _ := localFileToBase64URI(src, "", job)
 		if b64 == "" {
 			return seg
 		}
+		job.countRewrite("image")
 		return "[CQ:image,file=" + escapeCommaMaybe(b64) + "]"
 	})
 }
@@ -157,7 +265,8 @@ func rewritePictureTagInText(s string, cfg *Config) string {
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  64 * 1024,
 	WriteBufferSize: 64 * 1024,
-	CheckOrigin:     func(r *http.Request) bool { return true },
+	// 来源在 serveWS 中按 allowed_origins 校验
+	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
 func loadConfig(path string) (*Config, error) {
@@ -177,6 +286,69 @@ func loadConfig(path string) (*Config, error) {
 	if cfg.ListenWSPath == "" {
 		cfg.ListenWSPath = "/ws"
 	}
+	if cfg.LogLevel == "" {
+		cfg.LogLevel = "info"
+	}
+	if cfg.LogFormat == "" {
+		cfg.LogFormat = "json"
+	}
+	if cfg.LogFile == "" {
+		cfg.LogFile = filepath.Join("logs", "middleware-c.log")
+	}
+	if !cfg.LogConsole {
+		cfg.LogConsole = true
+	}
+	if cfg.LogMaxSizeMB == 0 {
+		cfg.LogMaxSizeMB = 100
+	}
+	if cfg.LogMaxBackups == 0 {
+		cfg.LogMaxBackups = 7
+	}
+	if _, err := parseRotateInterval(cfg.LogRotateInterval); err != nil {
+		return nil, err
+	}
+	if cfg.AuthMaxFailures == 0 {
+		cfg.AuthMaxFailures = 5
+	}
+	if cfg.AuthFailureWindow <= 0 {
+		cfg.AuthFailureWindow = 60
+	}
+	if cfg.AuthBanSeconds <= 0 {
+		cfg.AuthBanSeconds = 600
+	}
+	if cfg.WSReadLimitMB == 0 {
+		cfg.WSReadLimitMB = defaultWSReadLimitMB
+	}
+	if cfg.WSMediaReadLimitMB == 0 {
+		cfg.WSMediaReadLimitMB = defaultWSMediaReadLimitMB
+	}
+	if cfg.WSUpstreamReadLimitMB == 0 {
+		cfg.WSUpstreamReadLimitMB = defaultWSUpstreamReadLimitMB
+	}
+	if cfg.WSPingInterval == 0 {
+		cfg.WSPingInterval = defaultWSPingInterval
+	}
+	if cfg.WSIdleTimeout == 0 {
+		cfg.WSIdleTimeout = defaultWSIdleTimeout
+	}
+	if cfg.WSPingInterval > 0 && cfg.WSIdleTimeout > 0 && cfg.WSIdleTimeout <= cfg.WSPingInterval {
+		return nil, fmt.Errorf("ws_idle_timeout (%d) 需大于 ws_ping_interval (%d)", cfg.WSIdleTimeout, cfg.WSPingInterval)
+	}
+	table, err := buildRuleTable(cfg.RewriteRules)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ruleTable = table
+	cfg.mediaTypes = buildMediaTypes(cfg.MediaSegmentTypes)
+	if cfg.profile, err = resolveProfile(cfg.CompatProfile, cfg.Compat); err != nil {
+		return nil, err
+	}
+	if cfg.sandbox, err = newFileSandbox(cfg.AllowedFileRoots); err != nil {
+		return nil, err
+	}
+	if cfg.upstreamTLS, err = cfg.UpstreamTLS.build(); err != nil {
+		return nil, fmt.Errorf("upstream_tls: %w", err)
+	}
 	return &cfg, nil
 }
 
@@ -184,354 +356,219 @@ func main() {
 	var cfgPath string
 	flag.StringVar(&cfgPath, "config", "config.json", "config path")
 	flag.Parse()
+	initLoggerCDefault()
 
 	cfg, err := loadConfig(cfgPath)
 	if err != nil {
-		log.Fatalf("load config: %v", err)
+		loggerC.Error("加载配置失败", "err", err)
+		os.Exit(1)
+	}
+	initLoggerCFromConfig(cfg)
+	if len(cfg.AllowedFileRoots) == 0 {
+		loggerC.Warn("未配置 allowed_file_roots，消息中引用的任意本地文件都会被读取并内联")
 	}
 
 	http.HandleFunc(cfg.ListenWSPath, func(w http.ResponseWriter, r *http.Request) {
-		// 鉴权对接协议端的 access_token
-		if cfg.ServerAccessToken != "" {
-			auth := r.Header.Get("Authorization")
-			expected := "Bearer " + cfg.ServerAccessToken
-			if auth != expected {
-				w.WriteHeader(http.StatusUnauthorized)
-				_, _ = w.Write([]byte("unauthorized"))
-				return
-			}
-		}
-		// 对接到海豹的 Onebot v11 正向 WS 连接
-		clientConn, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			log.Printf("upgrade error: %v", err)
-			return
-		}
+		serveWS(w, r, cfg)
+	})
 
-		// 连接 Onebot V11 协议实现端
-		header := http.Header{}
-		if cfg.UpstreamAccessToken != "" && !cfg.UpstreamUseQueryToken {
-			header.Set("Authorization", "Bearer "+cfg.UpstreamAccessToken)
-		}
-		upstreamURL := cfg.UpstreamWSURL
-		if cfg.UpstreamAccessToken != "" && cfg.UpstreamUseQueryToken {
-			if u, e := url.Parse(upstreamURL); e == nil {
-				q := u.Query()
-				q.Set("access_token", cfg.UpstreamAccessToken)
-				u.RawQuery = q.Encode()
-				upstreamURL = u.String()
-			}
-		}
-		upstreamConn, _, err := websocket.DefaultDialer.Dial(upstreamURL, header)
-		if err != nil {
-			log.Printf("upstream dial error: %v", err)
-			clientConn.Close()
-			return
-		}
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", readyzHandler(cfg))
+	registerAdminHandlers(cfg)
 
-		var wg sync.WaitGroup
-		wg.Add(2)
+	tlsCfg, err := cfg.TLS.build()
+	if err != nil {
+		loggerC.Error("加载 TLS 证书失败", "err", err)
+		os.Exit(1)
+	}
+	loggerC.Info("服务启动", "http", cfg.ListenHTTP, "tls", tlsCfg != nil, "ws_path", cfg.ListenWSPath, "upstream", cfg.UpstreamWSURL)
+	if err := listenAndServe(cfg.ListenHTTP, nil, tlsCfg); err != nil {
+		loggerC.Error("HTTP 服务启动失败", "err", err)
+		os.Exit(1)
+	}
+}
 
-		go func() {
-			defer wg.Done()
-			for {
-				mt, msg, err := clientConn.ReadMessage()
-				if err != nil {
-					_ = upstreamConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), timeNowPlus())
-					return
-				}
-				if mt == websocket.TextMessage {
-					rewritten := rewriteIfUpload(cmdBytes(msg), cfg)
-					msg = rewritten
-				}
-				if err := upstreamConn.WriteMessage(mt, msg); err != nil {
-					return
-				}
-			}
-		}()
-
-		go func() {
-			defer wg.Done()
-			for {
-				mt, msg, err := upstreamConn.ReadMessage()
-				if err != nil {
-					_ = clientConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), timeNowPlus())
-					return
-				}
-				if err := clientConn.WriteMessage(mt, msg); err != nil {
-					return
-				}
-			}
-		}()
+// serveWS 处理一条海豹连接：鉴权、升级并与上游建立双向转发。
+func serveWS(w http.ResponseWriter, r *http.Request, cfg *Config) {
+	// 鉴权海豹携带的 access_token
+	if !authorizeServer(w, r, cfg) {
+		return
+	}
+	if !originAllowed(r, cfg.AllowedOrigins) {
+		metricWSRejected.WithLabelValues("origin").Inc()
+		loggerC.Warn("拒绝来源不在 allowed_origins 中的连接", "origin", r.Header.Get("Origin"), "remote", r.RemoteAddr)
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	if !acquirePair(cfg.MaxWSPairs) {
+		metricWSRejected.WithLabelValues("max_pairs").Inc()
+		loggerC.Warn("连接对数量已达上限", "max_ws_pairs", cfg.MaxWSPairs, "remote", r.RemoteAddr)
+		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+		return
+	}
+	defer releasePair()
+	limits := cfg.wsLimits()
+	// 对接到海豹的 Onebot v11 正向 WS 连接
+	clientConn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		loggerC.Error("WebSocket 升级失败", "err", err, "remote", r.RemoteAddr)
+		return
+	}
+	limits.setup(clientConn)
 
-		wg.Wait()
+	// 连接 Onebot V11 协议实现端
+	upstreamConn, err := dialUpstream(cfg.upstreamDialer(upstreamHandshakeTimeout), cfg)
+	if err != nil {
+		loggerC.Error("连接协议端失败", "err", err, "url", cfg.UpstreamWSURL)
 		clientConn.Close()
-		upstreamConn.Close()
-	})
+		return
+	}
+	upLimits := limits.upstream()
+	upLimits.setup(upstreamConn)
 
-	log.Printf("middleware-a listening on %s%s, proxying to %s", cfg.ListenHTTP, cfg.ListenWSPath, cfg.UpstreamWSURL)
-	if err := http.ListenAndServe(cfg.ListenHTTP, nil); err != nil {
-		log.Fatal(err)
+	sess := &session{
+		id:       newSessionID(),
+		remote:   r.RemoteAddr,
+		started:  time.Now(),
+		cfg:      cfg,
+		client:   clientConn,
+		upstream: upstreamConn,
+		selfID:   strings.TrimSpace(r.Header.Get("X-Self-ID")),
 	}
-}
+	registerSession(sess)
+	defer unregisterSession(sess)
+	loggerC.Info("ws opened", "session", sess.id, "remote", r.RemoteAddr, "upstream", cfg.UpstreamWSURL)
 
-func timeNowPlus() (deadline time.Time) { // minimal helper to satisfy control writes
-	return time.Now().Add(1 * time.Second)
-}
+	metricWSPairs.Inc()
+	defer metricWSPairs.Dec()
 
-func cmdBytes(b []byte) []byte { return b }
+	var wg sync.WaitGroup
+	wg.Add(2)
 
-func rewriteIfUpload(msg []byte, cfg *Config) []byte {
-	var cmd oneBotCommand
-	if err := json.Unmarshal(msg, &cmd); err != nil {
-		return msg
-	}
-	switch cmd.Action {
-	case "send_msg":
-		raw, _ := json.Marshal(cmd.Params)
-		var p map[string]interface{}
-		if json.Unmarshal(raw, &p) == nil {
-			if v, ok := p["message"].(string); ok {
-				nv := rewriteCQMediaInText(v, cfg)
-				nv = rewritePictureTagInText(nv, cfg)
-				if nv != v {
-					p["message"] = nv
-					newCmd := oneBotCommand{Action: "send_msg", Params: p, Echo: cmd.Echo}
-					b, _ := json.Marshal(newCmd)
-					return b
-				}
-			} else if arr, ok := p["message"].([]interface{}); ok {
-				changed := false
-				for i := range arr {
-					el, ok := arr[i].(map[string]interface{})
-					if !ok {
-						continue
-					}
-					t, _ := el["type"].(string)
-					data, _ := el["data"].(map[string]interface{})
-					if t == "image" || t == "record" {
-						if u, _ := data["url"].(string); strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") {
-							continue
-						}
-						src := ""
-						if f, _ := data["file"].(string); f != "" {
-							src = f
-						}
-						if src == "" {
-							if pth, _ := data["path"].(string); pth != "" {
-								src = pth
-							}
-						}
-						if src == "" {
-							continue
-						}
-						// 转为 base64:// 内联
-						b64, _ := localFileToBase64URI(src, "")
-						if b64 != "" {
-							data["url"] = b64
-							data["file"] = b64
-							delete(data, "path")
-							changed = true
-						}
-					} else if t == "text" {
-						if txt, _ := data["text"].(string); txt != "" {
-							nv := rewritePictureTagInText(txt, cfg)
-							if nv != txt {
-								data["text"] = nv
-								changed = true
-							}
-						}
-					}
-				}
-				if changed {
-					p["message"] = arr
-					newCmd := oneBotCommand{Action: "send_msg", Params: p, Echo: cmd.Echo}
-					b, _ := json.Marshal(newCmd)
-					return b
+	go func() {
+		defer wg.Done()
+		for {
+			mt, msg, err := limits.readMessage(clientConn)
+			if err != nil {
+				if errors.Is(err, errMessageTooLarge) {
+					metricWSRejected.WithLabelValues("too_large").Inc()
+					loggerC.Warn("海豹消息超过大小上限，关闭连接", "session", sess.id)
+				} else if !sess.closed.Load() && unexpectedClose(err) {
+					loggerC.Error("读取海豹消息失败", "session", sess.id, "err", err)
 				}
+				_ = sess.upstreamConn().WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), timeNowPlus())
+				return
 			}
-		}
-		return msg
-	case "send_private_msg":
-		raw, _ := json.Marshal(cmd.Params)
-		var p map[string]interface{}
-		if json.Unmarshal(raw, &p) == nil {
-			if v, ok := p["message"].(string); ok {
-				nv := rewriteCQMediaInText(v, cfg)
-				nv = rewritePictureTagInText(nv, cfg)
-				if nv != v {
-					p["message"] = nv
-					newCmd := oneBotCommand{Action: "send_private_msg", Params: p, Echo: cmd.Echo}
-					b, _ := json.Marshal(newCmd)
-					return b
-				}
-			} else if arr, ok := p["message"].([]interface{}); ok {
-				changed := false
-				for i := range arr {
-					el, ok := arr[i].(map[string]interface{})
-					if !ok {
-						continue
-					}
-					t, _ := el["type"].(string)
-					data, _ := el["data"].(map[string]interface{})
-					if t == "image" || t == "record" {
-						// prefer existing http(s) url
-						if u, _ := data["url"].(string); strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") {
-							continue
-						}
-						// candidate source
-						src := ""
-						if f, _ := data["file"].(string); f != "" {
-							src = f
-						}
-						if src == "" {
-							if pth, _ := data["path"].(string); pth != "" {
-								src = pth
-							}
-						}
-						if src == "" {
-							continue
-						}
-						// 转为 base64:// 内联
-						b64, _ := localFileToBase64URI(src, "")
-						if b64 != "" {
-							data["url"] = b64
-							data["file"] = b64
-							delete(data, "path")
-							changed = true
-						}
-					} else if t == "text" {
-						if txt, _ := data["text"].(string); txt != "" {
-							nv := rewritePictureTagInText(txt, cfg)
-							if nv != txt {
-								data["text"] = nv
-								changed = true
-							}
-						}
+			if mt == websocket.TextMessage {
+				rewritten, rerr := rewriteIfUpload(cmdBytes(msg), cfg)
+				if rerr != nil {
+					// 引用了禁止读取的路径：不转发，直接回复失败
+					if err := rejectAction(sess, msg, rerr.Error()); err != nil {
+						return
 					}
+					continue
 				}
-				if changed {
-					p["message"] = arr
-					newCmd := oneBotCommand{Action: "send_private_msg", Params: p, Echo: cmd.Echo}
-					b, _ := json.Marshal(newCmd)
-					return b
+				msg = rewritten
+			}
+			up := sess.upstreamConn()
+			err = up.WriteMessage(mt, msg)
+			if err != nil && sess.upstreamConn() != up {
+				// 写入期间上游被重连，改写到新连接
+				err = sess.upstreamConn().WriteMessage(mt, msg)
+			}
+			if err != nil {
+				if !sess.closed.Load() && unexpectedClose(err) {
+					loggerC.Error("写入协议端消息失败", "session", sess.id, "err", err)
 				}
+				return
 			}
+			metricMessages.WithLabelValues(dirToUpstream).Inc()
+			sess.toUpstream.Add(1)
 		}
-		return msg
-	case "send_group_msg":
-		raw, _ := json.Marshal(cmd.Params)
-		var p map[string]interface{}
-		if json.Unmarshal(raw, &p) == nil {
-			if v, ok := p["message"].(string); ok {
-				nv := rewriteCQMediaInText(v, cfg)
-				nv = rewritePictureTagInText(nv, cfg)
-				if nv != v {
-					p["message"] = nv
-					newCmd := oneBotCommand{Action: "send_group_msg", Params: p, Echo: cmd.Echo}
-					b, _ := json.Marshal(newCmd)
-					return b
+	}()
+
+	go func() {
+		defer wg.Done()
+		for {
+			up := sess.upstreamConn()
+			mt, msg, err := upLimits.readMessage(up)
+			if err != nil {
+				if !sess.closed.Load() && sess.upstreamConn() != up {
+					// 管理接口触发了重连，继续读取新连接
+					continue
 				}
-			} else if arr, ok := p["message"].([]interface{}); ok {
-				changed := false
-				for i := range arr {
-					el, ok := arr[i].(map[string]interface{})
-					if !ok {
-						continue
-					}
-					t, _ := el["type"].(string)
-					data, _ := el["data"].(map[string]interface{})
-					if t == "image" || t == "record" {
-						if u, _ := data["url"].(string); strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") {
-							continue
-						}
-						src := ""
-						if f, _ := data["file"].(string); f != "" {
-							src = f
-						}
-						if src == "" {
-							if pth, _ := data["path"].(string); pth != "" {
-								src = pth
-							}
-						}
-						if src == "" {
-							continue
-						}
-						// 转为 base64:// 内联
-						b64, _ := localFileToBase64URI(src, "")
-						if b64 != "" {
-							data["url"] = b64
-							data["file"] = b64
-							delete(data, "path")
-							changed = true
-						}
-					} else if t == "text" {
-						if txt, _ := data["text"].(string); txt != "" {
-							nv := rewritePictureTagInText(txt, cfg)
-							if nv != txt {
-								data["text"] = nv
-								changed = true
-							}
-						}
-					}
+				if errors.Is(err, errMessageTooLarge) {
+					metricWSRejected.WithLabelValues("too_large").Inc()
+					loggerC.Warn("协议端消息超过大小上限，关闭连接", "session", sess.id)
+				} else if !sess.closed.Load() && unexpectedClose(err) {
+					loggerC.Error("读取协议端消息失败", "session", sess.id, "err", err)
 				}
-				if changed {
-					p["message"] = arr
-					newCmd := oneBotCommand{Action: "send_group_msg", Params: p, Echo: cmd.Echo}
-					b, _ := json.Marshal(newCmd)
-					return b
+				_ = clientConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), timeNowPlus())
+				return
+			}
+			if mt == websocket.TextMessage {
+				sess.observeEvent(msg)
+			}
+			if err := sess.writeClient(mt, msg); err != nil {
+				if !sess.closed.Load() && unexpectedClose(err) {
+					loggerC.Error("写入海豹消息失败", "session", sess.id, "err", err)
 				}
+				return
 			}
+			metricMessages.WithLabelValues(dirToClient).Inc()
+			sess.toClient.Add(1)
 		}
-		return msg
-	case "upload_private_file":
-		raw, _ := json.Marshal(cmd.Params)
-		var p uploadPrivateFileParams
-		if err := json.Unmarshal(raw, &p); err != nil {
-			return msg
-		}
-		// upload_private_file 统一改为用 base64:// 文件发送
-		b64, name := localFileToBase64URI(p.File, p.Name)
-		if b64 == "" {
-			return msg
-		}
-		cq := fmt.Sprintf("[CQ:file,file=%s,name=%s]", escapeCommaMaybe(b64), name)
-		newCmd := oneBotCommand{
-			Action: "send_private_msg",
-			Params: sendPrivateMsgParams{UserID: p.UserID, Message: cq},
-			Echo:   cmd.Echo,
-		}
-		b, _ := json.Marshal(newCmd)
-		return b
-	case "upload_group_file":
-		raw, _ := json.Marshal(cmd.Params)
-		var p uploadGroupFileParams
-		if err := json.Unmarshal(raw, &p); err != nil {
-			return msg
-		}
-		// upload_group_file 统一改为用 base64:// 文件发送
-		b64, name := localFileToBase64URI(p.File, p.Name)
-		if b64 == "" {
-			return msg
-		}
-		cq := fmt.Sprintf("[CQ:file,file=%s,name=%s]", escapeCommaMaybe(b64), name)
-		newCmd := oneBotCommand{
-			Action: "send_group_msg",
-			Params: sendGroupMsgParams{GroupID: p.GroupID, Message: cq},
-			Echo:   cmd.Echo,
+	}()
+
+	wg.Wait()
+	loggerC.Info("ws closed", "session", sess.id, "remote", r.RemoteAddr)
+	clientConn.Close()
+	sess.upstreamConn().Close()
+}
+
+// unexpectedClose 判断转发中的错误是否需要记录：对端正常关闭或离开（1000/1001）不算错误
+func unexpectedClose(err error) bool {
+	var ce *websocket.CloseError
+	if errors.As(err, &ce) {
+		return websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
+	}
+	return true
+}
+
+// dialUpstream 携带 access_token 连接协议端
+func dialUpstream(d *websocket.Dialer, cfg *Config) (*websocket.Conn, error) {
+	header := http.Header{}
+	if cfg.UpstreamAccessToken != "" && !cfg.UpstreamUseQueryToken {
+		header.Set("Authorization", "Bearer "+cfg.UpstreamAccessToken)
+	}
+	upstreamURL := cfg.UpstreamWSURL
+	if cfg.UpstreamAccessToken != "" && cfg.UpstreamUseQueryToken {
+		if u, e := url.Parse(upstreamURL); e == nil {
+			q := u.Query()
+			q.Set("access_token", cfg.UpstreamAccessToken)
+			u.RawQuery = q.Encode()
+			upstreamURL = u.String()
 		}
-		b, _ := json.Marshal(newCmd)
-		return b
-	default:
-		return msg
 	}
+	conn, _, err := d.Dial(upstreamURL, header)
+	return conn, err
+}
+
+// upstreamHandshakeTimeout 与 websocket.DefaultDialer 一致
+const upstreamHandshakeTimeout = 45 * time.Second
+
+func timeNowPlus() (deadline time.Time) { // minimal helper to satisfy control writes
+	return time.Now().Add(1 * time.Second)
 }
 
+func cmdBytes(b []byte) []byte { return b }
+
 func escapeCommaMaybe(text string) string { return strings.ReplaceAll(text, ",", "%2C") }
 
 // localFileToBase64URI 将本地路径 / file:// / 相对路径文件读取为 base64://data
-// 对已是 http(s)、base64:// 的输入保持原样。
-func localFileToBase64URI(path string, name string) (string, string) {
+// 对已是 http(s)、base64:// 的输入保持原样；本地路径须在 allowed_file_roots 内，否则记入 job.denied。
+func localFileToBase64URI(path string, name string, job *rewriteJob) (string, string) {
 	// 已是 http(s) 的：不动，直接返回原始路径（避免破坏已有可访问 URL）
 	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
 		if name == "" {
@@ -570,24 +607,38 @@ func localFileToBase64URI(path string, name string) (string, string) {
 			path = abs
 		}
 	}
-	f, err := os.Open(path)
+	src := path
+	if name == "" {
+		name = filepath.Base(path)
+	}
+	path, err := job.cfg.sandbox.resolve(path)
+	if errors.Is(err, errPathDenied) {
+		metricBase64Failures.Inc()
+		loggerC.Warn("拒绝读取允许目录之外的文件", "action", job.action, "src", src, "err", err)
+		job.denied = append(job.denied, src)
+		return "", ""
+	}
+	var f *os.File
+	if err == nil {
+		f, err = os.Open(path)
+	}
 	if err != nil {
-		log.Printf("open file for base64 encode failed: %v", err)
+		metricBase64Failures.Inc()
+		loggerC.Error("打开文件失败", "err", err, "path", src)
 		return "", ""
 	}
 	defer f.Close()
 	data, err := io.ReadAll(f)
 	if err != nil {
-		log.Printf("read file for base64 encode failed: %v", err)
+		metricBase64Failures.Inc()
+		loggerC.Error("读取文件失败", "err", err, "path", path)
 		return "", ""
 	}
 	if name == "" {
-		name = filepath.Base(path)
-		if name == "" {
-			name = "file.bin"
-		}
+		name = "file.bin"
 	}
 	enc := base64.StdEncoding.EncodeToString(data)
+	metricBase64Bytes.Observe(float64(len(enc)))
 	// OneBot 常见写法是 base64:// 后直接内容
 	return "base64://" + enc, name
 }
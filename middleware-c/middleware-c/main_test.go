@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMain(m *testing.M) {
+	loggerC = slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: levelVarC}))
+	os.Exit(m.Run())
+}
+
+func TestUnexpectedClose(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"正常关闭", &websocket.CloseError{Code: websocket.CloseNormalClosure}, false},
+		{"对端离开", &websocket.CloseError{Code: websocket.CloseGoingAway}, false},
+		{"异常断开", &websocket.CloseError{Code: websocket.CloseAbnormalClosure}, true},
+		{"消息过大", &websocket.CloseError{Code: websocket.CloseMessageTooBig}, true},
+		{"网络错误", errors.New("connection reset by peer"), true},
+	}
+	for _, tc := range cases {
+		if got := unexpectedClose(tc.err); got != tc.want {
+			t.Errorf("%s: unexpectedClose = %v，期望 %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus 指标，经 /metrics 暴露。
+var (
+	metricWSPairs = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "middleware_c_ws_pairs_active",
+		Help: "当前活跃的海豹-协议端 WebSocket 连接对数量",
+	})
+	metricMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "middleware_c_messages_forwarded_total",
+		Help: "转发的 WebSocket 消息数，direction 为 to_upstream 或 to_client",
+	}, []string{"direction"})
+	metricRewrites = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "middleware_c_rewrites_total",
+		Help: "成功改写的媒体数，按动作与媒体类型区分",
+	}, []string{"action", "media"})
+	metricBase64Bytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "middleware_c_base64_payload_bytes",
+		Help:    "内联的 base64 负载大小（编码后字节数）",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+	})
+	metricBase64Failures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "middleware_c_base64_failures_total",
+		Help: "读取本地文件进行 base64 编码失败的次数",
+	})
+	metricAuthFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "middleware_c_auth_failures_total",
+		Help: "海豹连接鉴权失败次数，reason 为 invalid（token 错误）或 banned（来源 IP 被临时封禁）",
+	}, []string{"reason"})
+	metricWSRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "middleware_c_ws_rejected_total",
+		Help: "被拒绝的连接或消息数，reason 为 origin、max_pairs 或 too_large（消息超过大小上限，连接随之关闭）",
+	}, []string{"reason"})
+)
+
+const (
+	dirToUpstream = "to_upstream"
+	dirToClient   = "to_client"
+)
+
+// countRewrite 记录一次成功的媒体改写。
+func (job *rewriteJob) countRewrite(media string) {
+	metricRewrites.WithLabelValues(job.action, media).Inc()
+}
+
+// countAuthFailure 记录一次海豹连接的鉴权失败。
+func (cfg *Config) countAuthFailure(reason string) {
+	metricAuthFailures.WithLabelValues(reason).Inc()
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolveProfile(t *testing.T) {
+	yes, no := true, false
+	cases := []struct {
+		name     string
+		profile  string
+		override *CompatOverride
+		want     CompatProfile
+		wantErr  bool
+	}{
+		{name: "空名称为 generic", want: compatProfiles["generic"]},
+		{name: "名称忽略大小写与空白", profile: " NapCat ", want: compatProfiles["napcat"]},
+		{name: "未知名称", profile: "mirai", wantErr: true},
+		{
+			name:     "仅覆盖显式给出的项",
+			profile:  "go-cqhttp",
+			override: &CompatOverride{UploadFileAcceptsBase64: &yes},
+			want:     CompatProfile{SegmentFields: []string{"file"}, UploadFileAcceptsBase64: true},
+		},
+		{
+			name:     "覆盖为 false 与 segment_fields",
+			profile:  "napcat",
+			override: &CompatOverride{SegmentFields: []string{"url"}, CQFileSupported: &no},
+			want:     CompatProfile{SegmentFields: []string{"url"}, UploadFileAcceptsBase64: true},
+		},
+		{
+			name:     "空 segment_fields 不覆盖",
+			profile:  "shamrock",
+			override: &CompatOverride{SegmentFields: []string{}},
+			want:     compatProfiles["shamrock"],
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := resolveProfile(tc.profile, tc.override)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("期望报错，得到 %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("得到 %+v，期望 %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestApplySegmentURL(t *testing.T) {
+	cases := []struct {
+		profile string
+		want    map[string]interface{}
+	}{
+		{"generic", map[string]interface{}{"file": "base64://AA==", "url": "base64://AA==", "name": "a.png"}},
+		{"go-cqhttp", map[string]interface{}{"file": "base64://AA==", "name": "a.png"}},
+		{"shamrock", map[string]interface{}{"file": "base64://AA==", "url": "base64://AA==", "name": "a.png"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.profile, func(t *testing.T) {
+			data := map[string]interface{}{"file": "/tmp/a.png", "path": "/tmp/a.png", "name": "a.png"}
+			compatProfiles[tc.profile].applySegmentURL(data, "base64://AA==")
+			if !reflect.DeepEqual(data, tc.want) {
+				t.Errorf("得到 %v，期望 %v", data, tc.want)
+			}
+		})
+	}
+}
+
+// 各上游配置下 upload_*_file 的改写结果：原动作内联 base64://，否则改发 [CQ:file]。
+func TestRewriteUploadFile(t *testing.T) {
+	doc, docB64 := writeMedia(t, "报告.pdf", []byte("%PDF-1.4 test"))
+	group := `{"action":"upload_group_file","params":{"group_id":1,"file":` + jsonString(doc) + `},"echo":"e1"}`
+	private := `{"action":"upload_private_file","params":{"user_id":2,"file":` + jsonString(doc) + `,"name":"年报.pdf"},"echo":"e2"}`
+	cq := "[CQ:file,file=" + docB64 + ",name=报告.pdf]"
+	cases := []struct {
+		name    string
+		profile string
+		compat  map[string]any
+		msg     string
+		want    map[string]any
+	}{
+		{
+			name:    "napcat 原动作内联 base64",
+			profile: "napcat",
+			msg:     group,
+			want:    map[string]any{"action": "upload_group_file", "params.file": docB64, "params.name": "报告.pdf", "echo": "e1"},
+		},
+		{
+			name:    "llonebot 保留给定的 name",
+			profile: "llonebot",
+			msg:     private,
+			want:    map[string]any{"action": "upload_private_file", "params.file": docB64, "params.name": "年报.pdf"},
+		},
+		{
+			name:    "generic 群文件改为 CQ:file",
+			profile: "generic",
+			msg:     group,
+			want: map[string]any{
+				"action":          "send_group_msg",
+				"params.group_id": float64(1),
+				"params.message":  cq,
+				"params.file":     nil,
+				"echo":            "e1",
+			},
+		},
+		{
+			name:    "generic 私聊文件改为 CQ:file",
+			profile: "generic",
+			msg:     private,
+			want: map[string]any{
+				"action":         "send_private_msg",
+				"params.user_id": float64(2),
+				"params.message": "[CQ:file,file=" + docB64 + ",name=年报.pdf]",
+				"echo":           "e2",
+			},
+		},
+		{
+			name:    "关闭 base64 上传后改为 CQ:file",
+			profile: "napcat",
+			compat:  map[string]any{"upload_file_accepts_base64": false},
+			msg:     group,
+			want:    map[string]any{"action": "send_group_msg", "params.message": cq},
+		},
+		{
+			name:    "go-cqhttp 无可用方式时保持原样",
+			profile: "go-cqhttp",
+			msg:     group,
+			want:    map[string]any{"action": "upload_group_file", "params.file": doc, "params.name": nil},
+		},
+		{
+			name:    "shamrock 无可用方式时保持原样",
+			profile: "shamrock",
+			msg:     private,
+			want:    map[string]any{"action": "upload_private_file", "params.file": doc},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			extra := map[string]any{"compat_profile": tc.profile}
+			if tc.compat != nil {
+				extra["compat"] = tc.compat
+			}
+			got := rewriteWith(t, extra, tc.msg)
+			for path, want := range tc.want {
+				if v := fieldAt(got, path); !reflect.DeepEqual(v, want) {
+					t.Errorf("%s = %#v，期望 %#v", path, v, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// RewriteRule 描述一条动作改写规则：对 action 的 params 中 field 指向的字段按 strategy 处理。
+// field 为以 "." 分隔的 JSON 路径，"*" 表示遍历数组的每个元素，例如 "messages.*.data.content"。
+type RewriteRule struct {
+	Action   string `json:"action"`
+	Field    string `json:"field"`
+	Strategy string `json:"strategy"`
+}
+
+const (
+	// strategyMessage 字段为消息：CQ 码字符串或消息段数组
+	strategyMessage = "message"
+	// strategyBase64 读取本地文件后替换为 base64:// 内联
+	strategyBase64 = "base64"
+	// strategyUploadFile upload_*_file 语义：改为向同一目标发送 base64:// 的 [CQ:file]
+	strategyUploadFile = "upload_file"
+)
+
+var knownStrategies = map[string]bool{
+	strategyMessage:    true,
+	strategyBase64:     true,
+	strategyUploadFile: true,
+}
+
+// defaultRewriteRules 为内置规则；配置中出现同名 action 的规则时，该 action 的内置规则整体被替换。
+var defaultRewriteRules = []RewriteRule{
+	{Action: "send_msg", Field: "message", Strategy: strategyMessage},
+	{Action: "send_private_msg", Field: "message", Strategy: strategyMessage},
+	{Action: "send_group_msg", Field: "message", Strategy: strategyMessage},
+	{Action: "send_private_forward_msg", Field: "messages", Strategy: strategyMessage},
+	{Action: "send_group_forward_msg", Field: "messages", Strategy: strategyMessage},
+	{Action: "upload_private_file", Field: "file", Strategy: strategyUploadFile},
+	{Action: "upload_group_file", Field: "file", Strategy: strategyUploadFile},
+	{Action: "set_group_portrait", Field: "file", Strategy: strategyBase64},
+	{Action: "set_qq_avatar", Field: "file", Strategy: strategyBase64},
+	{Action: "send_group_notice", Field: "image", Strategy: strategyBase64},
+}
+
+func buildMediaTypes(types []string) map[string]bool {
+	if len(types) == 0 {
+		types = defaultMediaSegmentTypes
+	}
+	m := map[string]bool{}
+	for _, t := range types {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			m[t] = true
+		}
+	}
+	return m
+}
+
+func (cfg *Config) isMediaSegment(t string) bool {
+	return cfg.mediaTypes[strings.ToLower(t)]
+}
+
+// buildRuleTable 合并内置规则与配置规则，并校验配置规则的合法性。
+func buildRuleTable(custom []RewriteRule) (map[string][]RewriteRule, error) {
+	table := map[string][]RewriteRule{}
+	overridden := map[string]bool{}
+	for i, r := range custom {
+		r.Action = strings.TrimSpace(r.Action)
+		r.Field = strings.TrimSpace(r.Field)
+		r.Strategy = strings.ToLower(strings.TrimSpace(r.Strategy))
+		if r.Action == "" || r.Field == "" {
+			return nil, fmt.Errorf("rewrite_rules[%d]: action 与 field 不能为空", i)
+		}
+		if !knownStrategies[r.Strategy] {
+			return nil, fmt.Errorf("rewrite_rules[%d]: 未知的 strategy %q", i, r.Strategy)
+		}
+		overridden[r.Action] = true
+		table[r.Action] = append(table[r.Action], r)
+	}
+	for _, r := range defaultRewriteRules {
+		if overridden[r.Action] {
+			continue
+		}
+		table[r.Action] = append(table[r.Action], r)
+	}
+	return table, nil
+}
+
+func (cfg *Config) rulesFor(action string) []RewriteRule {
+	return cfg.ruleTable[action]
+}
+
+// rewriteJob 为一次动作改写的上下文，贯穿消息段改写与 base64 内联。
+type rewriteJob struct {
+	cfg    *Config
+	action string
+	denied []string // 不在 allowed_file_roots 内而被拒绝的来源
+}
+
+func rewriteIfUpload(msg []byte, cfg *Config) ([]byte, error) {
+	var cmd oneBotCommand
+	if err := json.Unmarshal(msg, &cmd); err != nil {
+		return msg, nil
+	}
+	rules := cfg.rulesFor(cmd.Action)
+	if len(rules) == 0 {
+		return msg, nil
+	}
+	p, ok := cmd.Params.(map[string]interface{})
+	if !ok {
+		return msg, nil
+	}
+	job := &rewriteJob{cfg: cfg, action: cmd.Action}
+	out := applyRules(cmd, p, rules, job, msg)
+	if len(job.denied) > 0 {
+		return msg, fmt.Errorf("%w: %s", errPathDenied, strings.Join(job.denied, ", "))
+	}
+	return out, nil
+}
+
+// applyRules 依次应用动作的改写规则，未发生变化时原样返回 msg。
+func applyRules(cmd oneBotCommand, p map[string]interface{}, rules []RewriteRule, job *rewriteJob, msg []byte) []byte {
+	changed := false
+	for _, rule := range rules {
+		if rule.Strategy == strategyUploadFile {
+			if b := rewriteUploadFile(cmd, p, rule, job); b != nil {
+				return b
+			}
+			continue
+		}
+		if _, ch := applyRule(p, strings.Split(rule.Field, "."), rule.Strategy, job); ch {
+			changed = true
+		}
+	}
+	if !changed {
+		return msg
+	}
+	b, _ := json.Marshal(oneBotCommand{Action: cmd.Action, Params: p, Echo: cmd.Echo})
+	return b
+}
+
+// applyRule 沿 path 定位字段并按 strategy 改写，返回新值与是否发生变化。
+func applyRule(v interface{}, path []string, strategy string, job *rewriteJob) (interface{}, bool) {
+	if len(path) == 0 {
+		switch strategy {
+		case strategyMessage:
+			return rewriteMessageValue(v, job)
+		case strategyBase64:
+			return rewriteFileValue(v, job)
+		}
+		return v, false
+	}
+	key := path[0]
+	switch node := v.(type) {
+	case map[string]interface{}:
+		child, ok := node[key]
+		if !ok {
+			return v, false
+		}
+		nv, ch := applyRule(child, path[1:], strategy, job)
+		if ch {
+			node[key] = nv
+		}
+		return node, ch
+	case []interface{}:
+		if key != "*" {
+			return v, false
+		}
+		changed := false
+		for i := range node {
+			nv, ch := applyRule(node[i], path[1:], strategy, job)
+			if ch {
+				node[i] = nv
+				changed = true
+			}
+		}
+		return node, changed
+	}
+	return v, false
+}
+
+func rewriteFileValue(v interface{}, job *rewriteJob) (interface{}, bool) {
+	src, _ := v.(string)
+	if src == "" || isRemoteURL(src) || strings.HasPrefix(src, "base64://") {
+		return v, false
+	}
+	b64, _ := localFileToBase64URI(src, "", job)
+	if b64 == "" {
+		return v, false
+	}
+	job.countRewrite("file")
+	return b64, true
+}
+
+// rewriteUploadFile 处理 upload_*_file 类动作：上游接受 base64:// 时原动作直接内联，
+// 否则改为向同一目标发送 base64:// 的 [CQ:file]。返回 nil 表示未改写。
+func rewriteUploadFile(cmd oneBotCommand, p map[string]interface{}, rule RewriteRule, job *rewriteJob) []byte {
+	path := strings.Split(rule.Field, ".")
+	file, _ := lookupField(p, path).(string)
+	if file == "" {
+		return nil
+	}
+	name, _ := p["name"].(string)
+	b64, name := localFileToBase64URI(file, name, job)
+	if b64 == "" {
+		return nil
+	}
+	if job.cfg.profile.UploadFileAcceptsBase64 {
+		job.countRewrite("file")
+		setField(p, path, b64)
+		if name != "" {
+			p["name"] = name
+		}
+		b, _ := json.Marshal(oneBotCommand{Action: cmd.Action, Params: p, Echo: cmd.Echo})
+		return b
+	}
+	if !job.cfg.profile.CQFileSupported {
+		loggerC.Warn("上游既不支持 base64 上传也不支持 CQ:file，保持原样", "action", cmd.Action, "profile", job.cfg.CompatProfile)
+		return nil
+	}
+	job.countRewrite("file")
+	cq := fmt.Sprintf("[CQ:file,file=%s,name=%s]", escapeCommaMaybe(b64), name)
+	var newCmd oneBotCommand
+	if gid, ok := p["group_id"]; ok {
+		newCmd = oneBotCommand{Action: "send_group_msg", Params: map[string]interface{}{"group_id": gid, "message": cq}, Echo: cmd.Echo}
+	} else if uid, ok := p["user_id"]; ok {
+		newCmd = oneBotCommand{Action: "send_private_msg", Params: map[string]interface{}{"user_id": uid, "message": cq}, Echo: cmd.Echo}
+	} else {
+		return nil
+	}
+	b, _ := json.Marshal(newCmd)
+	return b
+}
+
+func setField(m map[string]interface{}, path []string, val interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := m[key].(map[string]interface{})
+		if !ok {
+			return
+		}
+		m = next
+	}
+	m[path[len(path)-1]] = val
+}
+
+func lookupField(v interface{}, path []string) interface{} {
+	for _, key := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+// rewriteMessageValue 改写消息字段，支持 CQ 码字符串与消息段数组两种形式。
+func rewriteMessageValue(v interface{}, job *rewriteJob) (interface{}, bool) {
+	switch m := v.(type) {
+	case string:
+		nv := rewriteCQMediaInText(m, job)
+		nv = rewritePictureTagInText(nv, job)
+		return nv, nv != m
+	case []interface{}:
+		return m, rewriteMessageSegments(m, job)
+	case map[string]interface{}:
+		// 单个消息段
+		arr := []interface{}{m}
+		return m, rewriteMessageSegments(arr, job)
+	}
+	return v, false
+}
+
+func rewriteMessageSegments(arr []interface{}, job *rewriteJob) bool {
+	changed := false
+	for i := range arr {
+		el, ok := arr[i].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		t, _ := el["type"].(string)
+		data, _ := el["data"].(map[string]interface{})
+		if data == nil {
+			continue
+		}
+		if job.cfg.isMediaSegment(t) {
+			// prefer existing http(s) url
+			if u, _ := data["url"].(string); isRemoteURL(u) {
+				continue
+			}
+			// candidate source
+			src := ""
+			for _, k := range []string{"file", "path", "url"} {
+				if v, _ := data[k].(string); v != "" {
+					src = v
+					break
+				}
+			}
+			if src == "" || isRemoteURL(src) || strings.HasPrefix(src, "base64://") {
+				continue
+			}
+			// 转为 base64:// 内联
+			name, _ := data["name"].(string)
+			b64, name := localFileToBase64URI(src, name, job)
+			if b64 != "" {
+				job.cfg.profile.applySegmentURL(data, b64)
+				job.countRewrite(t)
+				// 文件类消息段保留原始文件名
+				if t == "file" && name != "" {
+					data["name"] = name
+				}
+				changed = true
+			}
+		} else if t == "text" {
+			if txt, _ := data["text"].(string); txt != "" {
+				nv := rewritePictureTagInText(txt, job)
+				if nv != txt {
+					data["text"] = nv
+					changed = true
+				}
+			}
+		} else if t == "node" {
+			// 合并转发中的自定义节点
+			if nv, ch := rewriteMessageValue(data["content"], job); ch {
+				data["content"] = nv
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+func isRemoteURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// rewriteWith 以 extra 为配置加载 c，改写 msg 并返回解析后的动作
+func rewriteWith(t *testing.T, extra map[string]any, msg string) map[string]any {
+	t.Helper()
+	raw, err := json.Marshal(extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(p, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(p)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	out, err := rewriteIfUpload([]byte(msg), cfg)
+	if err != nil {
+		t.Fatalf("rewriteIfUpload: %v", err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("改写结果不是合法 JSON: %v\n%s", err, out)
+	}
+	return got
+}
+
+// fieldAt 按以 "." 分隔的路径取值，数组下标写作数字
+func fieldAt(v any, path string) any {
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]any:
+			v = node[key]
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i >= len(node) {
+				return nil
+			}
+			v = node[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+// writeMedia 在临时目录写入 name，返回其路径与对应的 base64:// 地址
+func writeMedia(t *testing.T, name string, data []byte) (string, string) {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p, "base64://" + base64.StdEncoding.EncodeToString(data)
+}
+
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+func TestBuildRuleTable(t *testing.T) {
+	defaults := func(action string) []RewriteRule {
+		var rs []RewriteRule
+		for _, r := range defaultRewriteRules {
+			if r.Action == action {
+				rs = append(rs, r)
+			}
+		}
+		return rs
+	}
+	cases := []struct {
+		name    string
+		custom  []RewriteRule
+		want    map[string][]RewriteRule
+		wantErr string
+	}{
+		{
+			name: "未配置时使用内置规则",
+			want: map[string][]RewriteRule{
+				"send_group_msg":     defaults("send_group_msg"),
+				"upload_group_file":  defaults("upload_group_file"),
+				"set_group_portrait": defaults("set_group_portrait"),
+				"set_qq_avatar":      defaults("set_qq_avatar"),
+				"send_group_notice":  defaults("send_group_notice"),
+			},
+		},
+		{
+			name: "同名 action 整体替换内置规则，其余保留",
+			custom: []RewriteRule{
+				{Action: "send_group_msg", Field: "extra", Strategy: "base64"},
+				{Action: "send_group_msg", Field: "message", Strategy: "message"},
+			},
+			want: map[string][]RewriteRule{
+				"send_group_msg": {
+					{Action: "send_group_msg", Field: "extra", Strategy: strategyBase64},
+					{Action: "send_group_msg", Field: "message", Strategy: strategyMessage},
+				},
+				"send_private_msg": defaults("send_private_msg"),
+			},
+		},
+		{
+			name:   "新增 action 并规范化空白与大小写",
+			custom: []RewriteRule{{Action: " x_batch ", Field: " items.*.pic ", Strategy: " Base64 "}},
+			want: map[string][]RewriteRule{
+				"x_batch":        {{Action: "x_batch", Field: "items.*.pic", Strategy: strategyBase64}},
+				"send_group_msg": defaults("send_group_msg"),
+			},
+		},
+		{
+			name:    "action 为空",
+			custom:  []RewriteRule{{Field: "file", Strategy: "base64"}},
+			wantErr: "rewrite_rules[0]",
+		},
+		{
+			name:    "field 为空",
+			custom:  []RewriteRule{{Action: "a", Strategy: "base64"}},
+			wantErr: "rewrite_rules[0]",
+		},
+		{
+			name:    "a 的 url 策略在 c 中无效",
+			custom:  []RewriteRule{{Action: "a", Field: "file", Strategy: "base64"}, {Action: "b", Field: "file", Strategy: "url"}},
+			wantErr: `rewrite_rules[1]: 未知的 strategy "url"`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			table, err := buildRuleTable(tc.custom)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("err = %v，期望包含 %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for action, want := range tc.want {
+				if got := table[action]; !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: %+v，期望 %+v", action, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRewriteRules(t *testing.T) {
+	pic, picB64 := writeMedia(t, "a.png", []byte("\x89PNG\r\n\x1a\n-test-image"))
+	doc, docB64 := writeMedia(t, "报告.pdf", []byte("%PDF-1.4"))
+	src := jsonString(pic)
+	overrideMsg := map[string]any{"rewrite_rules": []map[string]any{
+		{"action": "send_group_msg", "field": "extra", "strategy": "base64"},
+	}}
+	batch := map[string]any{"rewrite_rules": []map[string]any{
+		{"action": "x_batch", "field": "items.*.pic", "strategy": "base64"},
+	}}
+	forward := map[string]any{"rewrite_rules": []map[string]any{
+		{"action": "send_group_forward_msg", "field": "messages.*.data.content", "strategy": "message"},
+	}}
+	cases := []struct {
+		name  string
+		extra map[string]any
+		msg   string
+		want  map[string]any
+	}{
+		{
+			name: "image 消息段",
+			msg:  `{"action":"send_group_msg","params":{"group_id":1,"message":[{"type":"image","data":{"file":` + src + `,"path":` + src + `}}]}}`,
+			want: map[string]any{
+				"params.message.0.data.file": picB64,
+				"params.message.0.data.url":  picB64,
+				"params.message.0.data.path": nil,
+			},
+		},
+		{
+			name: "CQ 码字符串",
+			msg:  `{"action":"send_private_msg","params":{"user_id":1,"message":` + jsonString("看[CQ:image,file="+pic+",name=a.png]") + `}}`,
+			want: map[string]any{"params.message": "看[CQ:image,file=" + picB64 + ",name=a.png]"},
+		},
+		{
+			name: "mface 扩展消息段",
+			msg:  `{"action":"send_group_msg","params":{"group_id":1,"message":[{"type":"mface","data":{"file":` + src + `,"summary":"[表情]"}}]}}`,
+			want: map[string]any{
+				"params.message.0.data.file":    picB64,
+				"params.message.0.data.summary": "[表情]",
+			},
+		},
+		{
+			name: "file 消息段保留 name",
+			msg:  `{"action":"send_group_msg","params":{"group_id":1,"message":[{"type":"file","data":{"file":` + jsonString(doc) + `,"name":"年报.pdf"}}]}}`,
+			want: map[string]any{
+				"params.message.0.data.file": docB64,
+				"params.message.0.data.name": "年报.pdf",
+			},
+		},
+		{
+			name: "file 消息段缺 name 时取本地文件名",
+			msg:  `{"action":"send_group_msg","params":{"group_id":1,"message":[{"type":"file","data":{"file":` + jsonString(doc) + `}}]}}`,
+			want: map[string]any{
+				"params.message.0.data.file": docB64,
+				"params.message.0.data.name": "报告.pdf",
+			},
+		},
+		{
+			name: "已有 http url 不改写",
+			msg:  `{"action":"send_group_msg","params":{"group_id":1,"message":[{"type":"image","data":{"file":` + src + `,"url":"http://x/a.png"}}]}}`,
+			want: map[string]any{"params.message.0.data.file": pic},
+		},
+		{
+			name: "已是 base64 不改写",
+			msg:  `{"action":"send_group_msg","params":{"group_id":1,"message":[{"type":"image","data":{"file":"` + docB64 + `"}}]}}`,
+			want: map[string]any{"params.message.0.data.file": docB64, "params.message.0.data.url": nil},
+		},
+		{
+			name: "非媒体消息段不改写",
+			msg:  `{"action":"send_group_msg","params":{"group_id":1,"message":[{"type":"json","data":{"file":` + src + `}}]}}`,
+			want: map[string]any{"params.message.0.data.file": pic},
+		},
+		{
+			name:  "media_segment_types 替换默认类型",
+			extra: map[string]any{"media_segment_types": []string{"sticker"}},
+			msg:   `{"action":"send_group_msg","params":{"group_id":1,"message":[{"type":"sticker","data":{"file":` + src + `}},{"type":"image","data":{"file":` + src + `}}]}}`,
+			want: map[string]any{
+				"params.message.0.data.file": picB64,
+				"params.message.1.data.file": pic,
+			},
+		},
+		{
+			name: "合并转发的 node 内容",
+			msg:  `{"action":"send_group_forward_msg","params":{"group_id":1,"messages":[{"type":"node","data":{"content":[{"type":"image","data":{"file":` + src + `}}]}}]}}`,
+			want: map[string]any{"params.messages.0.data.content.0.data.file": picB64},
+		},
+		{
+			name:  "通配路径遍历消息数组",
+			extra: forward,
+			msg:   `{"action":"send_group_forward_msg","params":{"group_id":1,"messages":[{"type":"node","data":{"content":` + jsonString("[CQ:image,file="+pic+",name=a.png]") + `}},{"type":"node","data":{"content":"纯文本"}}]}}`,
+			want: map[string]any{
+				"params.messages.0.data.content": "[CQ:image,file=" + picB64 + ",name=a.png]",
+				"params.messages.1.data.content": "纯文本",
+			},
+		},
+		{
+			name:  "通配路径按 base64 策略改写每个元素",
+			extra: batch,
+			msg:   `{"action":"x_batch","params":{"items":[{"pic":` + src + `},{"pic":"http://x/1.png"},{"other":1}]}}`,
+			want: map[string]any{
+				"params.items.0.pic": picB64,
+				"params.items.1.pic": "http://x/1.png",
+				"params.items.2.pic": nil,
+			},
+		},
+		{
+			name:  "通配符只匹配数组",
+			extra: batch,
+			msg:   `{"action":"x_batch","params":{"items":{"pic":` + src + `}}}`,
+			want:  map[string]any{"params.items.pic": pic},
+		},
+		{
+			name:  "覆盖内置规则后原字段不再改写",
+			extra: overrideMsg,
+			msg:   `{"action":"send_group_msg","params":{"group_id":1,"extra":` + src + `,"message":[{"type":"image","data":{"file":` + src + `}}]}}`,
+			want: map[string]any{
+				"params.extra":               picB64,
+				"params.message.0.data.file": pic,
+			},
+		},
+		{
+			name:  "覆盖不影响其他 action 的内置规则",
+			extra: overrideMsg,
+			msg:   `{"action":"send_private_msg","params":{"user_id":1,"message":[{"type":"image","data":{"file":` + src + `}}]}}`,
+			want:  map[string]any{"params.message.0.data.file": picB64},
+		},
+		{
+			name: "set_group_portrait",
+			msg:  `{"action":"set_group_portrait","params":{"group_id":1,"file":` + src + `}}`,
+			want: map[string]any{"params.file": picB64, "params.group_id": float64(1)},
+		},
+		{
+			name: "set_qq_avatar",
+			msg:  `{"action":"set_qq_avatar","params":{"file":"file://` + filepath.ToSlash(pic) + `"}}`,
+			want: map[string]any{"params.file": picB64},
+		},
+		{
+			name: "send_group_notice 的 image",
+			msg:  `{"action":"send_group_notice","params":{"group_id":1,"content":"公告","image":` + src + `}}`,
+			want: map[string]any{"params.image": picB64, "params.content": "公告"},
+		},
+		{
+			name: "send_group_notice 的 image 已是 URL",
+			msg:  `{"action":"send_group_notice","params":{"group_id":1,"content":"公告","image":"https://x/a.png"}}`,
+			want: map[string]any{"params.image": "https://x/a.png"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := rewriteWith(t, tc.extra, tc.msg)
+			for path, want := range tc.want {
+				if v := fieldAt(got, path); !reflect.DeepEqual(v, want) {
+					t.Errorf("%s = %#v，期望 %#v", path, v, want)
+				}
+			}
+		})
+	}
+}
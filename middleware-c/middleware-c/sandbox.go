@@ -0,0 +1,90 @@
+// 共享文件：与其他模块中的同名文件保持一致，以 middleware-a 中的为准。
+// 修改后运行 scripts/shared-files.sh sync 同步，CI 中由 scripts/shared-files.sh check 检查。
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// errPathDenied 表示消息中的本地路径解析后不在 allowed_file_roots 内
+var errPathDenied = errors.New("path outside allowed_file_roots")
+
+// fileSandbox 限制可读取的本地文件：路径解析符号链接后必须位于某个允许目录之下。
+// nil 表示未配置 allowed_file_roots，不作限制。
+type fileSandbox struct {
+	roots []string // 已解析符号链接的绝对路径
+}
+
+func newFileSandbox(roots []string) (*fileSandbox, error) {
+	if len(roots) == 0 {
+		return nil, nil
+	}
+	sb := &fileSandbox{}
+	for i, r := range roots {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		abs, err := filepath.Abs(r)
+		if err != nil {
+			return nil, fmt.Errorf("allowed_file_roots[%d]: %w", i, err)
+		}
+		real, err := filepath.EvalSymlinks(abs)
+		if err != nil {
+			return nil, fmt.Errorf("allowed_file_roots[%d]: %w", i, err)
+		}
+		sb.roots = append(sb.roots, real)
+	}
+	if len(sb.roots) == 0 {
+		return nil, errors.New("allowed_file_roots 不能只包含空路径")
+	}
+	return sb, nil
+}
+
+// resolve 解析 path（绝对路径）中的符号链接并返回真实路径，之后应只打开该路径；
+// 不在任何允许目录之下时返回 errPathDenied。
+func (sb *fileSandbox) resolve(path string) (string, error) {
+	if sb == nil {
+		return path, nil
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	for _, root := range sb.roots {
+		if withinDir(root, real) {
+			return real, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", errPathDenied, real)
+}
+
+// withinDir 判断 path 是否为 dir 本身或其下的文件
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || filepath.IsAbs(rel) {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// rejectAction 不转发引用了禁止路径的动作，直接向海豹返回失败响应。
+func rejectAction(sess *session, msg []byte, reason string) error {
+	var cmd oneBotCommand
+	_ = json.Unmarshal(msg, &cmd)
+	resp, _ := json.Marshal(map[string]interface{}{
+		"status":  "failed",
+		"retcode": 1403,
+		"data":    nil,
+		"msg":     "FORBIDDEN",
+		"wording": reason,
+		"echo":    cmd.Echo,
+	})
+	return sess.writeClient(websocket.TextMessage, resp)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 路径检查本身见 middleware-a/sandbox_test.go；这里只检查 c 内联本地文件时同样受 allowed_file_roots 限制。
+func TestLocalFileToBase64URISandbox(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, outside := filepath.Join(dir, "root"), filepath.Join(dir, "outside")
+	for _, d := range []string{root, outside} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(d, "a.png"), []byte(d), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := filepath.Join(root, "link.png")
+	hasLink := os.Symlink(filepath.Join(outside, "a.png"), link) == nil
+	sb, err := newFileSandbox([]string{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		src    string
+		want   string // 期望内联的文件内容，为空表示拒绝
+		denied bool
+	}{
+		{"目录内", filepath.Join(root, "a.png"), root, false},
+		{"file:// 目录内", "file://" + filepath.ToSlash(filepath.Join(root, "a.png")), root, false},
+		{"目录外", filepath.Join(outside, "a.png"), "", true},
+		{".. 跳出", filepath.Join(root, "..", "outside", "a.png"), "", true},
+		{"链接跳出", link, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.name == "链接跳出" && !hasLink {
+				t.Skip("不支持符号链接")
+			}
+			job := &rewriteJob{cfg: &Config{sandbox: sb}, action: "send_group_msg"}
+			got, _ := localFileToBase64URI(tt.src, "", job)
+			if tt.denied {
+				if got != "" || len(job.denied) != 1 {
+					t.Fatalf("应拒绝: got %.40q, denied %v", got, job.denied)
+				}
+				return
+			}
+			if want := "base64://" + base64.StdEncoding.EncodeToString([]byte(tt.want)); got != want || len(job.denied) != 0 {
+				t.Fatalf("got %.40q, denied %v", got, job.denied)
+			}
+		})
+	}
+}
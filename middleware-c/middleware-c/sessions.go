@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// session 为一对海豹-协议端 WebSocket 连接，登记在 sessions 中供管理接口查询与操作。
+type session struct {
+	id      string
+	remote  string
+	started time.Time
+	cfg     *Config
+
+	client   *websocket.Conn
+	clientMu sync.Mutex // 串行化向海豹的写入
+
+	mu         sync.Mutex
+	upstream   *websocket.Conn
+	selfID     string
+	reconnects int
+
+	closed     atomic.Bool
+	toUpstream atomic.Int64
+	toClient   atomic.Int64
+}
+
+// sessionInfo 为管理接口返回的会话快照
+type sessionInfo struct {
+	ID          string    `json:"id"`
+	Remote      string    `json:"remote"`
+	SelfID      string    `json:"self_id,omitempty"`
+	UpstreamURL string    `json:"upstream_url"`
+	StartedAt   time.Time `json:"started_at"`
+	ToUpstream  int64     `json:"messages_to_upstream"`
+	ToClient    int64     `json:"messages_to_client"`
+	Reconnects  int       `json:"reconnects"`
+}
+
+var sessions sync.Map // id -> *session
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func registerSession(s *session) { sessions.Store(s.id, s) }
+
+func unregisterSession(s *session) { sessions.Delete(s.id) }
+
+func lookupSession(id string) *session {
+	v, ok := sessions.Load(id)
+	if !ok {
+		return nil
+	}
+	return v.(*session)
+}
+
+func listSessions() []sessionInfo {
+	out := []sessionInfo{}
+	sessions.Range(func(_, v any) bool {
+		out = append(out, v.(*session).info())
+		return true
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAt.Before(out[j].StartedAt) })
+	return out
+}
+
+func (s *session) info() sessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sessionInfo{
+		ID:          s.id,
+		Remote:      s.remote,
+		SelfID:      s.selfID,
+		UpstreamURL: s.cfg.UpstreamWSURL,
+		StartedAt:   s.started,
+		ToUpstream:  s.toUpstream.Load(),
+		ToClient:    s.toClient.Load(),
+		Reconnects:  s.reconnects,
+	}
+}
+
+// writeClient 向海豹写入一条消息，可由多个协程调用
+func (s *session) writeClient(mt int, msg []byte) error {
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+	return s.client.WriteMessage(mt, msg)
+}
+
+func (s *session) upstreamConn() *websocket.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.upstream
+}
+
+// observeEvent 从上游事件中记录机器人账号，只解析首个携带 self_id 的事件。
+func (s *session) observeEvent(msg []byte) {
+	s.mu.Lock()
+	known := s.selfID != ""
+	s.mu.Unlock()
+	if known || !bytes.Contains(msg, []byte(`"self_id"`)) {
+		return
+	}
+	var ev struct {
+		SelfID json.Number `json:"self_id"`
+	}
+	if json.Unmarshal(msg, &ev) != nil || ev.SelfID == "" {
+		return
+	}
+	s.mu.Lock()
+	s.selfID = ev.SelfID.String()
+	s.mu.Unlock()
+}
+
+// reconnectUpstream 先建立新的上游连接再替换旧连接，转发协程随后切换到新连接。
+func (s *session) reconnectUpstream() error {
+	conn, err := dialUpstream(s.cfg.upstreamDialer(upstreamHandshakeTimeout), s.cfg)
+	if err != nil {
+		return err
+	}
+	s.cfg.wsLimits().upstream().setup(conn)
+	s.mu.Lock()
+	old := s.upstream
+	s.upstream = conn
+	s.reconnects++
+	s.mu.Unlock()
+	if old != nil {
+		_ = old.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), timeNowPlus())
+		old.Close()
+	}
+	return nil
+}
+
+// close 强制关闭两端连接，转发协程随之退出。
+func (s *session) close(reason string) {
+	if !s.closed.CompareAndSwap(false, true) {
+		return
+	}
+	_ = s.client.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason), timeNowPlus())
+	s.client.Close()
+	if up := s.upstreamConn(); up != nil {
+		_ = up.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason), timeNowPlus())
+		up.Close()
+	}
+}
@@ -0,0 +1,60 @@
+// 共享文件：与其他模块中的同名文件保持一致，以 middleware-a 中的为准。
+// 修改后运行 scripts/shared-files.sh sync 同步，CI 中由 scripts/shared-files.sh check 检查。
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ClientTLSConfig 为连接上游（协议端，a 中还包括 b）时的 TLS 配置，全部为空时使用系统默认设置。
+type ClientTLSConfig struct {
+	// CAFile 额外信任的 CA 证书（PEM，可包含多个），与系统根证书一起使用
+	CAFile string `json:"ca_file"`
+	// CertFile / KeyFile 客户端证书，用于双向 TLS，文件变更后自动重新加载
+	CertFile   string `json:"cert_file"`
+	KeyFile    string `json:"key_file"`
+	ServerName string `json:"server_name"`
+	// InsecureSkipVerify 不校验服务端证书，仅用于调试
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+}
+
+// build 生成拨号使用的 *tls.Config，未配置任何字段时返回 nil（使用默认设置）。
+func (tc ClientTLSConfig) build() (*tls.Config, error) {
+	if tc == (ClientTLSConfig{}) {
+		return nil, nil
+	}
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         tc.ServerName,
+		InsecureSkipVerify: tc.InsecureSkipVerify,
+	}
+	var err error
+	if tc.CAFile != "" {
+		if cfg.RootCAs, err = loadCertPool(tc.CAFile, true); err != nil {
+			return nil, fmt.Errorf("ca_file: %w", err)
+		}
+	}
+	if tc.CertFile != "" || tc.KeyFile != "" {
+		cr, err := newCertReloader(tc.CertFile, tc.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return cr.get() }
+	}
+	return cfg, nil
+}
+
+// upstreamDialer 返回连接协议端使用的 Dialer，携带 upstream_tls 配置。
+func (cfg *Config) upstreamDialer(handshakeTimeout time.Duration) *websocket.Dialer {
+	return &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: handshakeTimeout,
+		TLSClientConfig:  cfg.upstreamTLS,
+	}
+}
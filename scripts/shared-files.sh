@@ -0,0 +1,62 @@
+#!/usr/bin/env bash
+# 三个模块各自独立构建（Docker 构建上下文为各自目录），通用代码以副本形式存在于各模块中。
+# 副本以 middleware-a 为准，只允许日志变量名不同（loggerA / loggerB / loggerC）。
+#
+#   scripts/shared-files.sh check   检查副本是否与 middleware-a 一致，不一致时输出 diff 并返回 1
+#   scripts/shared-files.sh sync    以 middleware-a 中的文件覆盖其他模块中的副本
+set -euo pipefail
+
+root="$(cd "$(dirname "$0")/.." && pwd)"
+src="$root/middleware-a"
+b="$root/middleware-b"
+c="$root/middleware-c/middleware-c"
+
+# 文件名与持有副本的模块目录
+shared=(
+	"logfile.go $b $c"
+	"logfile_unix.go $b $c"
+	"logfile_windows.go $b $c"
+	"tlsconf.go $b $c"
+	"tlsclient.go $c"
+	"auth.go $c"
+	"wslimits.go $c"
+	"sandbox.go $c"
+)
+
+# expected 输出 middleware-a 中的 file 在模块 dir 中应有的内容
+expected() {
+	local file="$1" dir="$2" logger
+	case "$dir" in
+	"$b") logger=loggerB ;;
+	"$c") logger=loggerC ;;
+	esac
+	sed "s/loggerA/$logger/g" "$src/$file"
+}
+
+mode="${1:-check}"
+failed=0
+for entry in "${shared[@]}"; do
+	read -r file dirs <<<"$entry"
+	for dir in $dirs; do
+		rel="${dir#"$root"/}/$file"
+		case "$mode" in
+		check)
+			if ! diff -u --label "$rel (期望)" --label "$rel" <(expected "$file" "$dir") "$dir/$file"; then
+				failed=1
+			fi
+			;;
+		sync)
+			expected "$file" "$dir" >"$dir/$file"
+			echo "已同步 $rel"
+			;;
+		*)
+			echo "用法: $0 [check|sync]" >&2
+			exit 2
+			;;
+		esac
+	done
+done
+if [ "$failed" -ne 0 ]; then
+	echo "共享文件与 middleware-a 不一致，请在 middleware-a 中修改后运行 $0 sync" >&2
+	exit 1
+fi